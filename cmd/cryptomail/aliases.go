@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pentateu/email-cloud-service/mail"
+	"github.com/spf13/cobra"
+)
+
+var (
+	aliasesConfigPath  string
+	aliasesAccount     string
+	aliasCorrespondent string
+
+	aliasesCmd = &cobra.Command{
+		Use:   "aliases",
+		Short: "Manage the unlinkable alias addresses of the accounts",
+		Long: `Aliases are random addresses delivered to an account, one per correspondent, so the addresses given
+to different correspondents can't be linked. They need maildir_aliases_path and a KMS, see --kms`,
+	}
+
+	aliasesCreateCmd = &cobra.Command{
+		Use:   "create",
+		Short: "Issue a new alias for an account",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if aliasesAccount == "" {
+				return errors.New("--account is required")
+			}
+			a, err := mail.CreateAlias(aliasesConfigPath, aliasesAccount, aliasCorrespondent)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", a.Alias)
+			return nil
+		},
+	}
+
+	aliasesListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the aliases of an account",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if aliasesAccount == "" {
+				return errors.New("--account is required")
+			}
+			aliases, err := mail.ListAliases(aliasesConfigPath, aliasesAccount)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ALIAS\tSTATUS\tCREATED\tCORRESPONDENT")
+			for _, a := range aliases {
+				status := "active"
+				if a.Revoked {
+					status = "revoked"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Alias, status, a.Created.Format(time.RFC3339), a.Correspondent)
+			}
+			return tw.Flush()
+		},
+	}
+
+	aliasesRevokeCmd = &cobra.Command{
+		Use:   "revoke <alias>",
+		Short: "Revoke an alias, mail to it is refused",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := mail.RevokeAlias(aliasesConfigPath, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("revoked %s of %s\n", a.Alias, a.Account)
+			return nil
+		},
+	}
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{aliasesCreateCmd, aliasesListCmd, aliasesRevokeCmd} {
+		cmd.Flags().StringVarP(&aliasesConfigPath, "config", "c",
+			"maildiranasaurus.conf", "Path to the configuration file")
+	}
+	for _, cmd := range []*cobra.Command{aliasesCreateCmd, aliasesListCmd} {
+		cmd.Flags().StringVar(&aliasesAccount, "account", "", "Account the aliases are delivered to")
+	}
+	aliasesCreateCmd.Flags().StringVar(&aliasCorrespondent, "for", "",
+		"Label of the correspondent the alias is given to, only stored encrypted")
+	aliasesCmd.AddCommand(aliasesCreateCmd, aliasesListCmd, aliasesRevokeCmd)
+	rootCmd.AddCommand(aliasesCmd)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	ipfs "github.com/pentateu/email-cloud-service/ipfsnode"
+	"github.com/pentateu/email-cloud-service/mail"
+	"github.com/spf13/cobra"
+)
+
+var (
+	carConfigPath string
+	exportAccount string
+	exportOut     string
+	importAccount string
+
+	exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the mailbox of an account to a CAR file",
+		Long: `Writes a CARv1 file with the mailbox DAG root and every message block, for offline backups or to move an account to another service node.
+The service must be stopped, the command opens its IPFS repo and Maildir index`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if exportAccount == "" || exportOut == "" {
+				return errors.New("--account and --out are required")
+			}
+			if err := ipfs.CheckRepo(); err != nil {
+				return err
+			}
+			ipfsNode, err := ipfs.Start(cmd, args)
+			if err != nil {
+				return err
+			}
+			f, err := os.Create(exportOut)
+			if err != nil {
+				return err
+			}
+			root, err := mail.ExportCAR(context.Background(), carConfigPath, ipfsNode, exportAccount, f)
+			if err != nil {
+				f.Close()
+				os.Remove(exportOut)
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			fmt.Printf("exported %s to %s, root %s\n", exportAccount, exportOut, root)
+			return nil
+		},
+	}
+
+	importCmd = &cobra.Command{
+		Use:   "import <mailbox.car>",
+		Short: "Import a mailbox exported to a CAR file",
+		Long: `Loads the blocks of a CAR file written by export into the node and delivers the messages to the account Maildir.
+The service must be stopped, the command opens its IPFS repo and Maildir index. The service uploads
+the imported messages, and pins them to the remote pinning services, when it starts again`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := ipfs.CheckRepo(); err != nil {
+				return err
+			}
+			ipfsNode, err := ipfs.Start(cmd, args)
+			if err != nil {
+				return err
+			}
+			n, err := mail.ImportCAR(context.Background(), carConfigPath, ipfsNode, f, importAccount)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("imported %d messages from %s\n", n, args[0])
+			return nil
+		},
+	}
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		cmd.Flags().StringVarP(&carConfigPath, "config", "c",
+			"maildiranasaurus.conf", "Path to the configuration file")
+	}
+	exportCmd.Flags().StringVar(&exportAccount, "account", "", "Account to export")
+	exportCmd.Flags().StringVar(&exportOut, "out", "", "Path of the CAR file to write")
+	importCmd.Flags().StringVar(&importAccount, "account", "",
+		"Account to import into, defaults to the account the mailbox was exported from")
+	rootCmd.AddCommand(exportCmd, importCmd)
+}
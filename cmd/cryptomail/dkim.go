@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pentateu/email-cloud-service/dkim"
+	"github.com/pentateu/email-cloud-service/kms"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dkimDomain    string
+	dkimSelector  string
+	dkimAlgorithm string
+	dkimBits      int
+	dkimOut       string
+
+	dkimCmd = &cobra.Command{
+		Use:   "dkim",
+		Short: "Manage the keys outbound messages are signed with",
+	}
+
+	dkimKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate the DKIM key of a domain",
+		Long: `Writes a new private key to --out, a PKCS#8 PEM file or kms:<name> to keep it in the KMS, and prints
+the DNS TXT record to publish and the outbound_dkim_keys entry using it.
+RSA keys are checked by every server, ed25519 keys by the recent ones only: publish both under two selectors
+and list both in outbound_dkim_keys, messages get a signature of each`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if dkimDomain == "" {
+				return errors.New("--domain is required")
+			}
+			var key crypto.Signer
+			var err error
+			switch dkimAlgorithm {
+			case "rsa":
+				key, err = rsa.GenerateKey(rand.Reader, dkimBits)
+			case "ed25519":
+				_, key, err = ed25519.GenerateKey(rand.Reader)
+			default:
+				return fmt.Errorf("unknown algorithm %q, use rsa or ed25519", dkimAlgorithm)
+			}
+			if err != nil {
+				return err
+			}
+			s, err := dkim.NewSigner(dkimDomain, dkimSelector, key, nil)
+			if err != nil {
+				return err
+			}
+			record, err := s.ZoneRecord()
+			if err != nil {
+				return err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return err
+			}
+			out := dkimOut
+			if out == "" {
+				out = s.Domain + "." + s.Selector + ".pem"
+			}
+			if name := strings.TrimPrefix(out, kms.SecretPrefix); name != out {
+				k, err := kms.Open()
+				if err != nil {
+					return err
+				}
+				if names, err := k.List(context.Background()); err != nil {
+					return err
+				} else if contains(names, name) {
+					return fmt.Errorf("the KMS already has a key named %s", name)
+				}
+				if err := k.Import(context.Background(), name, der); err != nil {
+					return err
+				}
+			} else {
+				f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+				if err != nil {
+					return err
+				}
+				err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Printf("; publish in the zone of %s\n%s\n\n", s.Domain, record)
+			fmt.Printf("; then add to outbound_dkim_keys\n%s=%s:%s\n", s.Domain, s.Selector, out)
+			return nil
+		},
+	}
+)
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	dkimKeygenCmd.Flags().StringVar(&dkimDomain, "domain", "", "Domain the key signs for")
+	dkimKeygenCmd.Flags().StringVar(&dkimSelector, "selector", "mail", "Selector the key is published under")
+	dkimKeygenCmd.Flags().StringVar(&dkimAlgorithm, "algorithm", "rsa", "Key algorithm, rsa or ed25519")
+	dkimKeygenCmd.Flags().IntVar(&dkimBits, "bits", 2048, "Size of RSA keys")
+	dkimKeygenCmd.Flags().StringVar(&dkimOut, "out", "",
+		"File the private key is written to, or kms:<name>, defaults to <domain>.<selector>.pem")
+	dkimCmd.AddCommand(dkimKeygenCmd)
+	rootCmd.AddCommand(dkimCmd)
+}
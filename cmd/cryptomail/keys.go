@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pentateu/email-cloud-service/envelope"
+	"github.com/pentateu/email-cloud-service/mail"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keysConfigPath string
+	keysAccount    string
+	rotateKey      string
+	rotateValidFor time.Duration
+
+	keysCmd = &cobra.Command{
+		Use:   "keys",
+		Short: "Manage the keys messages are encrypted to",
+	}
+
+	keysGenerateCmd = &cobra.Command{
+		Use:   "generate",
+		Short: "Generate an encryption key pair",
+		Long:  `Prints a new X25519 key pair. The public key goes in maildir_encryption_keys or maildir_escrow_keys, the private key stays with the client`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			k, err := envelope.GenerateKey()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("public key:  %s\nprivate key: %s\n", k.Public(), k)
+			return nil
+		},
+	}
+
+	keysRotateCmd = &cobra.Command{
+		Use:   "rotate",
+		Short: "Make a new key the current key of an account",
+		Long: `Adds --key to the key history of the account and ends the validity of the previous keys.
+New messages are encrypted to the new key, the old keys stay listed so clients can decrypt the old messages.
+The key of maildir_encryption_keys is recorded as the first version, it is not used anymore once the account is rotated`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if keysAccount == "" || rotateKey == "" {
+				return errors.New("--account and --key are required")
+			}
+			r, err := mail.RotateKey(keysConfigPath, keysAccount, rotateKey, rotateValidFor)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("rotated %s to key %s, version %d\n", keysAccount, r.ID, r.Version)
+			return nil
+		},
+	}
+
+	keysListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the key history of an account",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if keysAccount == "" {
+				return errors.New("--account is required")
+			}
+			keys, err := mail.ListKeys(keysConfigPath, keysAccount)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				fmt.Printf("%s has no key history, it uses the key of maildir_encryption_keys\n", keysAccount)
+				return nil
+			}
+			now := time.Now()
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "VERSION\tID\tSTATUS\tNOT BEFORE\tNOT AFTER\tKEY")
+			for _, r := range keys {
+				status := "retired"
+				switch {
+				case r.Revoked:
+					status = "revoked"
+				case r.Valid(now):
+					status = "valid"
+				case now.Before(r.NotBefore):
+					status = "pending"
+				}
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Version, r.ID, status,
+					formatKeyTime(r.NotBefore), formatKeyTime(r.NotAfter), r.Key)
+			}
+			return tw.Flush()
+		},
+	}
+
+	keysRevokeCmd = &cobra.Command{
+		Use:   "revoke <key id>",
+		Short: "Revoke a key of an account",
+		Long:  `No message is encrypted to a revoked key anymore. The current key can only be revoked after a rotation`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if keysAccount == "" {
+				return errors.New("--account is required")
+			}
+			if err := mail.RevokeKey(keysConfigPath, keysAccount, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("revoked key %s of %s\n", args[0], keysAccount)
+			return nil
+		},
+	}
+)
+
+// formatKeyTime formats the validity of a key, - for no bound
+func formatKeyTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{keysRotateCmd, keysListCmd, keysRevokeCmd} {
+		cmd.Flags().StringVarP(&keysConfigPath, "config", "c",
+			"maildiranasaurus.conf", "Path to the configuration file")
+		cmd.Flags().StringVar(&keysAccount, "account", "", "Account whose keys are managed")
+	}
+	keysRotateCmd.Flags().StringVar(&rotateKey, "key", "",
+		"New key, as in maildir_encryption_keys: <base64 key>, age:age1..., tink:<path> or pgp:<path>")
+	keysRotateCmd.Flags().DurationVar(&rotateValidFor, "valid-for", 0,
+		"Validity of the new key, eg. 8760h, 0 for no end")
+	keysCmd.AddCommand(keysGenerateCmd, keysRotateCmd, keysListCmd, keysRevokeCmd)
+	rootCmd.AddCommand(keysCmd)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	ipfs "github.com/pentateu/email-cloud-service/ipfsnode"
+	"github.com/pentateu/email-cloud-service/kms"
+	"github.com/spf13/cobra"
+)
+
+var (
+	kmsCmd = &cobra.Command{
+		Use:   "kms",
+		Short: "Manage the private keys held by the KMS",
+		Long:  `Works on the KMS selected with --kms, a local keystore is created by the first import`,
+	}
+
+	kmsImportCmd = &cobra.Command{
+		Use:   "import <name> <file>",
+		Short: "Import a private key or a secret in the KMS",
+		Long: `Stores the content of file under name: a PKCS#8 or PKCS#1 private key, eg. a DKIM key, or a secret
+like the swarm key, used with --ipfs-swarm-key kms:<name>. The file can be removed afterwards.
+Use import-ipfs for the keys of the IPFS node`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := ioutil.ReadFile(args[1])
+			if err != nil {
+				return err
+			}
+			k, err := kms.Open()
+			if err != nil {
+				return err
+			}
+			if err := k.Import(context.Background(), args[0], data); err != nil {
+				return err
+			}
+			fmt.Printf("imported %s as %s\n", args[1], args[0])
+			return nil
+		},
+	}
+
+	kmsIdentityName string
+
+	kmsImportIPFSCmd = &cobra.Command{
+		Use:   "import-ipfs",
+		Short: "Import the identity and the IPNS keys of the IPFS node in the KMS",
+		Long: `Copies the private key of the node in the IPFS repo config to --name, used with --ipfs-identity kms:<name>,
+and the keys of the repo keystore as ipns-<key>, used with --ipfs-kms-keys. The repo is left as it is: remove
+Identity.PrivKey from its config and empty its keystore directory afterwards`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			k, err := kms.Open()
+			if err != nil {
+				return err
+			}
+			names, err := ipfs.ImportKeys(context.Background(), k, kmsIdentityName)
+			for _, name := range names {
+				fmt.Println("imported", name)
+			}
+			return err
+		},
+	}
+
+	kmsListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the keys of the KMS",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			k, err := kms.Open()
+			if err != nil {
+				return err
+			}
+			names, err := k.List(context.Background())
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	kmsImportIPFSCmd.Flags().StringVar(&kmsIdentityName, "name", "ipfs-identity", "Name of the node identity in the KMS")
+	kmsCmd.AddCommand(kmsImportCmd, kmsImportIPFSCmd, kmsListCmd)
+	rootCmd.AddCommand(kmsCmd)
+}
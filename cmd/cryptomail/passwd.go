@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pentateu/email-cloud-service/mail"
+	"github.com/spf13/cobra"
+)
+
+var (
+	passwdConfigPath string
+	passwdAccount    string
+	passwdRemove     bool
+
+	passwdCmd = &cobra.Command{
+		Use:   "passwd",
+		Short: "Set the password an account submits mail with",
+		Long: `Reads the new password from the first line of stdin, eg. from a password manager, and stores its
+bcrypt hash in maildir_credentials_path. The running service picks it up without a restart`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passwdAccount == "" {
+				return errors.New("--account is required")
+			}
+			password := ""
+			if !passwdRemove {
+				line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if password = strings.TrimRight(line, "\r\n"); password == "" {
+					if err != nil {
+						return fmt.Errorf("could not read the password from stdin: %s", err)
+					}
+					return errors.New("empty password, use --remove to remove it")
+				}
+			}
+			if err := mail.SetPassword(passwdConfigPath, passwdAccount, password); err != nil {
+				return err
+			}
+			if passwdRemove {
+				fmt.Printf("removed the password of %s\n", passwdAccount)
+			} else {
+				fmt.Printf("set the password of %s\n", passwdAccount)
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	passwdCmd.Flags().StringVarP(&passwdConfigPath, "config", "c",
+		"maildiranasaurus.conf", "Path to the configuration file")
+	passwdCmd.Flags().StringVar(&passwdAccount, "account", "", "Account to set the password of")
+	passwdCmd.Flags().BoolVar(&passwdRemove, "remove", false, "Remove the password, the account can't submit mail")
+	rootCmd.AddCommand(passwdCmd)
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"github.com/pentateu/email-cloud-service/config"
-	"github.com/pentateu/email-cloud-service/ipfs"
+	ipfs "github.com/pentateu/email-cloud-service/ipfsnode"
+	"github.com/pentateu/email-cloud-service/kms"
 	"github.com/pentateu/email-cloud-service/mail"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -25,7 +26,7 @@ var rootCmd = &cobra.Command{
 			return
 		}
 
-		mail.Start(cmd, args, mailConfig, ipfsNode)
+		mail.Start(cmd, args, mailConfig, ipfsNode, ipfs.PeerHost())
 	},
 }
 
@@ -44,5 +45,10 @@ func init() {
 			logrus.SetLevel(logrus.InfoLevel)
 		}
 	}
+	ipfs.Init(rootCmd)
+	kms.Init(rootCmd)
 	mail.Init(rootCmd)
+	mail.RegisterStatus("peers", func() interface{} {
+		return ipfs.PeerStatus()
+	})
 }
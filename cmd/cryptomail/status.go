@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	statusAddr string
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Print the status of a running service",
+		Long:  `Reads the status document served next to the metrics (see serve --metrics): peer connections and the IPFS upload queue`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := &http.Client{Timeout: 10 * time.Second}
+			resp, err := client.Get("http://" + statusAddr + "/status")
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("status request failed: %s", resp.Status)
+			}
+			status := make(map[string]interface{})
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				return err
+			}
+			out, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+)
+
+func init() {
+	statusCmd.Flags().StringVarP(&statusAddr, "metrics", "m", "127.0.0.1:9100",
+		"Address the service serves metrics and status on")
+	rootCmd.AddCommand(statusCmd)
+}
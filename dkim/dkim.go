@@ -0,0 +1,364 @@
+// Package dkim signs outbound messages with DomainKeys Identified Mail (RFC 6376), so the
+// servers receiving them can tell they come from the domain of their From address.
+//
+// RSA keys sign with rsa-sha256 and Ed25519 keys with ed25519-sha256 (RFC 8463). Headers and
+// body use the relaxed canonicalization, which survives the rewrapping done by relays.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Algorithms of the signatures
+const (
+	RSASHA256     = "rsa-sha256"
+	Ed25519SHA256 = "ed25519-sha256"
+)
+
+// minRSABits is the smallest RSA key verifiers accept (RFC 8301)
+const minRSABits = 1024
+
+// DefaultHeaders are the headers signed when a Signer has none configured.
+// From is listed twice so a From header added on the way invalidates the signature.
+var DefaultHeaders = []string{
+	"From", "From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "List-Id", "List-Unsubscribe",
+}
+
+// selectorRE matches the selectors, one or more DNS labels
+var selectorRE = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+var errNoFrom = errors.New("message has no From address")
+
+// Signer signs the messages of a domain with the key published under its selector
+type Signer struct {
+	Domain   string
+	Selector string
+	// Headers are the names of the headers signed, the headers missing from a message are skipped.
+	// A name listed more times than the message has instances signs the missing ones as empty.
+	Headers []string
+	Key     crypto.Signer
+
+	algorithm string
+}
+
+// NewSigner returns a signer for domain with key, published at <selector>._domainkey.<domain>.
+// headers are the headers to sign, DefaultHeaders when empty; From is always signed.
+func NewSigner(domain, selector string, key crypto.Signer, headers []string) (*Signer, error) {
+	if !selectorRE.MatchString(selector) {
+		return nil, fmt.Errorf("invalid DKIM selector %q", selector)
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !selectorRE.MatchString(domain) {
+		return nil, fmt.Errorf("invalid DKIM domain %q", domain)
+	}
+	algorithm, err := keyAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+	from := false
+	for _, h := range headers {
+		if strings.ContainsAny(h, ": \t;") || h == "" {
+			return nil, fmt.Errorf("invalid header name %q", h)
+		}
+		from = from || strings.EqualFold(h, "From")
+	}
+	if !from {
+		headers = append([]string{"From"}, headers...)
+	}
+	return &Signer{Domain: domain, Selector: selector, Headers: headers, Key: key, algorithm: algorithm}, nil
+}
+
+// keyAlgorithm returns the signing algorithm of a public key
+func keyAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return "", fmt.Errorf("RSA key of %d bits, DKIM needs at least %d", k.N.BitLen(), minRSABits)
+		}
+		return RSASHA256, nil
+	case ed25519.PublicKey:
+		return Ed25519SHA256, nil
+	}
+	return "", fmt.Errorf("unsupported DKIM key %T, use an RSA or Ed25519 key", pub)
+}
+
+// Sign returns msg with a DKIM-Signature header added on top
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	h, err := s.signature(msg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(h), msg...), nil
+}
+
+// signature returns the DKIM-Signature header of msg, folded and ending with CRLF
+func (s *Signer) signature(msg []byte, now time.Time) (string, error) {
+	fields, body := splitMessage(msg)
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// the headers are signed bottom up: each name takes the last instance not signed yet.
+	// Once they are all signed the name is still listed, so an instance added on the way
+	// invalidates the signature (RFC 6376 5.4.2).
+	used := make(map[string]int)
+	names := make([]string, 0, len(s.Headers))
+	hash := sha256.New()
+	for _, name := range s.Headers {
+		key := strings.ToLower(name)
+		f, ok := lastField(fields, key, used[key])
+		if !ok && used[key] == 0 {
+			continue
+		}
+		names = append(names, key)
+		if ok {
+			used[key]++
+			hash.Write([]byte(relaxedHeader(f)))
+		}
+	}
+
+	tags := []string{
+		"v=1", "a=" + s.algorithm, "c=relaxed/relaxed", "d=" + s.Domain, "s=" + s.Selector,
+		fmt.Sprintf("t=%d", now.Unix()), "h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bh[:]), "b=",
+	}
+	header := fold("DKIM-Signature: ", tags)
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(header), "\r\n")))
+
+	var sig []byte
+	var err error
+	if s.algorithm == Ed25519SHA256 {
+		// RFC 8463 signs the SHA-256 hash of the data with PureEdDSA
+		sig, err = s.Key.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not sign for %s: %s", s.Domain, err)
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		header, b = header+b[:72]+"\r\n\t", b[72:]
+	}
+	return header + b + "\r\n", nil
+}
+
+// fold joins tags after name, folding the lines before they get too long
+func fold(name string, tags []string) string {
+	buf := &strings.Builder{}
+	buf.WriteString(name)
+	line := len(name)
+	for i, tag := range tags {
+		if i > 0 {
+			buf.WriteString(";")
+			line++
+			if line+len(tag) > 76 {
+				buf.WriteString("\r\n\t")
+				line = 1
+			} else {
+				buf.WriteString(" ")
+				line++
+			}
+		}
+		buf.WriteString(tag)
+		line += len(tag)
+	}
+	return buf.String()
+}
+
+// splitMessage returns the header fields, each with its folded lines, and the body of msg
+func splitMessage(msg []byte) (fields []string, body []byte) {
+	for len(msg) > 0 {
+		i := bytes.IndexByte(msg, '\n')
+		line := msg
+		if i >= 0 {
+			line, msg = msg[:i+1], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, msg
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += string(line)
+		} else {
+			fields = append(fields, string(line))
+		}
+	}
+	return fields, nil
+}
+
+// lastField returns the field named key skipping the skip last ones
+func lastField(fields []string, key string, skip int) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		name := fields[i]
+		if j := strings.IndexByte(name, ':'); j >= 0 {
+			name = name[:j]
+		}
+		if strings.ToLower(strings.TrimRight(name, " \t")) != key {
+			continue
+		}
+		if skip == 0 {
+			return fields[i], true
+		}
+		skip--
+	}
+	return "", false
+}
+
+// compressWSP replaces every run of spaces and tabs by a single space
+func compressWSP(s string) string {
+	buf := &strings.Builder{}
+	wsp := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == ' ' || c == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			buf.WriteByte(' ')
+			wsp = false
+		}
+		buf.WriteByte(s[i])
+	}
+	if wsp {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
+
+// relaxedHeader is the relaxed canonicalization of a header field (RFC 6376 3.4.2)
+func relaxedHeader(f string) string {
+	name, value := f, ""
+	if i := strings.IndexByte(f, ':'); i >= 0 {
+		name, value = f[:i], f[i+1:]
+	}
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Trim(compressWSP(value), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// relaxedBody is the relaxed canonicalization of a body (RFC 6376 3.4.4)
+func relaxedBody(body []byte) []byte {
+	buf := &bytes.Buffer{}
+	empty := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(compressWSP(strings.TrimSuffix(line, "\r")), " ")
+		if line == "" {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// Keyring holds the signers of the domains the service sends mail for, a domain can have
+// several, eg. an RSA and an Ed25519 key
+type Keyring map[string][]*Signer
+
+// Add adds s to the signers of its domain
+func (k Keyring) Add(s *Signer) {
+	k[s.Domain] = append(k[s.Domain], s)
+}
+
+// Sign signs msg for the domain of its From address, or the closest parent domain with a
+// signer, adding a signature for each of its signers. Messages of the other domains are
+// returned as they are.
+func (k Keyring) Sign(msg []byte) ([]byte, error) {
+	signers, err := k.signers(msg)
+	if err != nil || len(signers) == 0 {
+		return msg, err
+	}
+	now := time.Now()
+	headers := make([]string, len(signers))
+	size := len(msg)
+	for i, s := range signers {
+		if headers[i], err = s.signature(msg, now); err != nil {
+			return nil, err
+		}
+		size += len(headers[i])
+	}
+	ret := make([]byte, 0, size)
+	for _, h := range headers {
+		ret = append(ret, h...)
+	}
+	return append(ret, msg...), nil
+}
+
+// signers returns the signers of the From domain of msg, nil if there are none
+func (k Keyring) signers(msg []byte) ([]*Signer, error) {
+	if len(k) == 0 {
+		return nil, nil
+	}
+	fields, _ := splitMessage(msg)
+	f, ok := lastField(fields, "from", 0)
+	if !ok {
+		return nil, errNoFrom
+	}
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(f[strings.IndexByte(f, ':')+1:]))
+	if err != nil || len(addrs) == 0 {
+		return nil, errNoFrom
+	}
+	domain := strings.ToLower(addrs[0].Address[strings.LastIndexByte(addrs[0].Address, '@')+1:])
+	for {
+		if signers, ok := k[domain]; ok {
+			return signers, nil
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return nil, nil
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Record returns the DNS TXT record publishing pub
+func Record(pub crypto.PublicKey) (string, error) {
+	algorithm, err := keyAlgorithm(pub)
+	if err != nil {
+		return "", err
+	}
+	if algorithm == Ed25519SHA256 {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub.(ed25519.PublicKey)), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ZoneRecord returns the TXT record of the signer in zone file syntax, the record split in
+// strings of at most 255 characters as DNS requires
+func (s *Signer) ZoneRecord() (string, error) {
+	record, err := Record(s.Key.Public())
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(record)/255+1)
+	for len(record) > 255 {
+		parts, record = append(parts, `"`+record[:255]+`"`), record[255:]
+	}
+	parts = append(parts, `"`+record+`"`)
+	return fmt.Sprintf("%s._domainkey.%s. IN TXT ( %s )", s.Selector, s.Domain, strings.Join(parts, " ")), nil
+}
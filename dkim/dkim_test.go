@@ -0,0 +1,274 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "Received: from client.example.com\r\n" +
+	"From: Test <test@example.com>\r\n" +
+	"To: bob@remote.test,\r\n" +
+	"  carol@remote.test\r\n" +
+	"Subject:   Hello\t there  \r\n" +
+	"Date: Mon, 19 Oct 2026 10:00:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"\r\n" +
+	"Hi Bob,  \r\n" +
+	"\r\n" +
+	"see you\t\ttomorrow\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// verify checks the first DKIM-Signature of msg with pub, the way a receiving server does
+func verify(t *testing.T, msg []byte, pub crypto.PublicKey) map[string]string {
+	fields, body := splitMessage(msg)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "DKIM-Signature:") {
+		t.Fatalf("no signature in %q", msg)
+	}
+	sigField := fields[0]
+	tags := make(map[string]string)
+	value := strings.NewReplacer("\r\n", "", "\t", "", " ", "").Replace(sigField[len("DKIM-Signature:"):])
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		tags[kv[0]] = kv[1]
+	}
+	bh := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		t.Fatalf("body hash mismatch")
+	}
+	hash := sha256.New()
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		// a missing instance is signed as empty
+		if f, ok := lastField(fields[1:], name, used[name]); ok {
+			used[name]++
+			hash.Write([]byte(relaxedHeader(f)))
+		}
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(sigField, "b=")
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(unsigned), "\r\n")))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash.Sum(nil), sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash.Sum(nil), sig) {
+			err = rsa.ErrVerification
+		}
+	}
+	if err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	return tags
+}
+
+func TestCanonicalization(t *testing.T) {
+	// RFC 6376 3.4.5
+	fields, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if len(fields) != 2 || relaxedHeader(fields[0])+relaxedHeader(fields[1]) != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected relaxed headers %q", fields)
+	}
+	if got := string(relaxedBody(body)); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body %q", got)
+	}
+	if got := relaxedBody([]byte("\r\n\r\n")); len(got) != 0 {
+		t.Errorf("expected an empty body, got %q", got)
+	}
+}
+
+// rfc8463Message is the ed25519-sha256 example of RFC 8463 Appendix A, signed with rfc8463Seed
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const rfc8463Seed = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+
+func TestRFC8463(t *testing.T) {
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	record, err := Record(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(record, "k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=") {
+		t.Errorf("unexpected record %s", record)
+	}
+	// the signature of the RFC checks with the canonicalization of the package
+	tags := verify(t, []byte(rfc8463Message), key.Public())
+
+	s, err := NewSigner("football.example.com", "brisbane", key, strings.Split(tags["h"], ":"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := []byte(rfc8463Message[strings.Index(rfc8463Message, "From:"):])
+	h, err := s.signature(unsigned, time.Unix(1528637909, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := verify(t, append([]byte(h), unsigned...), key.Public())
+	if signed["bh"] != tags["bh"] || signed["h"] != tags["h"] || signed["t"] != tags["t"] {
+		t.Errorf("expected the body hash and headers of the RFC, got %v", signed)
+	}
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		s, err := NewSigner("Example.com", "mail2026", key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := s.Sign([]byte(testMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(signed), testMessage) {
+			t.Fatalf("message changed by the signature")
+		}
+		tags := verify(t, signed, key.Public())
+		if tags["d"] != "example.com" || tags["s"] != "mail2026" || tags["a"] != s.algorithm {
+			t.Errorf("unexpected tags %v", tags)
+		}
+		if tags["h"] != "from:from:subject:date:to:message-id" {
+			t.Errorf("unexpected signed headers %s", tags["h"])
+		}
+		// a relay rewrapping the headers and the body does not break it
+		rewrapped := strings.NewReplacer("Subject:   Hello\t there  ", "subject: Hello there",
+			"see you\t\ttomorrow\r\n\r\n\r\n", "see you tomorrow\r\n").Replace(string(signed))
+		verify(t, []byte(rewrapped), key.Public())
+
+		record, err := Record(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := record[strings.Index(record, "p=")+2:]
+		der, _ := base64.StdEncoding.DecodeString(p)
+		if s.algorithm == RSASHA256 {
+			if pub, err := x509.ParsePKIXPublicKey(der); err != nil || !rsaKey.PublicKey.Equal(pub) {
+				t.Errorf("unexpected record %s", record)
+			}
+		} else if !ed25519.PublicKey(der).Equal(edKey.Public()) || !strings.Contains(record, "k=ed25519") {
+			t.Errorf("unexpected record %s", record)
+		}
+		zone, err := s.ZoneRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		quoted := regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(zone, -1)
+		joined := ""
+		for _, q := range quoted {
+			if len(q[1]) > 255 {
+				t.Errorf("TXT string of %d characters", len(q[1]))
+			}
+			joined += q[1]
+		}
+		if !strings.HasPrefix(zone, "mail2026._domainkey.example.com. IN TXT") || joined != record {
+			t.Errorf("unexpected zone record %s", zone)
+		}
+	}
+
+	small := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	if _, err := keyAlgorithm(small); err == nil {
+		t.Error("expected a 512 bits key to be refused")
+	}
+	if _, err := NewSigner("example.com", "bad selector", edKey, nil); err == nil {
+		t.Error("expected an invalid selector to be refused")
+	}
+	s, err := NewSigner("example.com", "s", edKey, []string{"Subject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.Headers, ",") != "From,Subject" {
+		t.Errorf("expected From to be signed, got %v", s.Headers)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s, err := NewSigner("example.com", "s", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := make(Keyring)
+	k.Add(s)
+	for from, signed := range map[string]bool{
+		"test@example.com":             true,
+		"MAILER-DAEMON@mx.Example.COM": true,
+		"test@example.org":             false,
+	} {
+		msg := []byte("From: " + from + "\r\nSubject: x\r\n\r\nhi\r\n")
+		out, err := k.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasPrefix(string(out), "DKIM-Signature:"); got != signed {
+			t.Errorf("%s: expected signed %v, got %v", from, signed, got)
+		}
+	}
+	if _, err := k.Sign([]byte("Subject: x\r\n\r\nhi\r\n")); err != errNoFrom {
+		t.Errorf("expected a message without From to be refused, got %v", err)
+	}
+
+	// a domain with an RSA and an Ed25519 key gets both signatures
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewSigner("example.com", "rsa", rsaKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Add(s2)
+	out, err := k.Sign([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(out), testMessage) {
+		t.Fatalf("message changed by the signatures")
+	}
+	fields, _ := splitMessage(out)
+	if tags := verify(t, out, key.Public()); tags["s"] != "s" {
+		t.Errorf("unexpected first signature %v", tags)
+	}
+	if tags := verify(t, out[len(fields[0]):], rsaKey.Public()); tags["s"] != "rsa" {
+		t.Errorf("unexpected second signature %v", tags)
+	}
+}
@@ -0,0 +1,177 @@
+// Package envelope implements the encrypted message format used to store mail.
+//
+// A message is encrypted once with a random data key and the data key is wrapped
+// for every recipient and escrow key, so a message delivered to N accounts is stored
+// as a single ciphertext.
+//
+// Format, version 1. All integers are big endian.
+//
+//	header:
+//	  magic     5 bytes  "CMENV"
+//	  version   1 byte   0x01
+//	  count     2 bytes  number of stanzas, at least 1
+//	  stanzas   count * 89 bytes
+//	    kind      1 byte   0x01 recipient, 0x02 escrow
+//	    key id    8 bytes  first 8 bytes of the SHA-256 of the X25519 public key
+//	    ephemeral 32 bytes X25519 ephemeral public key
+//	    wrapped   48 bytes data key sealed with ChaCha20-Poly1305
+//	  nonce     16 bytes random payload nonce
+//	  mac       32 bytes HMAC-SHA256 of the header up to the nonce (included)
+//	payload:
+//	  chunks of ChunkSize plaintext bytes sealed with ChaCha20-Poly1305,
+//	  the last chunk may be shorter and is only empty for an empty message
+//
+// The data key is 32 random bytes. It is wrapped with the key
+// HKDF-SHA256(X25519(ephemeral, recipient), salt = ephemeral || recipient, info = "cryptomail-envelope/v1 wrap")
+// and an all zero nonce, the wrapping key is never reused since the ephemeral key is fresh.
+//
+// The header mac key is HKDF-SHA256(data key, salt = nil, info = "cryptomail-envelope/v1 header").
+//
+// The payload key is HKDF-SHA256(data key, salt = nonce, info = "cryptomail-envelope/v1 payload").
+// Chunk i is sealed with the 12 byte nonce i (11 bytes) || last (1 byte, 0x01 for the last chunk),
+// which is the STREAM construction: chunks can't be reordered, dropped or truncated undetected.
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// Version of the format written by NewWriter
+	Version = 1
+	// ChunkSize is the size of the plaintext chunks of the payload
+	ChunkSize = 64 * 1024
+
+	magic     = "CMENV"
+	keySize   = 32
+	tagSize   = 16
+	idSize    = 8
+	nonceSize = 16
+	macSize   = 32
+
+	stanzaSize = 1 + idSize + keySize + keySize + tagSize
+	// maxStanzas bounds the header a reader accepts
+	maxStanzas = 1024
+
+	wrapInfo    = "cryptomail-envelope/v1 wrap"
+	headerInfo  = "cryptomail-envelope/v1 header"
+	payloadInfo = "cryptomail-envelope/v1 payload"
+)
+
+// Kind of a key stanza
+type Kind byte
+
+const (
+	KindRecipient Kind = 1
+	KindEscrow    Kind = 2
+)
+
+var (
+	ErrNotEnvelope = errors.New("envelope: not an encrypted message")
+	ErrNoKey       = errors.New("envelope: message is not encrypted to this key")
+	ErrCorrupted   = errors.New("envelope: message corrupted or tampered with")
+)
+
+// KeyID identifies a public key in the header
+type KeyID [idSize]byte
+
+func (id KeyID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// PublicKey is an X25519 public key
+type PublicKey [keySize]byte
+
+// ID returns the key ID stored in the stanzas wrapping the data key for k
+func (k PublicKey) ID() KeyID {
+	var id KeyID
+	sum := sha256.Sum256(k[:])
+	copy(id[:], sum[:idSize])
+	return id
+}
+
+// String encodes k in base64, as used in the configuration
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// PrivateKey is an X25519 private key
+type PrivateKey [keySize]byte
+
+// GenerateKey creates a new private key
+func GenerateKey() (*PrivateKey, error) {
+	k := &PrivateKey{}
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Public returns the public key of k
+func (k *PrivateKey) Public() PublicKey {
+	var pub PublicKey
+	p, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(pub[:], p)
+	return pub
+}
+
+// String encodes k in base64
+func (k *PrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParsePublicKey decodes a base64 public key
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != keySize {
+		return k, fmt.Errorf("envelope: invalid public key %q", s)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// ParsePrivateKey decodes a base64 private key
+func ParsePrivateKey(s string) (*PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != keySize {
+		return nil, errors.New("envelope: invalid private key")
+	}
+	k := &PrivateKey{}
+	copy(k[:], b)
+	return k, nil
+}
+
+// Recipient is a key the data key is wrapped for
+type Recipient struct {
+	Key  PublicKey
+	Kind Kind
+}
+
+// Stanza is the data key wrapped for one key
+type Stanza struct {
+	Kind      Kind
+	KeyID     KeyID
+	Ephemeral [keySize]byte
+	Wrapped   [keySize + tagSize]byte
+}
+
+// Header is the header of an encrypted message
+type Header struct {
+	Version int
+	Stanzas []Stanza
+	Nonce   [nonceSize]byte
+	MAC     [macSize]byte
+}
+
+// IsEnvelope reports if b, the start of a message, is an encrypted message
+func IsEnvelope(b []byte) bool {
+	return len(b) >= len(magic) && string(b[:len(magic)]) == magic
+}
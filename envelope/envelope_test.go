@@ -0,0 +1,165 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func encrypt(t *testing.T, plaintext []byte, recipients []Recipient) []byte {
+	out := &bytes.Buffer{}
+	w, err := NewWriter(out, recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in odd sized pieces to cross the chunk boundaries
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(ciphertext []byte, key *PrivateKey) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func newKeys(t *testing.T, n int) []*PrivateKey {
+	keys := make([]*PrivateKey, n)
+	for i := range keys {
+		k, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys := newKeys(t, 3)
+	recipients := []Recipient{
+		{Key: keys[0].Public(), Kind: KindRecipient},
+		{Key: keys[1].Public(), Kind: KindRecipient},
+		{Key: keys[2].Public(), Kind: KindEscrow},
+	}
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := encrypt(t, plaintext, recipients)
+
+		h, err := ReadHeader(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Stanzas) != 3 || h.Stanzas[2].Kind != KindEscrow || h.Stanzas[0].KeyID != keys[0].Public().ID() {
+			t.Fatalf("unexpected header %+v", h)
+		}
+		for i, k := range keys {
+			got, err := decrypt(ciphertext, k)
+			if err != nil {
+				t.Fatalf("size %d, key %d: %s", size, i, err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("size %d, key %d: plaintext mismatch", size, i)
+			}
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	keys := newKeys(t, 2)
+	ciphertext := encrypt(t, []byte("hello"), []Recipient{{Key: keys[0].Public(), Kind: KindRecipient}})
+	if _, err := decrypt(ciphertext, keys[1]); err != ErrNoKey {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+	if _, err := decrypt([]byte("From: test@example.com\r\n"), keys[0]); err != ErrNotEnvelope {
+		t.Fatalf("expected ErrNotEnvelope, got %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	keys := newKeys(t, 2)
+	plaintext := make([]byte, 2*ChunkSize+10)
+	ciphertext := encrypt(t, plaintext, []Recipient{
+		{Key: keys[0].Public(), Kind: KindRecipient},
+		{Key: keys[1].Public(), Kind: KindEscrow},
+	})
+	headerSize := len(magic) + 3 + 2*stanzaSize + nonceSize + macSize
+
+	// drop the escrow stanza
+	stripped := append([]byte{}, ciphertext[:len(magic)+1]...)
+	stripped = append(stripped, 0, 0)
+	binary.BigEndian.PutUint16(stripped[len(magic)+1:], 1)
+	stripped = append(stripped, ciphertext[len(magic)+3:len(magic)+3+stanzaSize]...)
+	stripped = append(stripped, ciphertext[len(magic)+3+2*stanzaSize:]...)
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[headerSize+ChunkSize+5] ^= 1
+
+	cases := map[string][]byte{
+		"stanza removed":     stripped,
+		"payload modified":   flipped,
+		"last chunk dropped": ciphertext[:headerSize+2*(ChunkSize+tagSize)],
+		"truncated":          ciphertext[:len(ciphertext)-1],
+		"chunks reordered": append(append(append([]byte{}, ciphertext[:headerSize]...),
+			ciphertext[headerSize+ChunkSize+tagSize:headerSize+2*(ChunkSize+tagSize)]...),
+			ciphertext[headerSize:headerSize+ChunkSize+tagSize]...),
+	}
+	for name, c := range cases {
+		if _, err := decrypt(c, keys[0]); err != ErrCorrupted {
+			t.Errorf("%s: expected ErrCorrupted, got %v", name, err)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	k := newKeys(t, 1)[0]
+	priv, err := ParsePrivateKey(k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKey(k.Public().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv.Public() != pub {
+		t.Fatal("parsed keys do not match")
+	}
+	if _, err := ParsePublicKey("c2hvcnQ="); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	w, err := NewWriter(ioutil.Discard, []Recipient{{Key: newKeys(t, 1)[0].Public(), Kind: KindRecipient}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("late")); err != errClosed {
+		t.Fatalf("expected errClosed, got %v", err)
+	}
+	if _, err := NewWriter(ioutil.Discard, nil); err == nil {
+		t.Fatal("expected an error without recipients")
+	}
+	var _ io.WriteCloser = w
+}
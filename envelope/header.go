@@ -0,0 +1,180 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// marshal encodes the header without the mac
+func (h *Header) marshal() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(magic)
+	buf.WriteByte(byte(h.Version))
+	binary.Write(buf, binary.BigEndian, uint16(len(h.Stanzas)))
+	for _, s := range h.Stanzas {
+		buf.WriteByte(byte(s.Kind))
+		buf.Write(s.KeyID[:])
+		buf.Write(s.Ephemeral[:])
+		buf.Write(s.Wrapped[:])
+	}
+	buf.Write(h.Nonce[:])
+	return buf.Bytes()
+}
+
+// ReadHeader reads the header of an encrypted message from r.
+// The mac can't be checked without a key, use NewReader to decrypt.
+func ReadHeader(r io.Reader) (*Header, error) {
+	prefix := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEnvelope
+		}
+		return nil, err
+	}
+	if !IsEnvelope(prefix) {
+		return nil, ErrNotEnvelope
+	}
+	h := &Header{Version: int(prefix[len(magic)])}
+	if h.Version != Version {
+		return nil, fmt.Errorf("envelope: unsupported version %d", h.Version)
+	}
+	count := int(binary.BigEndian.Uint16(prefix[len(magic)+1:]))
+	if count == 0 || count > maxStanzas {
+		return nil, ErrCorrupted
+	}
+	rest := make([]byte, count*stanzaSize+nonceSize+macSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	h.Stanzas = make([]Stanza, count)
+	for i := range h.Stanzas {
+		b := rest[i*stanzaSize:]
+		s := &h.Stanzas[i]
+		s.Kind = Kind(b[0])
+		b = b[1:]
+		copy(s.KeyID[:], b[:idSize])
+		b = b[idSize:]
+		copy(s.Ephemeral[:], b[:keySize])
+		b = b[keySize:]
+		copy(s.Wrapped[:], b[:keySize+tagSize])
+	}
+	rest = rest[count*stanzaSize:]
+	copy(h.Nonce[:], rest[:nonceSize])
+	copy(h.MAC[:], rest[nonceSize:])
+	return h, nil
+}
+
+// newHeader wraps dataKey for the recipients and computes the header mac
+func newHeader(dataKey []byte, recipients []Recipient) (*Header, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("envelope: no recipients")
+	}
+	if len(recipients) > maxStanzas {
+		return nil, fmt.Errorf("envelope: too many recipients, max %d", maxStanzas)
+	}
+	h := &Header{Version: Version, Stanzas: make([]Stanza, len(recipients))}
+	for i, r := range recipients {
+		if r.Kind != KindRecipient && r.Kind != KindEscrow {
+			return nil, fmt.Errorf("envelope: invalid key kind %d", r.Kind)
+		}
+		s, err := wrap(dataKey, r)
+		if err != nil {
+			return nil, err
+		}
+		h.Stanzas[i] = *s
+	}
+	if _, err := io.ReadFull(rand.Reader, h.Nonce[:]); err != nil {
+		return nil, err
+	}
+	copy(h.MAC[:], headerMAC(dataKey, h.marshal()))
+	return h, nil
+}
+
+// unwrap finds the stanza for key and returns the data key once the header mac is verified
+func (h *Header) unwrap(key *PrivateKey) ([]byte, error) {
+	pub := key.Public()
+	id := pub.ID()
+	for i := range h.Stanzas {
+		s := &h.Stanzas[i]
+		if s.KeyID != id {
+			continue
+		}
+		wk, err := wrapKey(key[:], s.Ephemeral[:], s.Ephemeral[:], pub[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(wk)
+		if err != nil {
+			return nil, err
+		}
+		dataKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.Wrapped[:], nil)
+		if err != nil {
+			// key ID collision, keep looking
+			continue
+		}
+		if !hmac.Equal(h.MAC[:], headerMAC(dataKey, h.marshal())) {
+			return nil, ErrCorrupted
+		}
+		return dataKey, nil
+	}
+	return nil, ErrNoKey
+}
+
+// wrap seals dataKey for r with a fresh ephemeral key
+func wrap(dataKey []byte, r Recipient) (*Stanza, error) {
+	eph, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stanza{Kind: r.Kind, KeyID: r.Key.ID(), Ephemeral: eph.Public()}
+	wk, err := wrapKey(eph[:], r.Key[:], s.Ephemeral[:], r.Key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wk)
+	if err != nil {
+		return nil, err
+	}
+	copy(s.Wrapped[:], aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), dataKey, nil))
+	return s, nil
+}
+
+// wrapKey derives the key wrapping the data key from the X25519 shared secret of
+// priv and peer, salted with the ephemeral and the recipient public keys
+func wrapKey(priv, peer []byte, ephemeral, recipient []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return derive(shared, salt, wrapInfo), nil
+}
+
+// headerMAC authenticates the header, so stanzas can't be added or changed
+func headerMAC(dataKey, header []byte) []byte {
+	mac := hmac.New(sha256.New, derive(dataKey, nil, headerInfo))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// derive expands secret into a 32 byte key
+func derive(secret, salt []byte, info string) []byte {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,204 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var errClosed = errors.New("envelope: write to closed writer")
+
+// Writer encrypts a message, see NewWriter
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  [chacha20poly1305.NonceSize]byte
+	buf    []byte
+	out    []byte
+	err    error
+	closed bool
+}
+
+// NewWriter writes the header of a message encrypted to recipients to w and returns
+// a Writer encrypting the plaintext written to it. Only one chunk is held in memory.
+// Close must be called to write the last chunk, it does not close w.
+func NewWriter(w io.Writer, recipients []Recipient) (*Writer, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	h, err := newHeader(dataKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(derive(dataKey, h.Nonce[:], payloadInfo))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(h.marshal(), h.MAC[:]...)); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, ChunkSize),
+		out:  make([]byte, 0, ChunkSize+tagSize),
+	}, nil
+}
+
+// Write encrypts p. A full chunk is only sealed when more data follows,
+// since the last chunk is sealed differently.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == ChunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		c := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seals the last chunk
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	return w.err
+}
+
+func (w *Writer) flush(last bool) error {
+	setLast(&w.nonce, last)
+	w.out = w.aead.Seal(w.out[:0], w.nonce[:], w.buf, nil)
+	w.buf = w.buf[:0]
+	if err := incNonce(&w.nonce); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// reader decrypts the payload, see NewReader
+type reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce [chacha20poly1305.NonceSize]byte
+	in    []byte
+	buf   []byte
+	first bool
+	err   error
+}
+
+// NewReader reads the header of the encrypted message from r, unwraps the data key
+// with key and returns a reader of the plaintext. Chunks are authenticated before
+// their content is returned, a truncated or modified message fails with ErrCorrupted.
+func NewReader(r io.Reader, key *PrivateKey) (io.Reader, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := h.unwrap(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(derive(dataKey, h.Nonce[:], payloadInfo))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		in:    make([]byte, ChunkSize+tagSize),
+		first: true,
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into buf, it returns io.EOF after the last chunk
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.r, r.in)
+	if err == io.EOF {
+		// the last chunk was not sealed as last
+		return ErrCorrupted
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := n < len(r.in)
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	setLast(&r.nonce, last)
+	buf, err := r.aead.Open(r.in[:0], r.nonce[:], r.in[:n], nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	if len(buf) == 0 && !r.first {
+		// only an empty message has an empty chunk
+		return ErrCorrupted
+	}
+	r.first = false
+	r.buf = buf
+	if err := incNonce(&r.nonce); err != nil {
+		return err
+	}
+	if last {
+		return io.EOF
+	}
+	return nil
+}
+
+// setLast sets the flag of the last chunk in the nonce
+func setLast(nonce *[chacha20poly1305.NonceSize]byte, last bool) {
+	if last {
+		nonce[len(nonce)-1] = 1
+	} else {
+		nonce[len(nonce)-1] = 0
+	}
+}
+
+// incNonce increments the chunk counter in the first 11 bytes of the nonce
+func incNonce(nonce *[chacha20poly1305.NonceSize]byte) error {
+	for i := len(nonce) - 2; i >= 0; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return nil
+		}
+	}
+	return errors.New("envelope: chunk counter overflow")
+}
@@ -3,6 +3,8 @@ module github.com/pentateu/email-cloud-service
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
+	github.com/ProtonMail/go-crypto v0.0.0-20220113124808-70ae35bab23f
 	github.com/armon/consul-api v0.0.0-20180202201655-eb2c6b5be1b6 // indirect
 	github.com/asaskevich/EventBus v0.0.0-20200907212545-49d423059eef // indirect
 	github.com/coreos/bbolt v1.3.2 // indirect
@@ -14,18 +16,28 @@ require (
 	github.com/flashmob/go-guerrilla v1.6.1 // indirect
 	github.com/flashmob/go-maildir v0.0.0-20170303050255-96c8878d94ea // indirect
 	github.com/flashmob/maildir-processor v0.0.0-20170318133922-235aad79032f // indirect
+	github.com/google/tink/go v1.7.0
 	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0 // indirect
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0 // indirect
 	github.com/gxed/hashland/keccakpg v0.0.1 // indirect
 	github.com/gxed/hashland/murmur3 v0.0.1 // indirect
+	github.com/ipfs/go-cid v0.0.7
+	github.com/ipfs/go-ipfs-config v0.16.0
 	github.com/ipfs/go-ipfs-files v0.0.9 // indirect
+	github.com/ipfs/go-ipfs-keystore v0.0.2
+	github.com/ipfs/go-ipld-format v0.2.0
+	github.com/ipfs/go-merkledag v0.4.0
+	github.com/ipfs/go-unixfs v0.2.4
 	github.com/ipfs/interface-go-ipfs-core v0.5.2 // indirect
+	github.com/ipld/go-car v0.3.2
+	github.com/ipld/go-ipld-prime v0.12.3 // indirect
 	github.com/jonboulle/clockwork v0.1.0 // indirect
+	github.com/libp2p/go-libp2p v0.16.0
 	github.com/libp2p/go-libp2p-core v0.11.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/multiformats/go-multiaddr v0.4.1 // indirect
 	github.com/pentateu/go-crypto-maildir v0.0.0-20211031084008-0e0875bc7fdd // indirect
-	github.com/prometheus/client_golang v0.9.3 // indirect
+	github.com/prometheus/client_golang v0.9.3
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/sloonz/go-maildir v0.0.0-20210417175458-ec35083290ab // indirect
 	github.com/soheilhy/cmux v0.1.4 // indirect
@@ -37,5 +49,6 @@ require (
 	github.com/xiang90/probing v0.0.0-20190116061207-43a291ad63a2 // indirect
 	github.com/xordataexchange/crypt v0.0.3-0.20170626215501-b2862e3d0a77 // indirect
 	go.etcd.io/bbolt v1.3.2 // indirect
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	gopkg.in/resty.v1 v1.12.0 // indirect
 )
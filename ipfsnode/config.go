@@ -0,0 +1,36 @@
+package ipfs
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var (
+	// nodeType is the strategy used to get a node: spawn, local or temp
+	nodeType string
+	// peers are the multiaddrs of the nodes to stay connected to
+	peers []string
+	// privateNetwork makes the node join the private swarm protected by the swarm key
+	privateNetwork bool
+	// swarmKeyPath is the pre-shared key of the private swarm
+	swarmKeyPath string
+	// identityKey is the KMS entry of the node identity, kms:<name>, empty for the one of the repo
+	identityKey string
+	// kmsKeys keeps the IPNS keys of the node in the KMS
+	kmsKeys bool
+)
+
+//Init - register the ipfs node flags
+func Init(rootCmd *cobra.Command) {
+	rootCmd.PersistentFlags().StringVar(&nodeType, "ipfs-node", "spawn",
+		"How to get an IPFS node: spawn, local or temp")
+	rootCmd.PersistentFlags().StringSliceVar(&peers, "ipfs-peers", nil,
+		"Multiaddrs of the peers to connect to, eg. /ip4/10.0.0.2/tcp/4001/p2p/12D3KooW...")
+	rootCmd.PersistentFlags().BoolVar(&privateNetwork, "ipfs-private", false,
+		"Join a private swarm, requires --ipfs-swarm-key")
+	rootCmd.PersistentFlags().StringVar(&swarmKeyPath, "ipfs-swarm-key", "",
+		"Path to the pre-shared swarm.key of the private swarm, or kms:<name> to read it from the KMS")
+	rootCmd.PersistentFlags().StringVar(&identityKey, "ipfs-identity", "",
+		"kms:<name> of the private key of the embedded node in the KMS, instead of the one in the repo config")
+	rootCmd.PersistentFlags().BoolVar(&kmsKeys, "ipfs-kms-keys", false,
+		"Keep the IPNS keys of the embedded node in the KMS, as ipns-<name>, instead of the repo keystore")
+}
@@ -3,25 +3,86 @@ package ipfs
 import (
 	"context"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
-//connect - connect the ipfs node to peers
-func connect(ctx context.Context, ipfs iface.CoreAPI, peers []string) error {
-	var wg sync.WaitGroup
+// protectTag protects the configured peers from the connection manager
+const protectTag = "cryptomail-peer"
+
+// variables so tests can shorten them
+var (
+	// checkInterval is how often a connected peer is checked
+	checkInterval = 30 * time.Second
+	// connectTimeout bounds a single connection attempt
+	connectTimeout = 30 * time.Second
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 5 * time.Minute
+)
+
+// PeerState is the connection status of a configured peer
+type PeerState struct {
+	ID            string    `json:"id"`
+	Addrs         []string  `json:"addrs"`
+	Connected     bool      `json:"connected"`
+	Failures      int       `json:"failures"`
+	Reconnects    int       `json:"reconnects"`
+	LastConnected time.Time `json:"last_connected,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttempt   time.Time `json:"next_attempt,omitempty"`
+}
+
+// supervisor keeps the configured peers connected
+type supervisor struct {
+	ipfs iface.CoreAPI
+	// host is nil when the node is not embedded, peers can't be protected then
+	host  host.Host
+	mu    sync.Mutex
+	peers map[peer.ID]*PeerState
+}
+
+var (
+	peerSupervisor   *supervisor
+	peerSupervisorMu sync.Mutex
+)
+
+//PeerStatus - returns the status of the configured peers, sorted by peer ID
+func PeerStatus() []PeerState {
+	peerSupervisorMu.Lock()
+	s := peerSupervisor
+	peerSupervisorMu.Unlock()
+	if s == nil {
+		return []PeerState{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]PeerState, 0, len(s.peers))
+	for _, st := range s.peers {
+		ret = append(ret, *st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+//parsePeers - group the peer multiaddrs by peer ID
+func parsePeers(peers []string) (map[peer.ID]*peer.AddrInfo, error) {
 	pinfos := make(map[peer.ID]*peer.AddrInfo, len(peers))
 	for _, addrStr := range peers {
 		addr, err := ma.NewMultiaddr(addrStr)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		pii, err := peer.AddrInfoFromP2pAddr(addr)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		pi, ok := pinfos[pii.ID]
 		if !ok {
@@ -30,19 +91,130 @@ func connect(ctx context.Context, ipfs iface.CoreAPI, peers []string) error {
 		}
 		pi.Addrs = append(pi.Addrs, pii.Addrs...)
 	}
+	return pinfos, nil
+}
+
+//connect - connect the ipfs node to peers and keep them connected until ctx is done
+func connect(ctx context.Context, ipfs iface.CoreAPI, h host.Host, peers []string) error {
+	pinfos, err := parsePeers(peers)
+	if err != nil {
+		log.Printf("invalid peer address: %s", err)
+		return err
+	}
+	s := &supervisor{ipfs: ipfs, host: h, peers: make(map[peer.ID]*PeerState, len(pinfos))}
+	for _, pi := range pinfos {
+		st := &PeerState{ID: pi.ID.Pretty()}
+		for _, a := range pi.Addrs {
+			st.Addrs = append(st.Addrs, a.String())
+		}
+		s.peers[pi.ID] = st
+		if h != nil {
+			h.ConnManager().Protect(pi.ID, protectTag)
+		}
+	}
+	peerSupervisorMu.Lock()
+	peerSupervisor = s
+	peerSupervisorMu.Unlock()
 
+	var wg sync.WaitGroup
 	wg.Add(len(pinfos))
 	for _, pi := range pinfos {
 		go func(pi *peer.AddrInfo) {
 			defer wg.Done()
+			s.supervise(ctx, *pi)
+		}(pi)
+	}
+	wg.Wait()
+	return nil
+}
+
+//supervise - keep pi connected, reconnecting with exponential backoff
+func (s *supervisor) supervise(ctx context.Context, pi peer.AddrInfo) {
+	backoff := minReconnectBackoff
+	wasConnected := false
+	for {
+		wait := checkInterval
+		if s.connected(ctx, pi.ID) {
+			s.update(pi.ID, true, nil)
+			wasConnected = true
+			backoff = minReconnectBackoff
+		} else {
+			if wasConnected {
+				log.Printf("lost connection to peer %s, reconnecting", pi.ID)
+				peerReconnects.WithLabelValues(pi.ID.Pretty()).Inc()
+				s.mu.Lock()
+				s.peers[pi.ID].Reconnects++
+				s.mu.Unlock()
+			}
 			log.Printf("attempting to connect to peer: %q\n", pi)
-			err := ipfs.Swarm().Connect(ctx, *pi)
+			cctx, cancel := context.WithTimeout(ctx, connectTimeout)
+			err := s.ipfs.Swarm().Connect(cctx, pi)
+			cancel()
 			if err != nil {
 				log.Printf("failed to connect to %s: %s", pi.ID, err)
+				s.update(pi.ID, false, err)
+				wasConnected = false
+				wait = backoff
+				if backoff *= 2; backoff > maxReconnectBackoff {
+					backoff = maxReconnectBackoff
+				}
+			} else {
+				log.Printf("successfully connected to %s\n", pi.ID)
+				s.update(pi.ID, true, nil)
+				wasConnected = true
+				backoff = minReconnectBackoff
 			}
-			log.Printf("successfully connected to %s\n", pi.ID)
-		}(pi)
+		}
+		s.mu.Lock()
+		s.peers[pi.ID].NextAttempt = time.Now().Add(wait)
+		s.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			if s.host != nil {
+				s.host.ConnManager().Unprotect(pi.ID, protectTag)
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+//connected - check if the node has a connection to id
+func (s *supervisor) connected(ctx context.Context, id peer.ID) bool {
+	if s.host != nil {
+		return s.host.Network().Connectedness(id) == network.Connected
+	}
+	conns, err := s.ipfs.Swarm().Peers(ctx)
+	if err != nil {
+		return false
+	}
+	for _, c := range conns {
+		if c.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+//update - record the result of a connection check
+func (s *supervisor) update(id peer.ID, connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[id]
+	st.Connected = connected
+	if connected {
+		st.Failures = 0
+		st.LastConnected = time.Now()
+		st.LastError = ""
+		peerConnected.WithLabelValues(st.ID).Set(1)
+	} else {
+		st.Failures++
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		peerConnected.WithLabelValues(st.ID).Set(0)
 	}
-	wg.Wait()
-	return nil
 }
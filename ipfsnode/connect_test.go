@@ -0,0 +1,142 @@
+package ipfs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// hostSwarm connects through a libp2p host, the way the swarm API of a node does
+type hostSwarm struct {
+	iface.CoreAPI
+	iface.SwarmAPI
+	h host.Host
+}
+
+func (s *hostSwarm) Swarm() iface.SwarmAPI { return s }
+
+func (s *hostSwarm) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	return s.h.Connect(ctx, pi)
+}
+
+// protectingHost records the peers protected from its connection manager
+type protectingHost struct {
+	host.Host
+	connmgr.NullConnMgr
+	mu        sync.Mutex
+	protected map[peer.ID]bool
+}
+
+func (h *protectingHost) ConnManager() connmgr.ConnManager { return h }
+
+func (h *protectingHost) Close() error { return h.Host.Close() }
+
+func (h *protectingHost) Protect(id peer.ID, tag string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.protected[id] = tag == protectTag
+}
+
+func (h *protectingHost) Unprotect(id peer.ID, tag string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.protected, id)
+	return false
+}
+
+func (h *protectingHost) IsProtected(id peer.ID, tag string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.protected[id]
+}
+
+func newHost(t *testing.T) host.Host {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// addr returns the p2p multiaddr of h
+func addr(h host.Host) string {
+	return h.Addrs()[0].String() + "/p2p/" + h.ID().Pretty()
+}
+
+// waitFor polls the status of peer id until ok accepts it
+func waitFor(t *testing.T, id peer.ID, what string, ok func(PeerState) bool) PeerState {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		for _, st := range PeerStatus() {
+			if st.ID == id.Pretty() && ok(st) {
+				return st
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: peer %s still %+v", what, id, PeerStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisePeers(t *testing.T) {
+	defer func(check, min, max time.Duration) {
+		checkInterval, minReconnectBackoff, maxReconnectBackoff = check, min, max
+	}(checkInterval, minReconnectBackoff, maxReconnectBackoff)
+	checkInterval = 20 * time.Millisecond
+	minReconnectBackoff = 10 * time.Millisecond
+	maxReconnectBackoff = 40 * time.Millisecond
+
+	node := &protectingHost{Host: newHost(t), protected: make(map[peer.ID]bool)}
+	defer node.Close()
+	remote := newHost(t)
+	defer remote.Close()
+	// a peer that is gone
+	gone := newHost(t)
+	goneAddr := addr(gone)
+	gone.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connect(ctx, &hostSwarm{h: node}, node, []string{addr(remote), goneAddr})
+	}()
+
+	waitFor(t, remote.ID(), "connect", func(st PeerState) bool { return st.Connected })
+	if !node.IsProtected(remote.ID(), protectTag) || !node.IsProtected(gone.ID(), protectTag) {
+		t.Error("expected the configured peers to be protected")
+	}
+
+	// the connection is dropped, the supervisor notices and connects again
+	if err := node.Network().ClosePeer(remote.ID()); err != nil {
+		t.Fatal(err)
+	}
+	st := waitFor(t, remote.ID(), "reconnect", func(st PeerState) bool { return st.Reconnects == 1 && st.Connected })
+	if st.Failures != 0 || st.LastError != "" || st.LastConnected.IsZero() {
+		t.Errorf("unexpected state after reconnecting %+v", st)
+	}
+
+	// the attempts to the gone peer fail and back off
+	st = waitFor(t, gone.ID(), "fail", func(st PeerState) bool { return st.Failures >= 3 })
+	if st.Connected || st.LastError == "" || st.Reconnects != 0 {
+		t.Errorf("unexpected state of the gone peer %+v", st)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("supervisor still running after ctx is done")
+	}
+	if node.IsProtected(remote.ID(), protectTag) || node.IsProtected(gone.ID(), protectTag) {
+		t.Error("expected the peers to be unprotected when the supervisor stops")
+	}
+}
@@ -13,13 +13,12 @@ import (
 
 //Start the IPFS node service
 func Start(cmd *cobra.Command, args []string) (iface.CoreAPI, error) {
-	//TODO: Grab nodeType from config
-	nodeType := "spawn"
-	//TODO: Grab peers 	from config
-	peers := []string{"", ""}
+	if privateNetwork && nodeType == "local" {
+		return nil, fmt.Errorf("private network requires an embedded node, %q can't be used", nodeType)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// the node and the peer supervisor live as long as the process
+	ctx := context.Background()
 
 	var ipfs iface.CoreAPI
 	var err error
@@ -37,7 +36,7 @@ func Start(cmd *cobra.Command, args []string) (iface.CoreAPI, error) {
 		return nil, err
 	}
 
-	go connect(ctx, ipfs, peers)
+	go connect(ctx, ipfs, PeerHost(), peers)
 
 	return ipfs, nil
 }
@@ -0,0 +1,181 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	config "github.com/ipfs/go-ipfs-config"
+	serialize "github.com/ipfs/go-ipfs-config/serialize"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pentateu/email-cloud-service/kms"
+)
+
+// ipnsKeyPrefix names the IPNS keys of the node in the KMS, eg. ipns-mailbox
+const ipnsKeyPrefix = "ipns-"
+
+var errKMSKeyRemove = errors.New("IPNS keys kept in the KMS are removed from the KMS, not by the node")
+
+// openKMS opens the KMS of the --kms flags, tests replace it
+var openKMS = kms.Open
+
+//identityConfig - read the node identity from the KMS, the marshalled libp2p private key
+//stored under kms:<name>, and return the option setting it in the config of the node
+func identityConfig() (CfgOpt, error) {
+	name := strings.TrimPrefix(identityKey, kms.SecretPrefix)
+	if name == identityKey || name == "" {
+		return nil, fmt.Errorf("invalid --ipfs-identity %q, use kms:<name>", identityKey)
+	}
+	k, err := openKMS()
+	if err != nil {
+		return nil, err
+	}
+	data, err := k.Secret(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the node identity: %s", err)
+	}
+	sk, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node identity %s: %s", identityKey, err)
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	identity := config.Identity{PeerID: id.Pretty(), PrivKey: base64.StdEncoding.EncodeToString(data)}
+	return func(cfg *config.Config) {
+		cfg.Identity = identity
+	}, nil
+}
+
+//kmsKeystore - the keystore of the IPNS keys of the node, kept in the KMS instead of the
+//keystore directory of the repo
+type kmsKeystore struct {
+	k kms.KMS
+}
+
+func (ks kmsKeystore) Has(name string) (bool, error) {
+	_, err := ks.k.Secret(context.Background(), ipnsKeyPrefix+name)
+	if errors.Is(err, kms.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ks kmsKeystore) Put(name string, k crypto.PrivKey) error {
+	if ok, err := ks.Has(name); err != nil {
+		return err
+	} else if ok {
+		return keystore.ErrKeyExists
+	}
+	data, err := crypto.MarshalPrivateKey(k)
+	if err != nil {
+		return err
+	}
+	return ks.k.Import(context.Background(), ipnsKeyPrefix+name, data)
+}
+
+func (ks kmsKeystore) Get(name string) (crypto.PrivKey, error) {
+	data, err := ks.k.Secret(context.Background(), ipnsKeyPrefix+name)
+	if errors.Is(err, kms.ErrNotFound) {
+		return nil, keystore.ErrNoSuchKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(data)
+}
+
+func (ks kmsKeystore) Delete(name string) error {
+	return errKMSKeyRemove
+}
+
+func (ks kmsKeystore) List() ([]string, error) {
+	names, err := ks.k.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, ipnsKeyPrefix) {
+			ret = append(ret, strings.TrimPrefix(name, ipnsKeyPrefix))
+		}
+	}
+	return ret, nil
+}
+
+//kmsKeystoreRepo - a repo whose IPNS keys are kept in the KMS
+type kmsKeystoreRepo struct {
+	repo.Repo
+	ks keystore.Keystore
+}
+
+func (r kmsKeystoreRepo) Keystore() keystore.Keystore {
+	return r.ks
+}
+
+//withKMSKeystore - keep the IPNS keys of the node of r in the KMS
+func withKMSKeystore(r repo.Repo) (repo.Repo, error) {
+	k, err := openKMS()
+	if err != nil {
+		return nil, err
+	}
+	return kmsKeystoreRepo{Repo: r, ks: kmsKeystore{k: k}}, nil
+}
+
+//ImportKeys - copy the node identity of the IPFS repo to k under identityName, and its IPNS
+//keys as ipns-<name>, for --ipfs-identity and --ipfs-kms-keys. The repo is left as it is.
+func ImportKeys(ctx context.Context, k kms.KMS, identityName string) ([]string, error) {
+	root, err := config.PathRoot()
+	if err != nil {
+		return nil, err
+	}
+	filename, err := config.Filename(root)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := serialize.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Identity.PrivKey == "" {
+		return nil, fmt.Errorf("no identity in %s", filename)
+	}
+	data, err := base64.StdEncoding.DecodeString(cfg.Identity.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity in %s: %s", filename, err)
+	}
+	if err := k.Import(ctx, identityName, data); err != nil {
+		return nil, err
+	}
+	imported := []string{identityName}
+
+	fsKeys, err := keystore.NewFSKeystore(filepath.Join(root, "keystore"))
+	if err != nil {
+		return imported, err
+	}
+	names, err := fsKeys.List()
+	if err != nil {
+		return imported, err
+	}
+	for _, name := range names {
+		sk, err := fsKeys.Get(name)
+		if err != nil {
+			return imported, err
+		}
+		if data, err = crypto.MarshalPrivateKey(sk); err != nil {
+			return imported, err
+		}
+		if err := k.Import(ctx, ipnsKeyPrefix+name, data); err != nil {
+			return imported, err
+		}
+		imported = append(imported, ipnsKeyPrefix+name)
+	}
+	return imported, nil
+}
@@ -0,0 +1,126 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/go-ipfs-config"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pentateu/email-cloud-service/kms"
+)
+
+// testKMS opens a local keystore in dir and makes it the KMS of the node
+func testKMS(t *testing.T, dir string) *kms.Keystore {
+	ks, err := kms.OpenKeystore(filepath.Join(dir, "keystore.json"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	openKMS = func() (kms.KMS, error) { return ks, nil }
+	return ks
+}
+
+// tempDir returns a new temporary directory and the function removing it
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cryptomail-ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestIdentityConfig(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	defer func(f func() (kms.KMS, error)) { openKMS = f }(openKMS)
+	ks := testKMS(t, dir)
+	defer func(key string) { identityKey = key }(identityKey)
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Import(context.Background(), "ipfs-identity", data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range []string{"/path/to/identity", "kms:", "kms:missing"} {
+		identityKey = invalid
+		if _, err := identityConfig(); err == nil {
+			t.Errorf("expected an error for --ipfs-identity %s", invalid)
+		}
+	}
+	identityKey = "kms:ipfs-identity"
+	opt, err := identityConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	opt(cfg)
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := cfg.Identity.DecodePrivateKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Identity.PeerID != id.Pretty() || !decoded.Equals(sk) {
+		t.Errorf("unexpected identity %+v", cfg.Identity)
+	}
+}
+
+func TestKMSKeystore(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	defer func(f func() (kms.KMS, error)) { openKMS = f }(openKMS)
+	k := testKMS(t, dir)
+	if err := k.Import(context.Background(), "dkim", []byte("not an IPNS key")); err != nil {
+		t.Fatal(err)
+	}
+	ks := kmsKeystore{k: k}
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ks.Has("mailbox"); ok || err != nil {
+		t.Errorf("expected no mailbox key, got %v (%v)", ok, err)
+	}
+	if _, err := ks.Get("mailbox"); err != keystore.ErrNoSuchKey {
+		t.Errorf("expected ErrNoSuchKey, got %v", err)
+	}
+	if err := ks.Put("mailbox", sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Put("mailbox", sk); err != keystore.ErrKeyExists {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	if ok, err := ks.Has("mailbox"); !ok || err != nil {
+		t.Errorf("expected the mailbox key, got %v (%v)", ok, err)
+	}
+	got, err := ks.Get("mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(sk) {
+		t.Error("unexpected mailbox key")
+	}
+	names, err := ks.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "mailbox" {
+		t.Errorf("expected only the mailbox key, got %v", names)
+	}
+	if err := ks.Delete("mailbox"); err == nil {
+		t.Error("expected the node not to remove keys from the KMS")
+	}
+}
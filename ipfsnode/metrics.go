@@ -0,0 +1,22 @@
+package ipfs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	peerConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cryptomail",
+		Name:      "peer_connected",
+		Help:      "Whether a configured peer is connected (1) or not (0).",
+	}, []string{"peer"})
+	peerReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cryptomail",
+		Name:      "peer_reconnects_total",
+		Help:      "Number of times a connection to a configured peer was lost.",
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(peerConnected, peerReconnects)
+}
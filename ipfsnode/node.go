@@ -2,21 +2,39 @@ package ipfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
 
+	config "github.com/ipfs/go-ipfs-config"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/libp2p/go-libp2p-core/host"
 )
 
 type CfgOpt func(*config.Config)
 
+// ErrRepoLocked is returned by CheckRepo when another process, eg. the service, runs the node of the repo
+var ErrRepoLocked = errors.New("the IPFS repo is used by another process, stop the service first")
+
+// node is the embedded node, nil when using the http strategy
+var node *core.IpfsNode
+
+//PeerHost - returns the libp2p host of the embedded node, nil if the node is not embedded.
+func PeerHost() host.Host {
+	if node == nil {
+		return nil
+	}
+	return node.PeerHost
+}
+
 //spawn - attempts to open a ipfs node based on the configuration root path.
 //if fails try to open a node on a temprary folder.
 func spawn(ctx context.Context) (iface.CoreAPI, error) {
@@ -30,7 +48,19 @@ func spawn(ctx context.Context) (iface.CoreAPI, error) {
 		return nil, err
 	}
 
-	ipfs, err := open(ctx, defaultPath)
+	opts, err := kmsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if privateNetwork {
+		if key, err = readSwarmKey(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, privateConfig)
+	}
+
+	ipfs, err := open(ctx, defaultPath, key, opts...)
 	if err == nil {
 		return ipfs, nil
 	}
@@ -38,6 +68,26 @@ func spawn(ctx context.Context) (iface.CoreAPI, error) {
 	return tmpNode(ctx)
 }
 
+//CheckRepo - fail when the spawn strategy can't open the node of the repo because another
+//process holds it, spawn would fall back to a temporary node without the mailboxes.
+func CheckRepo() error {
+	if nodeType != "spawn" {
+		return nil
+	}
+	defaultPath, err := config.PathRoot()
+	if err != nil {
+		return err
+	}
+	locked, err := fsrepo.LockedByOtherProcess(defaultPath)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrRepoLocked
+	}
+	return nil
+}
+
 // setupPlugins - Load ipfs plugins from the folder {path}/plugins/
 func setupPlugins(path string) error {
 	plugins, err := loader.NewPluginLoader(filepath.Join(path, "plugins"))
@@ -56,16 +106,32 @@ func setupPlugins(path string) error {
 	return nil
 }
 
-//open - open a ipfs node for a given folder.
-func open(ctx context.Context, repoPath string) (iface.CoreAPI, error) {
+//open - open a ipfs node for a given folder, applying opts to the config of the node.
+//The config file of the repo is left as it is.
+//swarmKey is the key of the private network to join, nil for the public network.
+func open(ctx context.Context, repoPath string, swarmKey []byte, opts ...CfgOpt) (iface.CoreAPI, error) {
 	// Open the repo
 	r, err := fsrepo.Open(repoPath)
 	if err != nil {
 		return nil, err
 	}
+	if len(opts) > 0 {
+		if r, err = withConfig(r, opts...); err != nil {
+			return nil, err
+		}
+	}
+
+	if swarmKey != nil {
+		r = withSwarmKey(r, swarmKey)
+	}
+	if kmsKeys {
+		if r, err = withKMSKeystore(r); err != nil {
+			return nil, err
+		}
+	}
 
 	// Construct the node
-	node, err := core.NewNode(ctx, &core.BuildCfg{
+	n, err := core.NewNode(ctx, &core.BuildCfg{
 		Online:  true,
 		Routing: libp2p.DHTClientOption,
 		Repo:    r,
@@ -73,9 +139,35 @@ func open(ctx context.Context, repoPath string) (iface.CoreAPI, error) {
 	if err != nil {
 		return nil, err
 	}
+	node = n
 	return coreapi.NewCoreAPI(node)
 }
 
+//configRepo - a repo whose config is changed in memory only, for the node built from it
+type configRepo struct {
+	repo.Repo
+	cfg *config.Config
+}
+
+func (r configRepo) Config() (*config.Config, error) {
+	return r.cfg, nil
+}
+
+//withConfig - apply opts to a copy of the config of r
+func withConfig(r repo.Repo, opts ...CfgOpt) (repo.Repo, error) {
+	cfg, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg, err = cfg.Clone(); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return configRepo{Repo: r, cfg: cfg}, nil
+}
+
 //temp load pluigins and creates a temporary node
 func temp(ctx context.Context) (iface.CoreAPI, error) {
 	defaultPath, err := config.PathRoot()
@@ -93,6 +185,17 @@ func temp(ctx context.Context) (iface.CoreAPI, error) {
 
 //tmpNode - creates a temporary node 'dhtclient' on a temp folder.
 func tmpNode(ctx context.Context) (iface.CoreAPI, error) {
+	opts, err := kmsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if privateNetwork {
+		if key, err = readSwarmKey(); err != nil {
+			return nil, err
+		}
+	}
+
 	dir, err := ioutil.TempDir("", "ipfs-shell")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get temp dir: %s", err)
@@ -117,10 +220,25 @@ func tmpNode(ctx context.Context) (iface.CoreAPI, error) {
 
 	// configure the temporary node
 	cfg.Routing.Type = "dhtclient"
+	if privateNetwork {
+		privateConfig(cfg)
+	}
 
 	err = fsrepo.Init(dir, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init ephemeral node: %s", err)
 	}
-	return open(ctx, dir)
+	return open(ctx, dir, key, opts...)
+}
+
+//kmsConfig - the options setting the node identity kept in the KMS, if any
+func kmsConfig() ([]CfgOpt, error) {
+	if identityKey == "" {
+		return nil, nil
+	}
+	opt, err := identityConfig()
+	if err != nil {
+		return nil, err
+	}
+	return []CfgOpt{opt}, nil
 }
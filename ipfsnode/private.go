@@ -0,0 +1,68 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/pentateu/email-cloud-service/kms"
+)
+
+var errNoSwarmKey = errors.New("private network selected but no swarm key configured, use --ipfs-swarm-key")
+
+//readSwarmKey - read and validate the configured swarm key, from a file or from the KMS
+//when the path is kms:<name>
+func readSwarmKey() ([]byte, error) {
+	if swarmKeyPath == "" {
+		return nil, errNoSwarmKey
+	}
+	var key []byte
+	var err error
+	if name := strings.TrimPrefix(swarmKeyPath, kms.SecretPrefix); name != swarmKeyPath {
+		var k kms.KMS
+		if k, err = openKMS(); err == nil {
+			key, err = k.Secret(context.Background(), name)
+		}
+	} else {
+		key, err = ioutil.ReadFile(swarmKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read swarm key: %s", err)
+	}
+	if _, err := pnet.DecodeV1PSK(bytes.NewReader(key)); err != nil {
+		return nil, fmt.Errorf("invalid swarm key %s: %s", swarmKeyPath, err)
+	}
+	return key, nil
+}
+
+//swarmKeyRepo - a repo handing go-ipfs a swarm key held in memory instead of the swarm.key file
+//of the repo, go-ipfs builds the libp2p private network option from it. The key, eg. read from
+//the KMS, is never written to the repo.
+type swarmKeyRepo struct {
+	repo.Repo
+	key []byte
+}
+
+func (r swarmKeyRepo) SwarmKey() ([]byte, error) {
+	return r.key, nil
+}
+
+//withSwarmKey - make the node of r join the private network of key. libp2p is forced to use
+//it, so the node refuses to start rather than join the public network.
+func withSwarmKey(r repo.Repo, key []byte) repo.Repo {
+	pnet.ForcePrivateNetwork = true
+	return swarmKeyRepo{Repo: r, key: key}
+}
+
+//privateConfig - configure the node for the private network: no public bootstrap peers,
+//the configured peers are used instead, and no local discovery.
+func privateConfig(cfg *config.Config) {
+	cfg.Bootstrap = append([]string{}, peers...)
+	cfg.Discovery.MDNS.Enabled = false
+}
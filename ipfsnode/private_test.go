@@ -0,0 +1,81 @@
+package ipfs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+const testSwarmKey = "/key/swarm/psk/1.0.0/\n/base16/\n" +
+	"0a2a26b3f5a0cf1c6ca9f3b0f0d2b0b5a7b5d9f8d8c4e1e0f5b3a2c1d0e9f8a7\n"
+
+func TestReadSwarmKey(t *testing.T) {
+	defer func(path string) { swarmKeyPath = path }(swarmKeyPath)
+	dir, remove := tempDir(t)
+	defer remove()
+
+	swarmKeyPath = ""
+	if _, err := readSwarmKey(); err != errNoSwarmKey {
+		t.Errorf("expected errNoSwarmKey, got %v", err)
+	}
+	swarmKeyPath = filepath.Join(dir, "missing.key")
+	if _, err := readSwarmKey(); err == nil {
+		t.Error("expected an error for a missing swarm key")
+	}
+	swarmKeyPath = filepath.Join(dir, "swarm.key")
+	for _, invalid := range []string{"", "not a key", strings.Replace(testSwarmKey, "0a2a", "zz2a", 1),
+		strings.Replace(testSwarmKey, "0a2a", "", 1)} {
+		if err := ioutil.WriteFile(swarmKeyPath, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSwarmKey(); err == nil {
+			t.Errorf("expected an error for the swarm key %q", invalid)
+		}
+	}
+	if err := ioutil.WriteFile(swarmKeyPath, []byte(testSwarmKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := readSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != testSwarmKey {
+		t.Errorf("unexpected swarm key %q", key)
+	}
+}
+
+func TestPrivateConfig(t *testing.T) {
+	defer func(p []string) { peers = p }(peers)
+	peers = []string{"/ip4/10.0.0.2/tcp/4001/p2p/12D3KooWK1sc81mJwopPD9LcyCEHCHbD3cSE8idQf5GobgMd8PLg"}
+	r := &repo.Mock{C: config.Config{Bootstrap: config.DefaultBootstrapAddresses}}
+	r.C.Discovery.MDNS.Enabled = true
+
+	private, err := withConfig(r, privateConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := private.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cfg.Bootstrap, ",") != peers[0] || cfg.Discovery.MDNS.Enabled {
+		t.Errorf("expected the configured peers only and no local discovery, got %v, MDNS %v",
+			cfg.Bootstrap, cfg.Discovery.MDNS.Enabled)
+	}
+	// the config of the repo is left as it is
+	if len(r.C.Bootstrap) != len(config.DefaultBootstrapAddresses) || !r.C.Discovery.MDNS.Enabled {
+		t.Errorf("the config of the repo changed: %v, MDNS %v", r.C.Bootstrap, r.C.Discovery.MDNS.Enabled)
+	}
+}
+
+func TestStartPrivateLocal(t *testing.T) {
+	defer func(private bool, node string) { privateNetwork, nodeType = private, node }(privateNetwork, nodeType)
+	privateNetwork, nodeType = true, "local"
+	if _, err := Start(nil, nil); err == nil {
+		t.Error("expected a private network to refuse the local node")
+	}
+}
@@ -0,0 +1,100 @@
+package kms
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// Environment variables holding the credentials of the KMS, so they stay out of the command line
+const (
+	PassphraseEnv = "CRYPTOMAIL_KMS_PASSPHRASE"
+	TokenEnv      = "CRYPTOMAIL_KMS_TOKEN"
+)
+
+// SecretPrefix marks a flag or config value naming a KMS entry instead of a file, eg. kms:swarm
+const SecretPrefix = "kms:"
+
+var (
+	location       string
+	passphraseFile string
+
+	opened struct {
+		sync.Mutex
+		k KMS
+	}
+)
+
+// ErrNoKMS is returned by Open when no KMS is configured
+var ErrNoKMS = errors.New("no KMS configured, use --kms")
+
+// Init registers the KMS flags
+func Init(rootCmd *cobra.Command) {
+	rootCmd.PersistentFlags().StringVar(&location, "kms", "",
+		"KMS holding the private keys: the path of a local keystore or the https:// URL of a remote KMS, http:// on loopback only")
+	rootCmd.PersistentFlags().StringVar(&passphraseFile, "kms-passphrase-file", "",
+		"File with the passphrase of the local keystore, defaults to $"+PassphraseEnv)
+}
+
+// isRemote tells if location is the URL of a remote KMS. The token and the keys must not
+// cross the network in clear: plain http is only allowed to a loopback address.
+func isRemote(location string) (bool, error) {
+	if strings.HasPrefix(location, "https://") {
+		return true, nil
+	}
+	if !strings.HasPrefix(location, "http://") {
+		return false, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return false, fmt.Errorf("invalid KMS URL %s: %s", location, err)
+	}
+	if host := u.Hostname(); host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return false, fmt.Errorf("remote KMS %s must use https://, http:// is only allowed on loopback", location)
+		}
+	}
+	return true, nil
+}
+
+// Open returns the KMS selected with --kms, opened once per process. The passphrase of a
+// keystore comes from --kms-passphrase-file or $CRYPTOMAIL_KMS_PASSPHRASE, the token of a
+// remote KMS from $CRYPTOMAIL_KMS_TOKEN.
+func Open() (KMS, error) {
+	opened.Lock()
+	defer opened.Unlock()
+	if opened.k != nil {
+		return opened.k, nil
+	}
+	if location == "" {
+		return nil, ErrNoKMS
+	}
+	if remote, err := isRemote(location); err != nil {
+		return nil, err
+	} else if remote {
+		opened.k = NewRemote(location, os.Getenv(TokenEnv))
+		return opened.k, nil
+	}
+	passphrase := []byte(os.Getenv(PassphraseEnv))
+	if passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	}
+	ks, err := OpenKeystore(location, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	opened.k = ks
+	return ks, nil
+}
@@ -0,0 +1,180 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// keystore scrypt parameters, stored in the file so they can be raised later
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var errPassphrase = errors.New("wrong keystore passphrase")
+
+// checkName is the associated data of the check entry, never a valid key name
+const checkName = "\x00check"
+
+// Keystore is a KMS kept in a local file encrypted with a passphrase
+type Keystore struct {
+	mu   sync.Mutex
+	path string
+	key  []byte
+	file keystoreFile
+}
+
+// keystoreFile is the JSON content of the keystore file
+type keystoreFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	// Check is an empty entry, opening it tells if the passphrase is right
+	Check []byte `json:"check"`
+	// Entries are nonce || ciphertext, the name is the associated data
+	Entries map[string][]byte `json:"entries"`
+}
+
+// OpenKeystore opens the keystore at path with passphrase, it is created when missing
+func OpenKeystore(path string, passphrase []byte) (*Keystore, error) {
+	ks := &Keystore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		ks.file = keystoreFile{Version: 1, KDF: "scrypt", Salt: make([]byte, 16), N: scryptN, R: scryptR, P: scryptP,
+			Entries: make(map[string][]byte)}
+		if _, err := rand.Read(ks.file.Salt); err != nil {
+			return nil, err
+		}
+		if ks.key, err = ks.derive(passphrase); err != nil {
+			return nil, err
+		}
+		if ks.file.Check, err = ks.seal(checkName, nil); err != nil {
+			return nil, err
+		}
+		return ks, ks.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ks.file); err != nil {
+		return nil, fmt.Errorf("could not parse keystore %s: %s", path, err)
+	}
+	if ks.file.Version != 1 || ks.file.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported keystore %s, version %d %s", path, ks.file.Version, ks.file.KDF)
+	}
+	if ks.key, err = ks.derive(passphrase); err != nil {
+		return nil, err
+	}
+	if _, err := ks.open(checkName, ks.file.Check); err != nil {
+		return nil, errPassphrase
+	}
+	if ks.file.Entries == nil {
+		ks.file.Entries = make(map[string][]byte)
+	}
+	return ks, nil
+}
+
+func (ks *Keystore) derive(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty keystore passphrase")
+	}
+	return scrypt.Key(passphrase, ks.file.Salt, ks.file.N, ks.file.R, ks.file.P, chacha20poly1305.KeySize)
+}
+
+func (ks *Keystore) seal(name string, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(ks.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func (ks *Keystore) open(name string, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(ks.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated keystore entry")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+}
+
+// save writes the keystore, replacing the file atomically, the caller must hold the lock
+func (ks *Keystore) save() error {
+	data, err := json.MarshalIndent(&ks.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+func (ks *Keystore) Secret(ctx context.Context, name string) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	sealed, ok := ks.file.Entries[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	data, err := ks.open(name, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt key %s: %s", name, err)
+	}
+	return data, nil
+}
+
+func (ks *Keystore) Signer(ctx context.Context, name string) (crypto.Signer, error) {
+	data, err := ks.Secret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
+
+func (ks *Keystore) Import(ctx context.Context, name string, data []byte) error {
+	if name == "" || name == checkName {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	sealed, err := ks.seal(name, data)
+	if err != nil {
+		return err
+	}
+	ks.file.Entries[name] = sealed
+	return ks.save()
+}
+
+func (ks *Keystore) List(ctx context.Context) ([]string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	names := make([]string, 0, len(ks.file.Entries))
+	for name := range ks.file.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,60 @@
+// Package kms keeps the private keys and secrets the service holds: DKIM signing keys,
+// the swarm key of the private network, the identity and IPNS keys of the IPFS node...
+//
+// Two implementations are provided. Keystore is a local file where every entry is encrypted
+// with XChaCha20-Poly1305 under a key derived from a passphrase with scrypt. Remote is a key
+// management service reached over HTTP: private keys stay in the service, which signs the
+// digests sent to it.
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned for a name the KMS has no key for
+var ErrNotFound = errors.New("no such key")
+
+// KMS is a key management service
+type KMS interface {
+	// Signer returns the private key name. The keys of a remote KMS never leave it,
+	// the signer sends it the digests to sign.
+	Signer(ctx context.Context, name string) (crypto.Signer, error)
+	// Secret returns the secret name, for material used as it is, eg. the swarm key
+	Secret(ctx context.Context, name string) ([]byte, error)
+	// Import stores data under name, a PKCS#8 or PKCS#1 private key (DER or PEM) or any secret
+	Import(ctx context.Context, name string, data []byte) error
+	// List returns the names of the keys
+	List(ctx context.Context) ([]string, error)
+}
+
+// ParsePrivateKey parses a PKCS#8, or PKCS#1 for RSA, private key in DER or PEM
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		s, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", k)
+		}
+		return s, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("not a PKCS#8 or PKCS#1 private key")
+}
+
+// hashName names the hash of signing options in the remote protocol,
+// empty when the message itself is signed (ed25519)
+func hashName(h crypto.Hash) string {
+	if h == 0 {
+		return ""
+	}
+	return h.String()
+}
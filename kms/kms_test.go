@@ -0,0 +1,228 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKeys imports an RSA key, an ed25519 key and a secret in k
+func testKeys(t *testing.T, k KMS) {
+	ctx := context.Background()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"dkim-rsa":     x509.MarshalPKCS1PrivateKey(rsaKey),
+		"dkim-ed25519": edDER,
+		"swarm":        []byte("/key/swarm/psk/1.0.0/\n/base16/\n0123"),
+	} {
+		if err := k.Import(ctx, name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkKeys uses the keys imported by testKeys
+func checkKeys(t *testing.T, k KMS) {
+	ctx := context.Background()
+	names, err := k.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "dkim-ed25519,dkim-rsa,swarm" {
+		t.Errorf("unexpected names %v", names)
+	}
+	secret, err := k.Secret(ctx, "swarm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(secret), "/key/swarm/psk/1.0.0/") {
+		t.Errorf("unexpected secret %q", secret)
+	}
+	if _, err := k.Secret(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	msg := []byte("DKIM-Signature: v=1")
+	digest := sha256.Sum256(msg)
+	s, err := k.Signer(ctx, "dkim-rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(s.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Error(err)
+	}
+	s, err = k.Signer(ctx, "dkim-ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, err = s.Sign(rand.Reader, msg, crypto.Hash(0)); err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(s.Public().(ed25519.PublicKey), msg, sig) {
+		t.Error("invalid ed25519 signature")
+	}
+	if _, err := k.Signer(ctx, "swarm"); err == nil {
+		t.Error("expected an error using a secret as a private key")
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptomail-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore.json")
+
+	ks, err := OpenKeystore(path, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys(t, ks)
+	checkKeys(t, ks)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "psk") {
+		t.Error("the keystore is not encrypted")
+	}
+	if _, err := OpenKeystore(path, []byte("wrong horse")); err != errPassphrase {
+		t.Errorf("expected errPassphrase, got %v", err)
+	}
+	if ks, err = OpenKeystore(path, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, ks)
+}
+
+// stubKMS serves the remote protocol with a KMS, checking the token
+func stubKMS(k KMS, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := func(status int, m *remoteMessage) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(m)
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			reply(http.StatusUnauthorized, &remoteMessage{Error: "bad token"})
+			return
+		}
+		req := &remoteMessage{}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(req)
+		}
+		ctx := r.Context()
+		if r.URL.Path == "/v1/keys" {
+			names, _ := k.List(ctx)
+			reply(http.StatusOK, &remoteMessage{Names: names})
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/keys/"), "/")
+		name, op := parts[0], ""
+		if len(parts) > 1 {
+			op = parts[1]
+		}
+		resp := &remoteMessage{}
+		var err error
+		switch {
+		case r.Method == http.MethodPut && op == "":
+			err = k.Import(ctx, name, req.Data)
+		case op == "secret":
+			resp.Secret, err = k.Secret(ctx, name)
+		case op == "public" || op == "sign":
+			var s crypto.Signer
+			if s, err = k.Signer(ctx, name); err != nil {
+				break
+			}
+			if op == "public" {
+				resp.PublicKey, err = x509.MarshalPKIXPublicKey(s.Public())
+				break
+			}
+			h := crypto.Hash(0)
+			if req.Hash == crypto.SHA256.String() {
+				h = crypto.SHA256
+			}
+			resp.Signature, err = s.Sign(rand.Reader, req.Digest, h)
+		default:
+			reply(http.StatusBadRequest, &remoteMessage{Error: "unknown operation"})
+			return
+		}
+		switch {
+		case err == ErrNotFound:
+			reply(http.StatusNotFound, &remoteMessage{Error: err.Error()})
+		case err != nil:
+			reply(http.StatusInternalServerError, &remoteMessage{Error: err.Error()})
+		default:
+			reply(http.StatusOK, resp)
+		}
+	})
+}
+
+func TestRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptomail-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks, err := OpenKeystore(filepath.Join(dir, "keystore.json"), []byte("stub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(stubKMS(ks, "s3cret"))
+	defer srv.Close()
+
+	r := NewRemote(srv.URL+"/", "s3cret")
+	testKeys(t, r)
+	checkKeys(t, r)
+
+	if _, err := NewRemote(srv.URL, "wrong").List(context.Background()); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Errorf("expected the KMS error, got %v", err)
+	}
+}
+
+func TestIsRemote(t *testing.T) {
+	for location, want := range map[string]bool{
+		"https://kms.example.com/v1":    true,
+		"http://127.0.0.1:8200":         true,
+		"http://[::1]:8200/":            true,
+		"http://localhost:8200":         true,
+		"/etc/cryptomail/keystore.json": false,
+	} {
+		if remote, err := isRemote(location); err != nil || remote != want {
+			t.Errorf("isRemote(%q) = %v, %v, expected %v", location, remote, err, want)
+		}
+	}
+	for _, location := range []string{"http://kms.example.com", "http://10.0.0.2:8200", "http://localhost.example.com"} {
+		if _, err := isRemote(location); err == nil {
+			t.Errorf("expected %s to be refused", location)
+		}
+	}
+}
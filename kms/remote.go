@@ -0,0 +1,149 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Remote is a KMS reached over HTTP. Requests carry the token as a bearer token,
+// bodies are JSON and binary values are base64:
+//
+//	GET  /v1/keys                 {"names": [...]}
+//	GET  /v1/keys/<name>/public   {"public_key": <PKIX DER>}
+//	POST /v1/keys/<name>/sign     {"digest": ..., "hash": "SHA-256"} -> {"signature": ...}
+//	GET  /v1/keys/<name>/secret   {"secret": ...}
+//	PUT  /v1/keys/<name>          {"data": ...}
+//
+// hash is empty when the message itself is signed, as with ed25519.
+// An unknown name is a 404, any other error a non 2xx status with {"error": ...}.
+type Remote struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// NewRemote returns the KMS at base, eg. https://kms.internal:8443
+func NewRemote(base, token string) *Remote {
+	return &Remote{base: strings.TrimRight(base, "/"), token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// remoteMessage is the body of every request and response
+type remoteMessage struct {
+	Names     []string `json:"names,omitempty"`
+	PublicKey []byte   `json:"public_key,omitempty"`
+	Digest    []byte   `json:"digest,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+	Signature []byte   `json:"signature,omitempty"`
+	Secret    []byte   `json:"secret,omitempty"`
+	Data      []byte   `json:"data,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (r *Remote) do(ctx context.Context, method, path string, req *remoteMessage) (*remoteMessage, error) {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, r.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	if req != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	ret := &remoteMessage{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(ret); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid KMS response: %s", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2 && ret.Error != "":
+		return nil, fmt.Errorf("KMS error: %s", ret.Error)
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("KMS error: %s", resp.Status)
+	}
+	return ret, nil
+}
+
+func keyPath(name string) string {
+	return "/v1/keys/" + url.PathEscape(name)
+}
+
+func (r *Remote) Signer(ctx context.Context, name string) (crypto.Signer, error) {
+	resp, err := r.do(ctx, http.MethodGet, keyPath(name)+"/public", nil)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key for %s: %s", name, err)
+	}
+	return &remoteSigner{r: r, name: name, pub: pub}, nil
+}
+
+func (r *Remote) Secret(ctx context.Context, name string) ([]byte, error) {
+	resp, err := r.do(ctx, http.MethodGet, keyPath(name)+"/secret", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Secret, nil
+}
+
+func (r *Remote) Import(ctx context.Context, name string, data []byte) error {
+	_, err := r.do(ctx, http.MethodPut, keyPath(name), &remoteMessage{Data: data})
+	return err
+}
+
+func (r *Remote) List(ctx context.Context) ([]string, error) {
+	resp, err := r.do(ctx, http.MethodGet, "/v1/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Names, nil
+}
+
+// remoteSigner signs with a key kept by a remote KMS
+type remoteSigner struct {
+	r    *Remote
+	name string
+	pub  crypto.PublicKey
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	resp, err := s.r.do(context.Background(), http.MethodPost, keyPath(s.name)+"/sign",
+		&remoteMessage{Digest: digest, Hash: hashName(opts.HashFunc())})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Signature) == 0 {
+		return nil, errors.New("KMS returned an empty signature")
+	}
+	return resp.Signature, nil
+}
@@ -0,0 +1,227 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// AckTopic is the pubsub topic client nodes publish acknowledgements to
+	AckTopic = "/cryptomail/ack/1.0.0"
+	// ackMaxSkew is how far the timestamp of an acknowledgement may be from the service clock
+	ackMaxSkew = 10 * time.Minute
+	// ackSignPrefix separates acknowledgement signatures from any other use of the account key
+	ackSignPrefix = "cryptomail-ack:"
+)
+
+var (
+	errAckUnknownAccount = errors.New("acknowledgement for an unknown account")
+	errAckBadSignature   = errors.New("acknowledgement signature is invalid")
+	errAckExpired        = errors.New("acknowledgement timestamp is out of range")
+)
+
+// Ack is sent by a client node after it has fetched messages, so the service
+// can unpin them and remove them from the local Maildir.
+type Ack struct {
+	Account   string   `json:"account"`
+	CIDs      []string `json:"cids"`
+	Timestamp int64    `json:"timestamp"`
+	Signature []byte   `json:"signature,omitempty"`
+}
+
+// signedBytes returns the bytes covered by the signature
+func (a *Ack) signedBytes() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = nil
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ackSignPrefix), data...), nil
+}
+
+// Sign signs the acknowledgement with the account key
+func (a *Ack) Sign(key crypto.PrivKey) error {
+	data, err := a.signedBytes()
+	if err != nil {
+		return err
+	}
+	a.Signature, err = key.Sign(data)
+	return err
+}
+
+// Verify checks the acknowledgement was signed by pub and is recent
+func (a *Ack) Verify(pub crypto.PubKey, now time.Time) error {
+	data, err := a.signedBytes()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(data, a.Signature)
+	if err != nil || !ok {
+		return errAckBadSignature
+	}
+	ts := time.Unix(a.Timestamp, 0)
+	if ts.Before(now.Add(-ackMaxSkew)) || ts.After(now.Add(ackMaxSkew)) {
+		return errAckExpired
+	}
+	return nil
+}
+
+// PublishAck is used by client nodes to acknowledge the messages they have fetched for account
+func PublishAck(ctx context.Context, ipfs iface.CoreAPI, key crypto.PrivKey, account string, cids []string) error {
+	a := &Ack{Account: account, CIDs: cids, Timestamp: time.Now().Unix()}
+	if err := a.Sign(key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return ipfs.PubSub().Publish(ctx, AckTopic, data)
+}
+
+// accountKeys parses the account keys config string and returns the result in a map
+// Example: "test=12D3KooWB...,guerrilla=12D3KooWC..."
+// the key is the peer ID of the account's client node, which embeds its public key
+func accountKeys(keys string) (ret map[string]crypto.PubKey, err error) {
+	ret = make(map[string]crypto.PubKey, 0)
+	if len(keys) == 0 {
+		return
+	}
+	records := strings.Split(keys, ",")
+	for i := range records {
+		r := strings.Split(records[i], "=")
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid account key record %q", records[i])
+		}
+		id, err := peer.Decode(strings.TrimSpace(r[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid account key for [%s]: %s", r[0], err)
+		}
+		pub, err := id.ExtractPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("account key for [%s] does not embed a public key: %s", r[0], err)
+		}
+		ret[strings.ToLower(strings.TrimSpace(r[0]))] = pub
+	}
+	return
+}
+
+// handleAck verifies a and releases the acknowledged messages:
+// the blocks are unpinned and the Maildir files removed
+func (m *MailDir) handleAck(ctx context.Context, a *Ack) error {
+	u := strings.ToLower(a.Account)
+	pub, ok := m.accountKeys[u]
+	if !ok {
+		return errAckUnknownAccount
+	}
+	idx, ok := m.indexes[u]
+	if !ok {
+		return errAckUnknownAccount
+	}
+	if err := a.Verify(pub, time.Now()); err != nil {
+		return err
+	}
+	for _, c := range a.CIDs {
+		e, ok := idx.byCID(c)
+		if !ok {
+			// already released or never stored for this account
+			continue
+		}
+		// the same encrypted message may have been delivered to other accounts,
+		// it stays pinned until they acknowledge it too
+		shared := m.storedElsewhere(u, c)
+		if m.ipfs != nil && !shared {
+			id, err := cid.Decode(c)
+			if err != nil {
+				return err
+			}
+			if err := m.ipfs.Pin().Rm(ctx, ipath.IpfsPath(id)); err != nil {
+				backends.Log().WithError(err).Error("could not unpin acknowledged message ", c)
+			}
+		}
+		if m.pinner != nil && m.pinner.Len() > 0 && !shared {
+			if err := m.pinner.Unpin(ctx, c); err != nil {
+				backends.Log().WithError(err).Error("could not unpin acknowledged message from remote pinning services")
+			}
+		}
+		if err := os.Remove(e.Filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := idx.remove(c); err != nil {
+			return err
+		}
+		backends.Log().Debug("released acknowledged message ", c)
+	}
+	return nil
+}
+
+// storedElsewhere reports if the message c is in the index of an account other than u
+func (m *MailDir) storedElsewhere(u, c string) bool {
+	for other, idx := range m.indexes {
+		if other == u {
+			continue
+		}
+		if _, ok := idx.byCID(c); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ackMux    sync.Mutex
+	ackCancel context.CancelFunc
+)
+
+// listenAcks subscribes to the acknowledgement topic and handles incoming acks.
+// Only one listener runs per process, so the listener started by an earlier worker
+// or before a config reload is replaced.
+func (m *MailDir) listenAcks() error {
+	ackMux.Lock()
+	defer ackMux.Unlock()
+	if ackCancel != nil {
+		ackCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := m.ipfs.PubSub().Subscribe(ctx, AckTopic)
+	if err != nil {
+		cancel()
+		return err
+	}
+	ackCancel = cancel
+	go func() {
+		defer sub.Close()
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					backends.Log().WithError(err).Error("acknowledgement subscription failed")
+				}
+				return
+			}
+			a := &Ack{}
+			if err := json.Unmarshal(msg.Data(), a); err != nil {
+				backends.Log().WithError(err).Info("ignoring malformed acknowledgement from ", msg.From())
+				continue
+			}
+			if err := m.handleAck(ctx, a); err != nil {
+				backends.Log().WithError(err).Info("rejected acknowledgement from ", msg.From())
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestAckSignVerify(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Ack{Account: "test", CIDs: []string{"bafy1", "bafy2"}, Timestamp: time.Now().Unix()}
+	if err := a.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(pub, time.Now()); err != nil {
+		t.Error("valid acknowledgement rejected:", err)
+	}
+	if err := a.Verify(pub, time.Now().Add(time.Hour)); err != errAckExpired {
+		t.Error("expected stale acknowledgement to be rejected, got", err)
+	}
+	a.CIDs = append(a.CIDs, "bafy3")
+	if err := a.Verify(pub, time.Now()); err != errAckBadSignature {
+		t.Error("expected tampered acknowledgement to be rejected, got", err)
+	}
+}
+
+func TestHandleAckRemovesMail(t *testing.T) {
+	dir, remove := testDir(t, "ack")
+	defer remove()
+
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:     "test=-1:-1",
+		AccountKeys: "test=" + id.Pretty(),
+	})
+	filename, err := m.dirs["test"].CreateMail(strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no IPFS node in the test, set the CID by hand
+	if _, err := m.indexes["test"].add(indexEntry{CID: "bafytest", Filename: filename}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Ack{Account: "test", CIDs: []string{"bafytest"}, Timestamp: time.Now().Unix()}
+	if err := a.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleAck(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("acknowledged message was not removed from the Maildir")
+	}
+	if _, ok := m.indexes["test"].byCID("bafytest"); ok {
+		t.Error("acknowledged message is still in the index")
+	}
+
+	// acknowledgements signed by another key must be ignored
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sign(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handleAck(context.Background(), a); err != errAckBadSignature {
+		t.Error("expected acknowledgement signed by another key to be rejected, got", err)
+	}
+}
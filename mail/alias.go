@@ -0,0 +1,332 @@
+package mail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pentateu/email-cloud-service/kms"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// aliasSecretName is the KMS secret the alias file is protected with
+const aliasSecretName = "aliases"
+
+// aliasSize is the number of random bytes of an alias, encoded in 16 z-base-32 characters
+const aliasSize = 10
+
+// openKMS returns the KMS of the process, replaced by the tests
+var openKMS = kms.Open
+
+var errNoSuchAlias = errors.New("no such alias")
+
+// Alias is an address issued to an account for a single correspondent, so the addresses
+// given to different correspondents can't be linked. Mail to a revoked alias is refused.
+type Alias struct {
+	Alias   string `json:"alias"`
+	Account string `json:"account"`
+	// Correspondent is a label for whom the alias was given to
+	Correspondent string    `json:"correspondent,omitempty"`
+	Created       time.Time `json:"created"`
+	Revoked       bool      `json:"revoked,omitempty"`
+}
+
+// aliasStore maps the aliases to their account. The file, maildir_aliases_path, only holds
+// an HMAC of each alias and the alias record encrypted, both keyed with a secret of the KMS:
+// it tells nothing about the accounts or their correspondents without the KMS.
+// The aliases command changes it while the service runs, so it is reloaded when the file changes.
+type aliasStore struct {
+	sync.Mutex
+	file    jsonFile
+	tagKey  []byte
+	sealKey []byte
+	// Aliases maps the hex HMAC of an alias to its sealed record
+	Aliases map[string][]byte `json:"aliases"`
+}
+
+// aliasStores are the alias stores opened, by path
+var aliasStores registry
+
+// openAliases returns the alias store at path, opened the first time
+func openAliases(path string) (*aliasStore, error) {
+	v, err := aliasStores.get(path, func() (interface{}, error) {
+		return newAliasStore(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*aliasStore), nil
+}
+
+// newAliasStore opens the alias store at path with the KMS secret
+func newAliasStore(path string) (*aliasStore, error) {
+	secret, err := kmsSecret(aliasSecretName)
+	if err != nil {
+		return nil, fmt.Errorf("aliases need a KMS: %s", err)
+	}
+	s := &aliasStore{file: jsonFile{path: path}}
+	if s.tagKey, err = aliasKey(secret, "tag"); err != nil {
+		return nil, err
+	}
+	if s.sealKey, err = aliasKey(secret, "seal"); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// kmsSecret returns the secret name of the KMS, a random one is created if the KMS has none
+func kmsSecret(name string) ([]byte, error) {
+	k, err := openKMS()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := k.Secret(context.Background(), name)
+	if err == kms.ErrNotFound {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err == nil {
+			err = k.Import(context.Background(), name, secret)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get the %s secret from the KMS: %s", name, err)
+	}
+	return secret, nil
+}
+
+func aliasKey(secret []byte, use string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("cryptomail-aliases/v1 "+use)), key)
+	return key, err
+}
+
+// load reads the store again if the file changed, the caller must hold the lock
+func (s *aliasStore) load() error {
+	loaded := &aliasStore{}
+	return s.file.load(loaded, func() error {
+		if loaded.Aliases == nil {
+			loaded.Aliases = make(map[string][]byte)
+		}
+		s.Aliases = loaded.Aliases
+		return nil
+	})
+}
+
+// save writes the store to disk, the caller must hold the lock
+func (s *aliasStore) save() error {
+	return s.file.save(s)
+}
+
+// tag returns the HMAC the alias is stored under
+func (s *aliasStore) tag(alias string) string {
+	mac := hmac.New(sha256.New, s.tagKey)
+	mac.Write([]byte(strings.ToLower(alias)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *aliasStore) seal(tag string, a *Alias) ([]byte, error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(s.sealKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(tag)), nil
+}
+
+func (s *aliasStore) open(tag string, sealed []byte) (*Alias, error) {
+	aead, err := chacha20poly1305.NewX(s.sealKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated alias record")
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(tag))
+	if err != nil {
+		return nil, err
+	}
+	a := &Alias{}
+	return a, json.Unmarshal(data, a)
+}
+
+// resolve returns the account of alias, if it is not revoked
+func (s *aliasStore) resolve(alias string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return "", false
+	}
+	tag := s.tag(alias)
+	sealed, ok := s.Aliases[tag]
+	if !ok {
+		return "", false
+	}
+	a, err := s.open(tag, sealed)
+	if err != nil || a.Revoked {
+		return "", false
+	}
+	return a.Account, true
+}
+
+// create issues a new alias for account
+func (s *aliasStore) create(account, correspondent string, now time.Time) (*Alias, error) {
+	b := make([]byte, aliasSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	a := &Alias{Alias: zbase32.EncodeToString(b), Account: account, Correspondent: correspondent, Created: now}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	tag := s.tag(a.Alias)
+	sealed, err := s.seal(tag, a)
+	if err != nil {
+		return nil, err
+	}
+	s.Aliases[tag] = sealed
+	return a, s.save()
+}
+
+// list returns the aliases of account, oldest first
+func (s *aliasStore) list(account string) ([]Alias, error) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	ret := make([]Alias, 0)
+	for tag, sealed := range s.Aliases {
+		a, err := s.open(tag, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt alias record: %s", err)
+		}
+		if a.Account == account {
+			ret = append(ret, *a)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret, nil
+}
+
+// revoke revokes alias, mail to it is refused from now on
+func (s *aliasStore) revoke(alias string) (*Alias, error) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	tag := s.tag(alias)
+	sealed, ok := s.Aliases[tag]
+	if !ok {
+		return nil, errNoSuchAlias
+	}
+	a, err := s.open(tag, sealed)
+	if err != nil {
+		return nil, err
+	}
+	a.Revoked = true
+	if s.Aliases[tag], err = s.seal(tag, a); err != nil {
+		return nil, err
+	}
+	return a, s.save()
+}
+
+// account returns the account mail to the local part user is delivered to: the account
+// itself or the account of an alias. A subaddress, eg. test+news, is delivered to the
+// account of its base, tag is what follows the separator.
+func (m *MailDir) account(user string) (account, tag string, ok bool) {
+	u := strings.ToLower(user)
+	if a, ok := m.resolve(u); ok {
+		return a, "", true
+	}
+	base, tag := m.subaddress(u)
+	if tag == "" {
+		return "", "", false
+	}
+	if a, ok := m.resolve(base); ok {
+		return a, tag, true
+	}
+	return "", "", false
+}
+
+// resolve returns the account of the local part u: the account itself or the account of an alias
+func (m *MailDir) resolve(u string) (string, bool) {
+	if _, ok := m.dirs[u]; ok {
+		return u, true
+	}
+	if m.aliases != nil {
+		if a, ok := m.aliases.resolve(u); ok {
+			if _, ok := m.dirs[a]; ok {
+				return a, true
+			}
+		}
+	}
+	return "", false
+}
+
+// openAliasesFor opens the alias store of the config at configPath, for the aliases command
+func openAliasesFor(configPath string) (*MailDir, error) {
+	m, err := loadMailDir(configPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.aliases == nil {
+		return nil, errors.New("maildir_aliases_path is not configured")
+	}
+	return m, nil
+}
+
+// CreateAlias issues a new alias for account, for the aliases command
+func CreateAlias(configPath, account, correspondent string) (*Alias, error) {
+	m, err := openAliasesFor(configPath)
+	if err != nil {
+		return nil, err
+	}
+	account = strings.ToLower(account)
+	if _, ok := m.dirs[account]; !ok {
+		return nil, fmt.Errorf("no such account [%s]", account)
+	}
+	return m.aliases.create(account, correspondent, time.Now())
+}
+
+// ListAliases returns the aliases of account, for the aliases command
+func ListAliases(configPath, account string) ([]Alias, error) {
+	m, err := openAliasesFor(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return m.aliases.list(strings.ToLower(account))
+}
+
+// RevokeAlias revokes alias, for the aliases command
+func RevokeAlias(configPath, alias string) (*Alias, error) {
+	m, err := openAliasesFor(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return m.aliases.revoke(alias)
+}
@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAliases(t *testing.T) {
+	dir, remove := testDir(t, "aliases")
+	defer remove()
+	_, restore := testKMS(t, dir)
+	defer restore()
+
+	path := filepath.Join(dir, "aliases.json")
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:     "test=-1:-1,guerrilla=-1:-1",
+		AliasesPath: path,
+	})
+
+	// the aliases command runs in another process
+	cli, err := newAliasStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cli.create("test", "bob@example.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cli.create("test", "carol@example.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Alias) != 16 || a.Alias == other.Alias {
+		t.Fatalf("unexpected aliases %s %s", a.Alias, other.Alias)
+	}
+
+	if err := m.validateRcpt(&mail.Address{User: a.Alias, Host: "example.com"}); err != nil {
+		t.Errorf("alias rejected: %v", err)
+	}
+	if err := m.validateRcpt(&mail.Address{User: "unknown"}); err != backends.NoSuchUser {
+		t.Errorf("expected NoSuchUser, got %v", err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hello\r\n\r\nbody\r\n")
+	e.RcptTo = []mail.Address{{User: a.Alias}, {User: other.Alias}, {User: "test"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].user != "test" {
+		t.Errorf("expected a single delivery to test, got %+v", saved)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{a.Alias, "test", "bob"} {
+		if bytes.Contains(data, []byte(leak)) {
+			t.Errorf("the alias file contains %q", leak)
+		}
+	}
+
+	aliases, err := cli.list("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 || aliases[0].Correspondent != "bob@example.com" {
+		t.Errorf("unexpected aliases %+v", aliases)
+	}
+	if _, err := cli.revoke(a.Alias); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.validateRcpt(&mail.Address{User: a.Alias}); err != backends.NoSuchUser {
+		t.Errorf("expected a revoked alias to be refused, got %v", err)
+	}
+	if err := m.validateRcpt(&mail.Address{User: other.Alias}); err != nil {
+		t.Errorf("alias rejected: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// AutocryptFileName is the name of the file, kept in the root of each Maildir, that logs what
+// the received messages tell about the Autocrypt state of their senders. Each line is an
+// AutocryptObservation encrypted to the account key: the service can't read it back, clients
+// sync the log and rebuild the peer state with AutocryptPeers.
+const AutocryptFileName = "cryptomail-autocrypt.json"
+
+// Autocrypt Level 1 prefer-encrypt values
+const (
+	PreferEncryptNoPreference = "nopreference"
+	PreferEncryptMutual       = "mutual"
+)
+
+// maxAutocryptKeySize bounds the key data accepted in an Autocrypt header
+const maxAutocryptKeySize = 16 * 1024
+
+var errAutocryptHeader = errors.New("invalid Autocrypt header")
+
+// AutocryptObservation is what a received message tells about the Autocrypt state of its sender
+type AutocryptObservation struct {
+	Addr string `json:"addr"`
+	// Date is the effective date of the message, its Date header unless in the future
+	Date time.Time `json:"date"`
+	// KeyData is the OpenPGP public key of the Autocrypt header, empty when the message
+	// had no valid header
+	KeyData       []byte `json:"keydata,omitempty"`
+	PreferEncrypt string `json:"prefer_encrypt,omitempty"`
+}
+
+// AutocryptPeer is the Autocrypt Level 1 state of a peer
+type AutocryptPeer struct {
+	Addr               string    `json:"addr"`
+	LastSeen           time.Time `json:"last_seen"`
+	AutocryptTimestamp time.Time `json:"autocrypt_timestamp"`
+	PublicKey          []byte    `json:"public_key"`
+	PreferEncrypt      string    `json:"prefer_encrypt"`
+}
+
+// AutocryptPeers is the peer state of an account by address, rebuilt by clients from the log
+type AutocryptPeers map[string]*AutocryptPeer
+
+// Update applies an observation following the Autocrypt Level 1 peer state update.
+// Only peers that sent a key are kept.
+func (p AutocryptPeers) Update(o *AutocryptObservation) {
+	addr := strings.ToLower(o.Addr)
+	peer, ok := p[addr]
+	if !ok {
+		if len(o.KeyData) == 0 {
+			return
+		}
+		peer = &AutocryptPeer{Addr: addr}
+		p[addr] = peer
+	}
+	if o.Date.Before(peer.AutocryptTimestamp) {
+		// older than the last header
+		return
+	}
+	if o.Date.After(peer.LastSeen) {
+		peer.LastSeen = o.Date
+	}
+	if len(o.KeyData) == 0 {
+		return
+	}
+	peer.AutocryptTimestamp = o.Date
+	peer.PublicKey = o.KeyData
+	peer.PreferEncrypt = o.PreferEncrypt
+}
+
+// Apply decrypts the records of the log, in order, and updates the peers with them
+func (p AutocryptPeers) Apply(records []SyncAutocrypt, decrypt Decrypter) error {
+	for _, rec := range records {
+		r, err := decrypt(bytes.NewReader(rec.Data))
+		if err != nil {
+			return fmt.Errorf("could not decrypt Autocrypt record %d: %s", rec.Seq, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		o := &AutocryptObservation{}
+		if err := json.Unmarshal(data, o); err != nil {
+			return err
+		}
+		p.Update(o)
+	}
+	return nil
+}
+
+// observeAutocrypt reads the headers at the start of data. It returns false for messages that
+// tell nothing about their sender: without a single From address, or delivery reports.
+func observeAutocrypt(data []byte, now time.Time) (*AutocryptObservation, bool) {
+	if len(data) > maxHeaderSize {
+		data = data[:maxHeaderSize]
+	}
+	header, _, ok := splitHeader(data)
+	if !ok {
+		return nil, false
+	}
+	var from, date, contentType string
+	var autocrypt []string
+	for _, f := range headerFields(header) {
+		switch fieldName(f) {
+		case "from":
+			from = fieldValue(f)
+		case "date":
+			date = fieldValue(f)
+		case "content-type":
+			contentType = fieldValue(f)
+		case "autocrypt":
+			autocrypt = append(autocrypt, fieldValue(f))
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "multipart/report" {
+		return nil, false
+	}
+	addr, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, false
+	}
+	o := &AutocryptObservation{Addr: strings.ToLower(addr.Address), Date: now}
+	if d, err := netmail.ParseDate(date); err == nil && d.Before(now) {
+		o.Date = d
+	}
+	valid := 0
+	for _, v := range autocrypt {
+		keyData, prefer, err := parseAutocrypt(v, o.Addr, now)
+		if err != nil {
+			continue
+		}
+		valid++
+		o.KeyData, o.PreferEncrypt = keyData, prefer
+	}
+	if valid != 1 {
+		// more than one header for the sender is treated as none
+		o.KeyData, o.PreferEncrypt = nil, ""
+	}
+	return o, true
+}
+
+// parseAutocrypt parses the value of an Autocrypt header sent by addr and validates its key
+func parseAutocrypt(v, addr string, now time.Time) (keyData []byte, prefer string, err error) {
+	var headerAddr, encoded string
+	prefer = PreferEncryptNoPreference
+	for _, attr := range strings.Split(v, ";") {
+		kv := strings.SplitN(strings.TrimSpace(attr), "=", 2)
+		if len(kv) != 2 {
+			return nil, "", errAutocryptHeader
+		}
+		switch name := strings.TrimSpace(kv[0]); {
+		case name == "addr":
+			headerAddr = strings.TrimSpace(kv[1])
+		case name == "keydata":
+			encoded = kv[1]
+		case name == "prefer-encrypt":
+			if strings.TrimSpace(kv[1]) == PreferEncryptMutual {
+				prefer = PreferEncryptMutual
+			}
+		case strings.HasPrefix(name, "_"):
+			// non critical attribute
+		default:
+			// unknown critical attribute, the header must be ignored
+			return nil, "", errAutocryptHeader
+		}
+	}
+	if !strings.EqualFold(headerAddr, addr) || encoded == "" {
+		return nil, "", errAutocryptHeader
+	}
+	encoded = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, encoded)
+	if keyData, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return nil, "", err
+	}
+	if len(keyData) > maxAutocryptKeySize {
+		return nil, "", errAutocryptHeader
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(el) != 1 {
+		return nil, "", errAutocryptHeader
+	}
+	if _, ok := el[0].EncryptionKey(now); !ok {
+		return nil, "", errors.New("Autocrypt key can't encrypt")
+	}
+	return keyData, prefer, nil
+}
+
+// SyncAutocrypt is an encrypted record of the Autocrypt log, see AutocryptFileName
+type SyncAutocrypt struct {
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// autocryptLog is the Autocrypt log of an account, records are only appended
+type autocryptLog struct {
+	sync.Mutex
+	path    string
+	lastSeq uint64
+}
+
+// autocryptLogs are the Autocrypt logs opened, by path
+var autocryptLogs registry
+
+// openAutocryptLog returns the Autocrypt log of the Maildir located at dir, the sequence
+// numbers continue from its last record
+func openAutocryptLog(dir string) (*autocryptLog, error) {
+	path := filepath.Join(dir, AutocryptFileName)
+	v, err := autocryptLogs.get(path, func() (interface{}, error) {
+		l := &autocryptLog{path: path}
+		records, err := l.since(0)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			l.lastSeq = records[len(records)-1].Seq
+		}
+		return l, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*autocryptLog), nil
+}
+
+// append adds an encrypted record to the log
+func (l *autocryptLog) append(data []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	line, err := json.Marshal(&SyncAutocrypt{Seq: l.lastSeq + 1, Data: data})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, MailDirFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	l.lastSeq++
+	return nil
+}
+
+// since returns the records added after the seq cursor
+func (l *autocryptLog) since(seq uint64) ([]SyncAutocrypt, error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([]SyncAutocrypt, 0)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*maxAutocryptKeySize)
+	for sc.Scan() {
+		rec := SyncAutocrypt{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// a record cut by a crash
+			continue
+		}
+		if rec.Seq > seq {
+			ret = append(ret, rec)
+		}
+	}
+	return ret, sc.Err()
+}
+
+// harvestAutocrypt records what the message tells about its sender in the Autocrypt log of
+// the recipients it was saved for, encrypted to their current key. Accounts without encryption
+// key are skipped. Errors are logged, they never fail the delivery.
+func (m *MailDir) harvestAutocrypt(e *mail.Envelope, saved []delivery) {
+	o, ok := observeAutocrypt(e.Data.Bytes(), time.Now())
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return
+	}
+	for _, d := range saved {
+		if !m.sealedAccount(d.user) {
+			continue
+		}
+		if err := m.logAutocrypt(d.user, data); err != nil {
+			backends.Log().WithError(err).Error("could not record the Autocrypt state for ", d.user)
+		}
+	}
+}
+
+// logAutocrypt encrypts an observation to the current key of u and appends it to its log
+func (m *MailDir) logAutocrypt(u string, data []byte) error {
+	l, ok := m.autocrypt[u]
+	if !ok {
+		return os.ErrNotExist
+	}
+	k, err := m.currentKey(u)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	w, err := m.encrypt(buf, []AccountKey{k.AccountKey})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return l.append(buf.Bytes())
+}
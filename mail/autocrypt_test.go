@@ -0,0 +1,112 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAutocrypt(t *testing.T) {
+	dir, remove := testDir(t, "autocrypt")
+	defer remove()
+	k := testEnvelopeKey(t)
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:        "test=-1:-1,plain=-1:-1",
+		EncryptionKeys: "test=" + k.Public().String(),
+	})
+
+	entity, _ := testPGPKey(t, dir, "alice")
+	buf := &bytes.Buffer{}
+	if err := entity.Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	keyData := buf.Bytes()
+	// folded as MUAs send it
+	encoded := base64.StdEncoding.EncodeToString(keyData)
+	folded := ""
+	for len(encoded) > 60 {
+		folded += encoded[:60] + "\r\n "
+		encoded = encoded[60:]
+	}
+	folded += encoded
+
+	deliver := func(date time.Time, autocrypt ...string) {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("From: Alice <Alice@example.com>\r\nTo: test@example.com\r\nDate: " + date.Format(time.RFC1123Z) + "\r\n")
+		for _, a := range autocrypt {
+			e.Data.WriteString("Autocrypt: " + a + "\r\n")
+		}
+		e.Data.WriteString("Subject: hello\r\n\r\nbody\r\n")
+		e.RcptTo = []mail.Address{{User: "test"}, {User: "plain"}}
+		saved, err := m.save(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.harvestAutocrypt(e, saved)
+	}
+	now := time.Now().Truncate(time.Second)
+	header := "addr=alice@example.com; prefer-encrypt=mutual; keydata=\r\n " + folded
+	deliver(now.Add(-2*time.Hour), header)
+	// older than the last header, ignored
+	deliver(now.Add(-3*time.Hour), "addr=alice@example.com; keydata="+folded)
+	// no header, only updates last seen
+	deliver(now.Add(-time.Hour))
+	// invalid headers: another address, unknown critical attribute, two headers
+	deliver(now.Add(-30*time.Minute), "addr=bob@example.com; keydata="+folded)
+	deliver(now.Add(-20*time.Minute), "addr=alice@example.com; color=blue; keydata="+folded)
+	deliver(now.Add(-10*time.Minute), header, header)
+	// a delivery report tells nothing about the sender
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("From: alice@example.com\r\nContent-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n--b--\r\n")
+	e.RcptTo = []mail.Address{{User: "test"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.harvestAutocrypt(e, saved)
+
+	records, err := m.autocrypt["test"].since(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	for _, r := range records {
+		if bytes.Contains(r.Data, []byte("alice")) {
+			t.Error("the Autocrypt log is not encrypted")
+		}
+	}
+	if plain, _ := m.autocrypt["plain"].since(0); len(plain) != 0 {
+		t.Errorf("expected no Autocrypt log for an account without key, got %d records", len(plain))
+	}
+
+	peers := AutocryptPeers{}
+	if err := peers.Apply(records, EnvelopeDecrypter(k)); err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := peers["alice@example.com"]
+	if !ok || len(peers) != 1 {
+		t.Fatalf("expected a single peer, got %+v", peers)
+	}
+	if !bytes.Equal(peer.PublicKey, keyData) || peer.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("unexpected key or preference %+v", peer)
+	}
+	if !peer.AutocryptTimestamp.Equal(now.Add(-2*time.Hour)) || !peer.LastSeen.Equal(now.Add(-10*time.Minute)) {
+		t.Errorf("unexpected timestamps %+v", peer)
+	}
+
+	// the log survives a restart and continues its sequence
+	autocryptLogs.forget(m.autocrypt["test"].path)
+	l, err := openAutocryptLog(strings.TrimSuffix(m.autocrypt["test"].path, AutocryptFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.lastSeq != 6 {
+		t.Errorf("expected the sequence to continue after 6, got %d", l.lastSeq)
+	}
+}
@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+	"github.com/pentateu/email-cloud-service/relay"
+)
+
+var errNoBounceQueue = errors.New("outbound_queue_path is not configured, the sender can't be notified")
+
+// deliver saves e for its recipients and indexes it. A Maildir or index that could not be
+// written is transient: the message is refused with 451 and the client sends it again, the
+// accounts that got it skip it then. An account refusing it for good does not stop the others:
+// the message is refused only when no account got it. Otherwise it is accepted, the accounts it
+// could not be saved for are logged and the sender gets a delivery status notification for
+// them, when outbound_queue_path is configured.
+// It returns a nil result when the message is accepted.
+func (m *MailDir) deliver(e *mail.Envelope) (backends.Result, error) {
+	saved, err := m.save(e)
+	// save only fails with deliveryErrors
+	var failed deliveryErrors
+	errors.As(err, &failed)
+	delivered := make([]delivery, 0, len(saved))
+	for _, d := range saved {
+		backends.Log().Debug("saved email as", d.filename)
+		if _, err := m.indexMail(d); errors.Is(err, errNotQueued) {
+			backends.Log().WithError(err).Error("Could not queue email for IPFS")
+		} else if err != nil {
+			// a message the index does not list is never synced, it is not delivered
+			os.Remove(d.filename)
+			failed = append(failed, &deliveryError{user: d.user, err: err})
+			continue
+		}
+		delivered = append(delivered, d)
+	}
+	m.harvestAutocrypt(e, delivered)
+	var transient *deliveryError
+	for _, f := range failed {
+		code, _ := f.status()
+		backends.Log().WithError(f.err).Errorf("could not save email for [%s], %s", f.user, code)
+		if transient == nil && f.temporary() {
+			transient = f
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return nil, nil
+	case transient != nil:
+		return backends.NewResult(fmt.Sprintf("451 Error: could not save email for [%s], try again later", transient.user)), failed
+	case len(delivered) == 0:
+		if errors.Is(failed, errMessageTooBig) {
+			return backends.NewResult(response.Canned.FailMessageSizeExceeded), failed
+		}
+		return backends.NewResult(fmt.Sprintf("554 Error: could not save email for [%s]", failed[0].user)), failed
+	}
+	if err := m.bounce(e, failed); err != nil {
+		backends.Log().WithError(err).Error("Could not send the delivery status notification")
+	}
+	return nil, nil
+}
+
+// bounce sends the sender of e a delivery status notification for the recipients leading to
+// the accounts of failed. Recipients are named with the address the sender used, the accounts
+// behind aliases and lists are not disclosed. Messages with an empty sender are not bounced.
+func (m *MailDir) bounce(e *mail.Envelope, failed deliveryErrors) error {
+	if e.MailFrom.IsEmpty() {
+		return nil
+	}
+	if m.relay == nil {
+		return errNoBounceQueue
+	}
+	byAccount := make(map[string]*deliveryError, len(failed))
+	for _, f := range failed {
+		byAccount[f.user] = f
+	}
+	r := &relay.Report{To: e.MailFrom.String(), Arrival: time.Now()}
+	for i := range e.RcptTo {
+		for _, t := range m.targets(&e.RcptTo[i]) {
+			f, ok := byAccount[t.account]
+			if !ok {
+				continue
+			}
+			code, diagnostic := f.status()
+			r.Recipients = append(r.Recipients, relay.Recipient{
+				Address:    e.RcptTo[i].String(),
+				Status:     relay.StatusFailed,
+				Code:       code,
+				Diagnostic: diagnostic,
+			})
+			break
+		}
+	}
+	if len(r.Recipients) == 0 {
+		return nil
+	}
+	r.Headers, _ = relay.ReadHeaders(bytes.NewReader(e.Data.Bytes()))
+	id, err := m.relay.Bounce(r)
+	if err == nil {
+		backends.Log().Infof("queued delivery status notification %s to %s for %d recipients", id, r.To, len(r.Recipients))
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/pentateu/email-cloud-service/relay"
+)
+
+func TestPartialDelivery(t *testing.T) {
+	dir, remove := testDir(t, "bounce")
+	defer remove()
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:  "test=-1:-1,guerrilla=-1:-1,sealed=-1:-1",
+		AliasMap: "team=sealed",
+	})
+	var err error
+	if m.relay, err = relay.Open(filepath.Join(dir, "outbound")); err != nil {
+		t.Fatal(err)
+	}
+	// the only key of sealed is revoked, its messages are refused for good
+	kr := newKeyring(m.dirs["sealed"].Path)
+	r, err := kr.rotate("age:age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p", "", time.Now().Add(-2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.revoke(r.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// the Maildir of guerrilla can't be written for now
+	broken := filepath.Join(m.dirs["guerrilla"].Path, "tmp")
+	if err := os.RemoveAll(broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(broken, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	newEnvelope := func(from string, rcpt ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("From: " + from + "\r\nSubject: hello\r\n\r\nbody\r\n")
+		if from != "" {
+			e.MailFrom = mail.Address{User: strings.Split(from, "@")[0], Host: strings.Split(from, "@")[1]}
+		}
+		for _, r := range rcpt {
+			e.RcptTo = append(e.RcptTo, mail.Address{User: r, Host: "example.com"})
+		}
+		return e
+	}
+
+	// accepted for test, the sender is told about team
+	if result, err := m.deliver(newEnvelope("alice@remote.test", "test", "team")); result != nil {
+		t.Fatalf("expected the message to be accepted, got %s (%v)", result, err)
+	}
+	if n := len(m.indexes["test"].since(0)); n != 1 {
+		t.Errorf("expected the message to be indexed for test, got %d", n)
+	}
+	messages := m.relay.Messages()
+	if len(messages) != 1 || messages[0].From != "" || messages[0].Recipients[0].Address != "alice@remote.test" {
+		t.Fatalf("expected a bounce to alice, got %+v", messages)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "outbound", messages[0].ID+".eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := string(data)
+	for _, want := range []string{"Final-Recipient: rfc822; team@example.com\r\nAction: failed\r\nStatus: 5.2.1",
+		"Content-Type: text/rfc822-headers\r\n\r\nFrom: alice@remote.test\r\nSubject: hello\r\n"} {
+		if !strings.Contains(dsn, want) {
+			t.Errorf("expected %q in the DSN:\n%s", want, dsn)
+		}
+	}
+	if strings.Contains(dsn, "sealed") || strings.Contains(dsn, "test@example.com") {
+		t.Errorf("DSN discloses the accounts:\n%s", dsn)
+	}
+
+	// a bounce is never bounced
+	if result, _ := m.deliver(newEnvelope("", "test", "team")); result != nil {
+		t.Fatalf("expected the message to be accepted, got %s", result)
+	}
+	// a Maildir that can't be written is transient, the client sends the message again and
+	// test, which already got it, skips it
+	result, err := m.deliver(newEnvelope("alice@remote.test", "test", "guerrilla"))
+	if result == nil || !strings.HasPrefix(result.String(), "451") || err == nil {
+		t.Errorf("expected the message to be refused for now, got %v (%v)", result, err)
+	}
+	// nobody got it, the client tells the sender
+	result, err = m.deliver(newEnvelope("alice@remote.test", "team"))
+	if result == nil || !strings.HasPrefix(result.String(), "554") || err == nil {
+		t.Errorf("expected the message to be refused, got %v (%v)", result, err)
+	}
+	if m.relay.Depth() != 1 {
+		t.Errorf("expected no more bounce, got %d queued messages", m.relay.Depth())
+	}
+	// without outbound queue the sender is not told, refusing the message would make the
+	// client send it again to the accounts that got it
+	m.relay = nil
+	if result, err := m.deliver(newEnvelope("bob@remote.test", "test", "team")); result != nil {
+		t.Errorf("expected the message to be accepted without outbound queue, got %s (%v)", result, err)
+	}
+	if n := len(m.indexes["test"].since(0)); n != 3 {
+		t.Errorf("expected the message to be indexed for test, got %d messages", n)
+	}
+}
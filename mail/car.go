@@ -0,0 +1,324 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs/hamt"
+	uio "github.com/ipfs/go-unixfs/io"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/ipld/go-car"
+)
+
+// carManifestSuffix names the file of a CAR listing the index entries of its mailbox
+const carManifestSuffix = ".json"
+
+// loadMailDir creates a MailDir from the backend_config of the config file at path,
+// for commands that work on the Maildirs without running the SMTP server.
+// No background work (upload queue, acknowledgements) is started.
+func loadMailDir(path string, ipfs iface.CoreAPI) (*MailDir, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	appConfig := struct {
+		BackendConfig backends.BackendConfig `json:"backend_config"`
+	}{}
+	if err := json.Unmarshal(data, &appConfig); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	bcfg, err := backends.Svc.ExtractConfig(appConfig.BackendConfig, &maildirConfig{})
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMailDir(bcfg.(*maildirConfig), nil)
+	if err != nil {
+		return nil, err
+	}
+	m.ipfs = ipfs
+	return m, nil
+}
+
+// carEntry is what a CAR keeps of the index entry of a message, beside the message itself
+type carEntry struct {
+	Name   string `json:"name"`
+	KeyID  string `json:"key_id,omitempty"`
+	Folder string `json:"folder,omitempty"`
+}
+
+// ExportCAR writes the mailbox of account to w as a CARv1 file.
+// The root of the CAR is a unixfs directory with an entry named after the account, a sharded
+// directory holding every message under its Maildir file name, and <account>.json listing
+// the key and the folder of each message.
+func ExportCAR(ctx context.Context, configPath string, ipfs iface.CoreAPI, account string, w io.Writer) (cid.Cid, error) {
+	m, err := loadMailDir(configPath, ipfs)
+	if err != nil {
+		return cid.Undef, err
+	}
+	u := strings.ToLower(account)
+	idx, ok := m.indexes[u]
+	if !ok {
+		return cid.Undef, fmt.Errorf("no such account [%s]", account)
+	}
+	shard, err := hamt.NewShard(ipfs.Dag(), uio.DefaultShardWidth)
+	if err != nil {
+		return cid.Undef, err
+	}
+	entries := make([]carEntry, 0)
+	for _, e := range idx.since(0) {
+		if e.CID == "" {
+			// still in the upload queue, store it now so the export is complete
+			if e.CID, err = m.storeIPFS(ctx, e.Filename); err != nil {
+				return cid.Undef, err
+			}
+			if err := idx.setCID(e.Seq, e.CID); err != nil {
+				return cid.Undef, err
+			}
+		}
+		c, err := cid.Decode(e.CID)
+		if err != nil {
+			return cid.Undef, err
+		}
+		nd, err := ipfs.Dag().Get(ctx, c)
+		if err != nil {
+			return cid.Undef, err
+		}
+		name := filepath.Base(e.Filename)
+		if err := shard.Set(ctx, name, nd); err != nil {
+			return cid.Undef, err
+		}
+		entries = append(entries, carEntry{Name: name, KeyID: e.KeyID, Folder: e.Folder})
+	}
+	mailbox, err := shard.Node()
+	if err != nil {
+		return cid.Undef, err
+	}
+	root := uio.NewDirectory(ipfs.Dag())
+	if err := root.AddChild(ctx, u, mailbox); err != nil {
+		return cid.Undef, err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return cid.Undef, err
+	}
+	p, err := ipfs.Unixfs().Add(ctx, files.NewBytesFile(data))
+	if err != nil {
+		return cid.Undef, err
+	}
+	manifest, err := ipfs.Dag().Get(ctx, p.Cid())
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := root.AddChild(ctx, u+carManifestSuffix, manifest); err != nil {
+		return cid.Undef, err
+	}
+	rootNode, err := root.GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := ipfs.Dag().Add(ctx, rootNode); err != nil {
+		return cid.Undef, err
+	}
+	return rootNode.Cid(), car.WriteCar(ctx, ipfs.Dag(), []cid.Cid{rootNode.Cid()}, w)
+}
+
+// ImportCAR loads a CAR written by ExportCAR into the node and delivers the messages to
+// the Maildir of the account it was exported from, or to account when not empty, in the
+// folder they were exported from. Messages already in the Maildir are skipped. The imported
+// messages are indexed without a CID, the upload queue stores and pins them when the service
+// starts. It returns the number of imported messages.
+func ImportCAR(ctx context.Context, configPath string, ipfs iface.CoreAPI, r io.Reader, account string) (int, error) {
+	m, err := loadMailDir(configPath, ipfs)
+	if err != nil {
+		return 0, err
+	}
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(cr.Header.Roots) != 1 {
+		return 0, fmt.Errorf("expected a single root in the CAR, found %d", len(cr.Header.Roots))
+	}
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		nd, err := ipld.Decode(blk)
+		if err != nil {
+			return 0, err
+		}
+		if err := ipfs.Dag().Add(ctx, nd); err != nil {
+			return 0, err
+		}
+	}
+
+	rootEntries, err := ls(ctx, ipfs, ipath.IpfsPath(cr.Header.Roots[0]))
+	if err != nil {
+		return 0, err
+	}
+	mailboxes := make([]iface.DirEntry, 0, 1)
+	manifests := make(map[string]cid.Cid, 1)
+	for _, e := range rootEntries {
+		if name := strings.TrimSuffix(e.Name, carManifestSuffix); name != e.Name {
+			manifests[name] = e.Cid
+		} else {
+			mailboxes = append(mailboxes, e)
+		}
+	}
+	if len(mailboxes) != 1 {
+		return 0, fmt.Errorf("expected a single mailbox in the CAR, found %d", len(mailboxes))
+	}
+	entries := make(map[string]carEntry)
+	if c, ok := manifests[mailboxes[0].Name]; ok {
+		if entries, err = readCARManifest(ctx, ipfs, c); err != nil {
+			return 0, err
+		}
+	}
+	u := strings.ToLower(mailboxes[0].Name)
+	if account != "" {
+		u = strings.ToLower(account)
+	}
+	if _, ok := m.dirs[u]; !ok {
+		return 0, fmt.Errorf("no such account [%s]", u)
+	}
+	known, err := m.knownCIDs(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := ls(ctx, ipfs, ipath.IpfsPath(mailboxes[0].Cid))
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, msg := range messages {
+		c := msg.Cid.String()
+		if known[c] {
+			continue
+		}
+		entry := entries[msg.Name]
+		if entry.Folder != "" && !folderTag.MatchString(entry.Folder) {
+			return imported, fmt.Errorf("invalid folder %q for %s in the CAR", entry.Folder, msg.Name)
+		}
+		mdir, err := m.mailbox(u, entry.Folder)
+		if err != nil {
+			return imported, err
+		}
+		p := ipath.IpfsPath(msg.Cid)
+		nd, err := ipfs.Unixfs().Get(ctx, p)
+		if err != nil {
+			return imported, err
+		}
+		f, ok := nd.(files.File)
+		if !ok {
+			return imported, fmt.Errorf("%s in the CAR is not a file", msg.Name)
+		}
+		br := bufio.NewReaderSize(f, maxHeaderSize)
+		// short messages fail to fill the buffer, what was read is enough
+		head, _ := br.Peek(maxHeaderSize)
+		encryption, e2e := sniffStored(head)
+		filename, err := mdir.CreateMail(br)
+		f.Close()
+		if err != nil {
+			return imported, err
+		}
+		if filename, err = m.opaqueName(filename); err != nil {
+			return imported, err
+		}
+		// keeps the blocks until the upload queue stores the message
+		if err := ipfs.Pin().Add(ctx, p); err != nil {
+			return imported, err
+		}
+		size, _ := f.Size()
+		e, err := m.newIndexEntry(u, filename, encryption, entry.KeyID, IndexMeta{Date: time.Now(), Size: size, EndToEnd: e2e})
+		if err != nil {
+			return imported, err
+		}
+		e.Folder = entry.Folder
+		if _, err := m.indexes[u].add(e); err != nil {
+			return imported, err
+		}
+		known[c] = true
+		imported++
+	}
+	return imported, nil
+}
+
+// readCARManifest reads the <account>.json file of a CAR, see carEntry
+func readCARManifest(ctx context.Context, ipfs iface.CoreAPI, c cid.Cid) (map[string]carEntry, error) {
+	nd, err := ipfs.Unixfs().Get(ctx, ipath.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	f, ok := nd.(files.File)
+	if !ok {
+		return nil, errors.New("the mailbox index in the CAR is not a file")
+	}
+	defer f.Close()
+	list := make([]carEntry, 0)
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("could not parse the mailbox index in the CAR: %s", err)
+	}
+	entries := make(map[string]carEntry, len(list))
+	for _, e := range list {
+		entries[e.Name] = e
+	}
+	return entries, nil
+}
+
+// knownCIDs returns the CIDs of the messages of u. Messages still waiting for the upload
+// queue are hashed, without being stored, to get the CID they will have.
+func (m *MailDir) knownCIDs(ctx context.Context, u string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, e := range m.indexes[u].since(0) {
+		if e.CID != "" {
+			known[e.CID] = true
+			continue
+		}
+		f, err := os.Open(e.Filename)
+		if err != nil {
+			return nil, err
+		}
+		p, err := m.ipfs.Unixfs().Add(ctx, files.NewReaderFile(f), options.Unixfs.HashOnly(true))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		known[p.Cid().String()] = true
+	}
+	return known, nil
+}
+
+// ls lists the entries of the unixfs directory at p
+func ls(ctx context.Context, ipfs iface.CoreAPI, p ipath.Path) ([]iface.DirEntry, error) {
+	entries, err := ipfs.Unixfs().Ls(ctx, p, options.Unixfs.ResolveChildren(false))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]iface.DirEntry, 0)
+	for e := range entries {
+		if e.Err != nil {
+			return nil, e.Err
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
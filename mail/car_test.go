@@ -0,0 +1,257 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	ufile "github.com/ipfs/go-unixfs/file"
+	uio "github.com/ipfs/go-unixfs/io"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// memIPFS is an in-memory node with what the CAR export and import use,
+// files are stored as a single block
+type memIPFS struct {
+	iface.CoreAPI
+	dag *memDAG
+}
+
+func newMemIPFS() *memIPFS {
+	return &memIPFS{dag: &memDAG{nodes: make(map[cid.Cid]ipld.Node)}}
+}
+
+func (n *memIPFS) Dag() iface.APIDagService { return n.dag }
+func (n *memIPFS) Unixfs() iface.UnixfsAPI  { return memUnixfs{n.dag} }
+func (n *memIPFS) Pin() iface.PinAPI        { return memPin{} }
+
+type memDAG struct {
+	sync.Mutex
+	nodes map[cid.Cid]ipld.Node
+}
+
+func (d *memDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	d.Lock()
+	defer d.Unlock()
+	nd, ok := d.nodes[c]
+	if !ok {
+		return nil, ipld.ErrNotFound
+	}
+	return nd, nil
+}
+
+func (d *memDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := d.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func (d *memDAG) Add(ctx context.Context, nd ipld.Node) error {
+	d.Lock()
+	defer d.Unlock()
+	d.nodes[nd.Cid()] = nd
+	return nil
+}
+
+func (d *memDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		d.Add(ctx, nd)
+	}
+	return nil
+}
+
+func (d *memDAG) Remove(ctx context.Context, c cid.Cid) error {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.nodes, c)
+	return nil
+}
+
+func (d *memDAG) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		d.Remove(ctx, c)
+	}
+	return nil
+}
+
+func (d *memDAG) Pinning() ipld.NodeAdder { return d }
+
+type memUnixfs struct{ dag *memDAG }
+
+func (u memUnixfs) Add(ctx context.Context, f files.Node, opts ...options.UnixfsAddOption) (ipath.Resolved, error) {
+	settings, _, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f.(files.File))
+	if err != nil {
+		return nil, err
+	}
+	nd := merkledag.NodeWithData(unixfs.FilePBData(data, uint64(len(data))))
+	if !settings.OnlyHash {
+		u.dag.Add(ctx, nd)
+	}
+	return ipath.IpfsPath(nd.Cid()), nil
+}
+
+func (u memUnixfs) Get(ctx context.Context, p ipath.Path) (files.Node, error) {
+	nd, err := u.dag.Get(ctx, p.(ipath.Resolved).Cid())
+	if err != nil {
+		return nil, err
+	}
+	return ufile.NewUnixfsFile(ctx, u.dag, nd)
+}
+
+func (u memUnixfs) Ls(ctx context.Context, p ipath.Path, opts ...options.UnixfsLsOption) (<-chan iface.DirEntry, error) {
+	nd, err := u.dag.Get(ctx, p.(ipath.Resolved).Cid())
+	if err != nil {
+		return nil, err
+	}
+	dir, err := uio.NewDirectoryFromNode(u.dag, nd)
+	if err != nil {
+		return nil, err
+	}
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan iface.DirEntry, len(links))
+	for _, l := range links {
+		out <- iface.DirEntry{Name: l.Name, Cid: l.Cid}
+	}
+	close(out)
+	return out, nil
+}
+
+type memPin struct{ iface.PinAPI }
+
+func (memPin) Add(context.Context, ipath.Path, ...options.PinAddOption) error { return nil }
+
+// writeCARConfig writes a config file for the Maildirs under dir
+func writeCARConfig(t *testing.T, dir string) string {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]interface{}{"backend_config": map[string]interface{}{
+		"maildir_path":               dir + "/[user]",
+		"maildir_user_map":           "test=-1:-1",
+		"maildir_subaddress_folders": true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "service.conf")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCARRoundTrip(t *testing.T) {
+	dir, remove := testDir(t, "car")
+	defer remove()
+	srcConfig := writeCARConfig(t, filepath.Join(dir, "src"))
+	src := newMemIPFS()
+	m, err := loadMailDir(srcConfig, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]indexEntry{
+		"Subject: inbox\r\n\r\nhello\r\n":                   {KeyID: "key-1"},
+		"Subject: news\r\n\r\nnews\r\n":                     {KeyID: "key-2", Folder: "news"},
+		"Subject: queued\r\n\r\nnot stored in IPFS yet\r\n": {},
+	}
+	for msg, want := range messages {
+		mdir, err := m.mailbox("test", want.Folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename, err := mdir.CreateMail(strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := m.newIndexEntry("test", filename, "", want.KeyID, IndexMeta{Size: int64(len(msg))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Folder = want.Folder
+		if want.KeyID != "" {
+			if e.CID, err = m.storeIPFS(context.Background(), filename); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := m.indexes["test"].add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	car := &bytes.Buffer{}
+	if _, err := ExportCAR(context.Background(), srcConfig, src, "test", car); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range m.indexes["test"].since(0) {
+		if e.CID == "" {
+			t.Errorf("expected the export to store %s", e.Filename)
+		}
+	}
+
+	dstConfig := writeCARConfig(t, filepath.Join(dir, "dst"))
+	dst := newMemIPFS()
+	n, err := ImportCAR(context.Background(), dstConfig, dst, bytes.NewReader(car.Bytes()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(messages) {
+		t.Fatalf("expected %d messages imported, got %d", len(messages), n)
+	}
+	imported, err := loadMailDir(dstConfig, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := imported.indexes["test"].since(0)
+	if len(entries) != len(messages) {
+		t.Fatalf("expected %d entries, got %d", len(messages), len(entries))
+	}
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(e.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := messages[string(data)]
+		if !ok {
+			t.Errorf("unexpected message %q", data)
+			continue
+		}
+		if e.KeyID != want.KeyID || e.Folder != want.Folder {
+			t.Errorf("expected key %q and folder %q, got %q and %q", want.KeyID, want.Folder, e.KeyID, e.Folder)
+		}
+		if inFolder := strings.Contains(e.Filename, "/.news/"); inFolder != (want.Folder == "news") {
+			t.Errorf("%s not in the folder %q", e.Filename, want.Folder)
+		}
+		if e.CID != "" {
+			t.Errorf("expected the CID to be left to the upload queue, got %s", e.CID)
+		}
+	}
+
+	// the messages waiting for the upload queue are recognized
+	if n, err := ImportCAR(context.Background(), dstConfig, dst, bytes.NewReader(car.Bytes()), ""); err != nil || n != 0 {
+		t.Errorf("expected nothing imported again, got %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared when the account is unknown, so the time taken does not tell it apart
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("cryptomail"), bcrypt.DefaultCost)
+
+var errNoCredentials = errors.New("maildir_credentials_path is not configured")
+
+// credentialStore keeps the bcrypt hashes of the passwords the accounts submit mail with.
+// The passwd command changes it while the service runs, so it is reloaded when the file changes.
+type credentialStore struct {
+	sync.Mutex
+	file jsonFile
+	// Accounts maps the accounts to the bcrypt hash of their password
+	Accounts map[string]string `json:"accounts"`
+}
+
+// credentialStores are the credentials opened, by path
+var credentialStores registry
+
+// openCredentials returns the credentials at path, loaded the first time
+func openCredentials(path string) (*credentialStore, error) {
+	v, err := credentialStores.get(path, func() (interface{}, error) {
+		s := &credentialStore{file: jsonFile{path: path}}
+		s.Lock()
+		defer s.Unlock()
+		return s, s.load()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*credentialStore), nil
+}
+
+// load reads the store again if the file changed, the caller must hold the lock
+func (s *credentialStore) load() error {
+	loaded := &credentialStore{}
+	return s.file.load(loaded, func() error {
+		if loaded.Accounts == nil {
+			loaded.Accounts = make(map[string]string)
+		}
+		s.Accounts = loaded.Accounts
+		return nil
+	})
+}
+
+// save writes the store to disk, the caller must hold the lock
+func (s *credentialStore) save() error {
+	return s.file.save(s)
+}
+
+// verify tells if password is the password of account
+func (s *credentialStore) verify(account, password string) bool {
+	s.Lock()
+	if err := s.load(); err != nil {
+		s.Unlock()
+		return false
+	}
+	hash, ok := s.Accounts[strings.ToLower(account)]
+	s.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// set sets the password of account, an empty password removes it
+func (s *credentialStore) set(account, password string) error {
+	var hash []byte
+	if len(password) > 0 {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return err
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if hash == nil {
+		delete(s.Accounts, account)
+	} else {
+		s.Accounts[account] = string(hash)
+	}
+	return s.save()
+}
+
+// SetPassword sets the password account submits mail with, for the passwd command.
+// An empty password removes it, the account can't submit mail then.
+func SetPassword(configPath, account, password string) error {
+	m, err := loadMailDir(configPath, nil)
+	if err != nil {
+		return err
+	}
+	if m.credentials == nil {
+		return errNoCredentials
+	}
+	account = strings.ToLower(account)
+	if _, ok := m.dirs[account]; !ok {
+		return fmt.Errorf("no such account [%s]", account)
+	}
+	return m.credentials.set(account, password)
+}
@@ -0,0 +1,326 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// maxMessageSize is the largest message saved, the largest max_size of the servers.
+// 0 means no limit.
+var maxMessageSize int64
+
+var errMessageTooBig = errors.New("message exceeds the maximum size")
+
+// delivery is a message saved to the Maildir of a recipient
+type delivery struct {
+	user     string
+	filename string
+	// encryption is the scheme the message was encrypted with, empty for plain messages
+	encryption string
+	// keyID is the account key the message was encrypted to
+	keyID string
+	// endToEnd is the encryption applied by the sender, see endToEnd
+	endToEnd string
+	// folder is the Maildir folder of the subaddress the message was sent to, empty for the inbox
+	folder string
+	// hash identifies the message, see messageHash
+	hash string
+}
+
+// Enhanced status codes of the accounts a message could not be saved for (RFC 3463)
+const (
+	// statusMailbox is a Maildir or an index that could not be written, the message may be
+	// saved when it is sent again
+	statusMailbox = "4.2.0"
+	// statusNoKey is an account without valid encryption key, its messages are not stored in clear
+	statusNoKey = "5.2.1"
+	// statusKeyExpired is an account whose keys expired, or a key history that could not be
+	// read, the message may be saved once a key is valid again
+	statusKeyExpired = "4.2.1"
+	// statusTooBig is a message over maxMessageSize
+	statusTooBig = "5.3.4"
+)
+
+// deliveryError is returned when the message could not be saved for user
+type deliveryError struct {
+	user string
+	err  error
+	// code is the enhanced status code reported to the sender, see status
+	code string
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("could not save email for [%s]: %s", e.user, e.err)
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// status returns the enhanced status code and the diagnostic reported to the sender.
+// The diagnostic does not tell the cause, or the account, more precisely.
+func (e *deliveryError) status() (code, diagnostic string) {
+	switch {
+	case errors.Is(e.err, errMessageTooBig):
+		return statusTooBig, "message exceeds the maximum size of the mailbox"
+	case e.code == statusNoKey:
+		return statusNoKey, "mailbox does not accept messages"
+	case e.code == statusKeyExpired:
+		return statusKeyExpired, "mailbox does not accept messages for now"
+	}
+	return statusMailbox, "could not save the message in the mailbox"
+}
+
+// temporary tells if the message may be saved for the account when it is sent again
+func (e *deliveryError) temporary() bool {
+	code, _ := e.status()
+	return strings.HasPrefix(code, "4.")
+}
+
+// deliveryErrors are the accounts a message could not be saved for, the others got it
+type deliveryErrors []*deliveryError
+
+func (e deliveryErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the first failure
+func (e deliveryErrors) Unwrap() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0]
+}
+
+// err returns e as an error, nil when no account failed
+func (e deliveryErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// recipients returns the accounts the recipients of e are delivered to, once each even when
+// several recipients or aliases lead to them, split between the ones messages are encrypted
+// for and the ones getting the plain message. folders maps them to the folder of their
+// subaddress, the first one listed for an account wins.
+func (m *MailDir) recipients(rcpt []mail.Address) (sealed, plain []string, folders map[string]string) {
+	folders = make(map[string]string, len(rcpt))
+	for i := range rcpt {
+		for _, t := range m.targets(&rcpt[i]) {
+			u := t.account
+			if _, seen := folders[u]; seen {
+				continue
+			}
+			folders[u] = m.folder(t.tag)
+			if m.sealedAccount(u) {
+				sealed = append(sealed, u)
+			} else {
+				plain = append(plain, u)
+			}
+		}
+	}
+	return
+}
+
+// messageHash identifies a message by its sender and its content, so a message sent again by
+// a client that did not get the reply to DATA is recognised. The Received header added by this
+// server changes with every attempt, it is not part of it. When the metadata is protected it
+// is an HMAC keyed with a secret of the KMS: the index does not tell which known messages the
+// account got.
+func (m *MailDir) messageHash(e *mail.Envelope) string {
+	h := sha256.New()
+	if m.hashKey != nil {
+		h = hmac.New(sha256.New, m.hashKey)
+	}
+	h.Write([]byte(e.MailFrom.String()))
+	h.Write([]byte{0})
+	h.Write(e.Data.Bytes())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// undelivered returns the users of list that did not get the message with hash yet
+func (m *MailDir) undelivered(list []string, hash string) []string {
+	ret := make([]string, 0, len(list))
+	for _, u := range list {
+		if idx, ok := m.indexes[u]; ok && idx.delivered(hash) {
+			backends.Log().Infof("message %s already saved for [%s], skipped", hash, u)
+			continue
+		}
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+// save writes e to the Maildirs of its recipients. The recipients with an encryption key get
+// the message encrypted while it is written, the ones using a scheme that can share a ciphertext
+// get a copy of the same ciphertext. The others get the plain message. The message is held in
+// memory once, in e.Data as received: endToEnd and messageHash read it in place and it is
+// streamed from there to all the Maildirs at once, without more copies.
+// Messages already encrypted by the sender are stored as they are, unless maildir_encrypted_policy is wrap.
+// An account that fails does not stop the others: the error is a deliveryErrors listing the
+// accounts the message was not saved for, the deliveries are the ones it was. The accounts
+// that already got the same message, when a client sends it again, are skipped.
+func (m *MailDir) save(e *mail.Envelope) ([]delivery, error) {
+	sealed, plain, folders := m.recipients(e.RcptTo)
+	hash := m.messageHash(e)
+	sealed, plain = m.undelivered(sealed, hash), m.undelivered(plain, hash)
+	e2e := endToEnd(e.Data.Bytes())
+	if e2e != "" && m.config.EncryptedPolicy == policyStore {
+		plain = append(plain, sealed...)
+		sealed = nil
+	}
+	keys, failed := m.currentKeys(sealed)
+	withKey := make([]string, 0, len(sealed))
+	for _, u := range sealed {
+		if _, ok := keys[u]; ok {
+			withKey = append(withKey, u)
+		}
+	}
+	ret := make([]delivery, 0, len(sealed)+len(plain))
+	for _, group := range encryptionGroups(withKey, keys) {
+		scheme := keys[group[0]].Scheme()
+		groupKeys := make([]AccountKey, len(group))
+		for i, u := range group {
+			groupKeys[i] = keys[u].AccountKey
+		}
+		d, errs := m.writeMail(group, folders, func(w io.Writer) error {
+			ew, err := m.encrypt(w, groupKeys)
+			if err != nil {
+				return err
+			}
+			if err := copyMessage(ew, e); err != nil {
+				return err
+			}
+			return ew.Close()
+		})
+		for i := range d {
+			d[i].encryption, d[i].keyID, d[i].endToEnd, d[i].hash = scheme, keys[d[i].user].id, e2e, hash
+		}
+		ret = append(ret, d...)
+		failed = append(failed, errs...)
+	}
+	if len(plain) > 0 {
+		d, errs := m.writeMail(plain, folders, func(w io.Writer) error {
+			return copyMessage(w, e)
+		})
+		for i := range d {
+			d[i].endToEnd, d[i].hash = e2e, hash
+		}
+		ret = append(ret, d...)
+		failed = append(failed, errs...)
+	}
+	return ret, failed.err()
+}
+
+// writeMail creates a message in the Maildir of each of users, or their folder, with what
+// write writes. The Maildirs are written concurrently from a single stream: a Maildir that
+// fails discards its copy and drops out of the stream, the others carry on. If write fails
+// they all discard their copy.
+func (m *MailDir) writeMail(users []string, folders map[string]string, write func(io.Writer) error) ([]delivery, deliveryErrors) {
+	writers := make([]io.Writer, len(users))
+	pipes := make([]*io.PipeWriter, len(users))
+	filenames := make([]string, len(users))
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	wg.Add(len(users))
+	for i, u := range users {
+		pr, pw := io.Pipe()
+		writers[i], pipes[i] = pw, pw
+		go func(i int, u string) {
+			defer wg.Done()
+			mdir, err := m.mailbox(u, folders[u])
+			if err == nil {
+				filenames[i], err = mdir.CreateMail(pr)
+			}
+			if errs[i] = err; err == nil {
+				filenames[i], errs[i] = m.opaqueName(filenames[i])
+			} else {
+				// unblock the writer
+				pr.CloseWithError(errs[i])
+			}
+		}(i, u)
+	}
+	err := write(&fanOut{writers: writers})
+	for _, pw := range pipes {
+		// a nil err closes the pipe with io.EOF
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+
+	ret := make([]delivery, 0, len(users))
+	var failed deliveryErrors
+	for i, u := range users {
+		if errs[i] != nil {
+			failed = append(failed, &deliveryError{user: u, err: errs[i]})
+			continue
+		}
+		ret = append(ret, delivery{user: u, filename: filenames[i], folder: folders[u]})
+	}
+	return ret, failed
+}
+
+// fanOut writes to all its writers, dropping the ones that fail. It only fails once they all
+// failed, with the last error.
+type fanOut struct {
+	writers []io.Writer
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	var err error
+	live := f.writers[:0]
+	for _, w := range f.writers {
+		if _, werr := w.Write(p); werr != nil {
+			err = werr
+			continue
+		}
+		live = append(live, w)
+	}
+	f.writers = live
+	if len(live) == 0 {
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// copyMessage copies the message of e to w, failing with errMessageTooBig past maxMessageSize
+func copyMessage(w io.Writer, e *mail.Envelope) error {
+	r := e.NewReader()
+	if maxMessageSize > 0 {
+		r = &sizeLimitReader{r: r, left: maxMessageSize + int64(len(e.DeliveryHeader))}
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// sizeLimitReader reads from r until left bytes are read, then fails with errMessageTooBig.
+// Unlike io.LimitReader it does not truncate the message silently.
+type sizeLimitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return 0, errMessageTooBig
+	}
+	return n, err
+}
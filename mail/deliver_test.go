@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const largeMessageSize = 50 << 20
+
+func newSealingMailDir(tb testing.TB) (*MailDir, func()) {
+	dir, remove := testDir(tb, "deliver")
+	k := testEnvelopeKey(tb)
+	m := testMailDir(tb, dir, &maildirConfig{
+		UserMap:        "test=-1:-1,guerrilla=-1:-1",
+		EncryptionKeys: "test=" + k.Public().String() + ",guerrilla=" + k.Public().String(),
+	})
+	return m, remove
+}
+
+func largeEnvelope(size int) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.Grow(size)
+	line := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ\r\n")
+	for e.Data.Len() < size {
+		e.Data.Write(line)
+	}
+	e.RcptTo = []mail.Address{{User: "test"}, {User: "guerrilla"}}
+	return e
+}
+
+// TestSaveLargeMessageNoCopy checks a 50MB message is encrypted and written to two Maildirs
+// without allocating more copies of it, e.Data already holds the whole message
+func TestSaveLargeMessageNoCopy(t *testing.T) {
+	m, cleanup := newSealingMailDir(t)
+	defer cleanup()
+	e := largeEnvelope(largeMessageSize)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	saved, err := m.save(e)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 deliveries, got %+v", saved)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Errorf("saving a %dMB message allocated %d bytes", largeMessageSize>>20, alloc)
+	}
+	for _, d := range saved {
+		fi, err := os.Stat(d.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() <= largeMessageSize {
+			t.Errorf("%s is smaller than the message, %d bytes", d.filename, fi.Size())
+		}
+	}
+}
+
+func TestSaveMaxSize(t *testing.T) {
+	m, cleanup := newSealingMailDir(t)
+	defer cleanup()
+	maxMessageSize = 1 << 20
+	defer func() { maxMessageSize = 0 }()
+
+	saved, err := m.save(largeEnvelope(2 << 20))
+	if !errors.Is(err, errMessageTooBig) {
+		t.Fatal("expected errMessageTooBig, got", err)
+	}
+	if len(saved) != 0 {
+		t.Fatalf("expected no deliveries, got %+v", saved)
+	}
+	for _, u := range []string{"test", "guerrilla"} {
+		for _, sub := range []string{"tmp", "new"} {
+			files, err := ioutil.ReadDir(m.dirs[u].Path + "/" + sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 0 {
+				t.Errorf("partial message left in %s/%s", u, sub)
+			}
+		}
+	}
+
+	if _, err := m.save(largeEnvelope(512 << 10)); err != nil {
+		t.Fatal("message under max_size rejected:", err)
+	}
+}
+
+// TestSaveSentAgain checks a message sent again, eg. by a client that did not get the reply to
+// DATA, is not stored twice for the accounts that already got it
+func TestSaveSentAgain(t *testing.T) {
+	m, cleanup := newSealingMailDir(t)
+	defer cleanup()
+	newEnvelope := func(body string, rcpt ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "alice", Host: "remote.test"}
+		e.Data.WriteString("Message-ID: <1@remote.test>\r\nSubject: hello\r\n\r\n" + body + "\r\n")
+		for _, u := range rcpt {
+			e.RcptTo = append(e.RcptTo, mail.Address{User: u})
+		}
+		return e
+	}
+	count := func(u string) int {
+		return len(m.indexes[u].since(0))
+	}
+
+	if result, err := m.deliver(newEnvelope("body", "test")); result != nil {
+		t.Fatal(result, err)
+	}
+	// sent again, with a new recipient
+	e := newEnvelope("body", "test", "guerrilla")
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].user != "guerrilla" {
+		t.Fatalf("expected the message to be saved for guerrilla only, got %+v", saved)
+	}
+	if _, err := m.indexMail(saved[0]); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := m.deliver(e); result != nil {
+		t.Fatal(result, err)
+	}
+	if count("test") != 1 || count("guerrilla") != 1 {
+		t.Errorf("expected a single copy each, got %d and %d", count("test"), count("guerrilla"))
+	}
+	if result, err := m.deliver(newEnvelope("another body", "test")); result != nil {
+		t.Fatal(result, err)
+	}
+	if count("test") != 2 {
+		t.Errorf("expected another message to be saved, got %d", count("test"))
+	}
+
+	// the hashes are kept with the index, only the last ones
+	idx := m.indexes["test"]
+	first := idx.Recent[0]
+	for i := 0; i < recentMessages; i++ {
+		if _, err := idx.add(indexEntry{hash: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(idx.Recent) != recentMessages || idx.delivered(first) || !idx.delivered("0") {
+		t.Errorf("unexpected recent messages, %d kept", len(idx.Recent))
+	}
+	data, err := ioutil.ReadFile(idx.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"recent":["0",`) {
+		t.Error("recent messages not saved")
+	}
+}
+
+// BenchmarkSave50MB reports the memory allocated to encrypt and save a 50MB message
+// to two Maildirs, it stays around the size of a couple of encryption chunks.
+func BenchmarkSave50MB(b *testing.B) {
+	m, cleanup := newSealingMailDir(b)
+	defer cleanup()
+	e := largeEnvelope(largeMessageSize)
+	b.SetBytes(largeMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		saved, err := m.save(e)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		for _, d := range saved {
+			os.Remove(d.filename)
+		}
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,223 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+// End-to-end encryption applied by the sender, recorded in the index
+const (
+	E2EPGPMIME   = "pgp-mime"
+	E2EPGPInline = "pgp-inline"
+	E2ESMIME     = "smime"
+)
+
+// Policies for messages already encrypted by the sender, maildir_encrypted_policy
+const (
+	// policyStore stores them as they are
+	policyStore = "store"
+	// policyWrap encrypts them to the account key like the other messages,
+	// so their headers are not kept in clear
+	policyWrap = "wrap"
+)
+
+// checkEncryptedPolicy validates maildir_encrypted_policy and sets its default:
+// wrap when the metadata is protected, store otherwise
+func (m *MailDir) checkEncryptedPolicy() error {
+	switch m.config.EncryptedPolicy {
+	case "":
+		m.config.EncryptedPolicy = policyStore
+		if m.config.ProtectMetadata {
+			m.config.EncryptedPolicy = policyWrap
+		}
+	case policyWrap:
+	case policyStore:
+		if m.config.ProtectMetadata {
+			return fmt.Errorf("maildir_encrypted_policy %q keeps headers in clear, it can't be used with maildir_protect_metadata", policyStore)
+		}
+	default:
+		return fmt.Errorf("invalid maildir_encrypted_policy %q, use %q or %q", m.config.EncryptedPolicy, policyStore, policyWrap)
+	}
+	return nil
+}
+
+// endToEnd detects a message already encrypted by the sender: PGP/MIME (RFC 3156),
+// S/MIME enveloped data (RFC 8551) or an inline PGP message. The Content-Type is not enough,
+// the body must hold the encrypted data it announces. It returns an empty string for other
+// messages, which are encrypted to the account key like any other.
+func endToEnd(data []byte) string {
+	return detectEndToEnd(data, true)
+}
+
+// detectEndToEnd is endToEnd for data that is the whole message when complete is set, or
+// only its start. What follows the start can't be checked then.
+func detectEndToEnd(data []byte, complete bool) string {
+	head := data
+	if len(head) > maxHeaderSize {
+		head = head[:maxHeaderSize]
+	}
+	header, size, ok := splitHeader(head)
+	if !ok {
+		return ""
+	}
+	contentType, encoding := "", ""
+	for _, f := range headerFields(header) {
+		switch fieldName(f) {
+		case "content-type":
+			contentType = fieldValue(f)
+		case "content-transfer-encoding":
+			encoding = strings.ToLower(fieldValue(f))
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if contentType != "" && err != nil {
+		return ""
+	}
+	body := data[size:]
+	switch mediaType {
+	case "multipart/encrypted":
+		if strings.ToLower(params["protocol"]) == "application/pgp-encrypted" && pgpMIMEEncrypted(body, params["boundary"], complete) {
+			return E2EPGPMIME
+		}
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		smime := false
+		switch strings.ToLower(params["smime-type"]) {
+		case "enveloped-data", "authenveloped-data":
+			smime = true
+		case "":
+			// older clients only name the file
+			smime = strings.ToLower(filepath.Ext(params["name"])) == ".p7m"
+		}
+		if smime && cmsEnveloped(body, encoding) {
+			return E2ESMIME
+		}
+	case "", "text/plain":
+		if pgpEncrypted(body) {
+			return E2EPGPInline
+		}
+	}
+	return ""
+}
+
+// pgpMIMEEncrypted checks body is the two parts of a PGP/MIME message: the version and
+// an OpenPGP encrypted message
+func pgpMIMEEncrypted(body []byte, boundary string, complete bool) bool {
+	if boundary == "" {
+		return false
+	}
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	control, err := r.NextPart()
+	if err != nil || !isMediaType(control.Header.Get("Content-Type"), "application/pgp-encrypted") {
+		return false
+	}
+	encrypted, err := r.NextPart()
+	if err != nil || !isMediaType(encrypted.Header.Get("Content-Type"), "application/octet-stream") {
+		return false
+	}
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(encrypted, head)
+	if !pgpEncrypted(head[:n]) {
+		return false
+	}
+	if !complete {
+		return true
+	}
+	// no other part, eg. in clear, may follow
+	_, err = r.NextPart()
+	return err == io.EOF
+}
+
+// isMediaType tells if the Content-Type value contentType is of mediaType
+func isMediaType(contentType, mediaType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && t == mediaType
+}
+
+// pgpEncrypted checks data starts with an armored OpenPGP message whose first packet is
+// a public-key or symmetric-key encrypted session key (RFC 4880 5.1 and 5.3)
+func pgpEncrypted(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if !bytes.HasPrefix(data, []byte("-----BEGIN PGP MESSAGE-----")) {
+		return false
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil || block.Type != "PGP MESSAGE" {
+		return false
+	}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(block.Body, first); err != nil || first[0]&0x80 == 0 {
+		return false
+	}
+	tag := first[0] & 0x3f
+	if first[0]&0x40 == 0 {
+		// old format packet
+		tag = (first[0] & 0x3c) >> 2
+	}
+	return tag == 1 || tag == 3
+}
+
+// Content types of CMS enveloped messages (RFC 5652 6.1 and RFC 5083)
+var (
+	oidEnvelopedData     = []byte{0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x03}
+	oidAuthEnvelopedData = []byte{0x06, 0x0b, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x09, 0x10, 0x01, 0x17}
+)
+
+// cmsEnveloped checks body, with its Content-Transfer-Encoding, starts with a CMS
+// ContentInfo of enveloped or authenticated-enveloped data, in DER or BER
+func cmsEnveloped(body []byte, encoding string) bool {
+	der := body
+	if encoding == "" || encoding == "base64" {
+		// the content type is at the start, decode only that much
+		b64 := make([]byte, 0, 64)
+		for _, c := range body {
+			if len(b64) == cap(b64) {
+				break
+			}
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				b64 = append(b64, c)
+			}
+		}
+		der = make([]byte, base64.StdEncoding.DecodedLen(len(b64)))
+		n, err := base64.StdEncoding.Decode(der, b64[:len(b64)/4*4])
+		if err != nil {
+			return false
+		}
+		der = der[:n]
+	}
+	// ContentInfo is a SEQUENCE starting with the content type OID
+	if len(der) < 2 || der[0] != 0x30 {
+		return false
+	}
+	i := 2
+	if der[1] > 0x80 {
+		// long form length
+		i += int(der[1] & 0x7f)
+	}
+	if i > len(der) {
+		return false
+	}
+	return bytes.HasPrefix(der[i:], oidEnvelopedData) || bytes.HasPrefix(der[i:], oidAuthEnvelopedData)
+}
+
+// sniffStored detects the encryption of a stored message from its start, for messages
+// delivered without going through save, eg. imported from a backup
+func sniffStored(head []byte) (encryption, e2e string) {
+	switch {
+	case envelope.IsEnvelope(head):
+		return SchemeEnvelope, ""
+	case bytes.HasPrefix(head, []byte("age-encryption.org/")):
+		return SchemeAge, ""
+	case bytes.HasPrefix(head, []byte(tinkMagic)):
+		return SchemeTink, ""
+	}
+	return "", detectEndToEnd(head, false)
+}
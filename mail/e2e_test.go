@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+const pgpMIMEMessage = "From: alice@example.com\r\n" +
+	"To: test@example.com\r\n" +
+	"Subject: hello\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/encrypted;\r\n" +
+	" protocol=\"application/pgp-encrypted\"; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pgp-encrypted\r\n" +
+	"\r\n" +
+	"Version: 1\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"\r\n" +
+	"-----BEGIN PGP MESSAGE-----\r\n" +
+	"\r\n" +
+	"hF4D\r\n" +
+	"-----END PGP MESSAGE-----\r\n" +
+	"--b--\r\n"
+
+func TestEndToEnd(t *testing.T) {
+	cases := []struct {
+		msg string
+		e2e string
+	}{
+		{pgpMIMEMessage, E2EPGPMIME},
+		{"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\nMIAGCSqGSIb3DQEHA6CAMIA=\r\n", E2ESMIME},
+		{"Content-Type: application/x-pkcs7-mime; name=\"smime.p7m\"\r\n\r\nMIIBAAYLKoZIhvcNAQkQAReg\r\n", E2ESMIME},
+		{"Subject: a\n\n\n-----BEGIN PGP MESSAGE-----\n\nhF4D\n-----END PGP MESSAGE-----\n", E2EPGPInline},
+		// signed but not encrypted
+		{"Content-Type: application/pkcs7-mime; smime-type=signed-data\r\n\r\nMIAGCSqGSIb3DQEHAqCA\r\n", ""},
+		{"Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; boundary=b\r\n\r\n--b--\r\n", ""},
+		{"Content-Type: text/html\r\n\r\n-----BEGIN PGP MESSAGE-----\r\n", ""},
+		{"Subject: a\r\n\r\nbody\r\n", ""},
+		// the headers announce encrypted data the body does not have
+		{strings.Replace(pgpMIMEMessage, "hF4D", "ywAA", 1), ""},
+		{strings.Replace(pgpMIMEMessage, "--b--\r\n", "--b\r\nContent-Type: text/plain\r\n\r\nin clear\r\n--b--\r\n", 1), ""},
+		{pgpMIMEMessage[:strings.Index(pgpMIMEMessage, "--b\r\n")] + "--b\r\nContent-Type: text/plain\r\n\r\nin clear\r\n--b--\r\n", ""},
+		{"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n\r\nin clear\r\n", ""},
+		{"Content-Type: application/pkcs7-mime; name=smime.p7m\r\n\r\nMIAGCSqGSIb3DQEHAqCA\r\n", ""},
+		{"Subject: a\r\n\r\n-----BEGIN PGP MESSAGE-----\r\n\r\nin clear\r\n", ""},
+	}
+	for _, c := range cases {
+		if e2e := endToEnd([]byte(c.msg)); e2e != c.e2e {
+			t.Errorf("endToEnd(%q) = %q, expected %q", c.msg, e2e, c.e2e)
+		}
+	}
+	// the start of a stored message is enough
+	head := pgpMIMEMessage[:strings.Index(pgpMIMEMessage, "-----END")]
+	if _, e2e := sniffStored([]byte(head)); e2e != E2EPGPMIME {
+		t.Errorf("sniffStored(%q) = %q, expected %q", head, e2e, E2EPGPMIME)
+	}
+}
+
+// TestSaveEndToEnd saves a PGP/MIME message with each maildir_encrypted_policy
+func TestSaveEndToEnd(t *testing.T) {
+	dir, remove := testDir(t, "e2e")
+	defer remove()
+	k := testEnvelopeKey(t)
+
+	for _, policy := range []string{policyStore, policyWrap} {
+		m := testMailDir(t, dir, &maildirConfig{
+			Path:            dir + "/" + policy + "/[user]",
+			UserMap:         "test=-1:-1,plain=-1:-1",
+			EncryptionKeys:  "test=" + k.Public().String(),
+			EncryptedPolicy: policy,
+		})
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(pgpMIMEMessage)
+		e.RcptTo = []mail.Address{{User: "test"}, {User: "plain"}}
+		saved, err := m.save(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved) != 2 {
+			t.Fatalf("expected 2 deliveries, got %+v", saved)
+		}
+		for _, d := range saved {
+			entry, err := m.indexMail(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.EndToEnd != E2EPGPMIME {
+				t.Errorf("[%s] %s: expected %s in the index, got %+v", policy, d.user, E2EPGPMIME, entry)
+			}
+			stored, err := ioutil.ReadFile(d.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrapped := policy == policyWrap && d.user == "test"
+			if wrapped {
+				if entry.Encryption != SchemeEnvelope || !envelope.IsEnvelope(stored) {
+					t.Errorf("[%s] %s: expected an envelope, got %+v", policy, d.user, entry)
+				}
+				continue
+			}
+			if entry.Encryption != "" {
+				t.Errorf("[%s] %s: expected no service encryption, got %+v", policy, d.user, entry)
+			}
+			if !bytes.Equal(stored, []byte(pgpMIMEMessage)) {
+				t.Errorf("[%s] %s: expected the message as received, got %q", policy, d.user, stored)
+			}
+		}
+	}
+
+	// a forged Content-Type does not keep a message in clear
+	m := testMailDir(t, dir, &maildirConfig{
+		Path:            dir + "/forged/[user]",
+		UserMap:         "test=-1:-1",
+		EncryptionKeys:  "test=" + k.Public().String(),
+		EncryptedPolicy: policyStore,
+	})
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nin clear\r\n--b--\r\n")
+	e.RcptTo = []mail.Address{{User: "test"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := ioutil.ReadFile(saved[0].filename); err != nil || !envelope.IsEnvelope(stored) || saved[0].endToEnd != "" {
+		t.Errorf("expected the forged message to be wrapped, got %+v (%v)", saved[0], err)
+	}
+
+	if _, err := newMailDir(&maildirConfig{
+		Path:            dir + "/[user]",
+		UserMap:         "test=-1:-1",
+		EncryptionKeys:  "test=" + k.Public().String(),
+		ProtectMetadata: true,
+		EncryptedPolicy: policyStore,
+	}, nil); err == nil {
+		t.Error("expected an error storing encrypted messages as they are with protected metadata")
+	}
+}
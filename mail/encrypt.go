@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+// parseAccountKey parses a key of maildir_encryption_keys or maildir_escrow_keys:
+// <scheme>:<key>, or an envelope key without prefix
+func parseAccountKey(s string) (AccountKey, error) {
+	s = strings.TrimSpace(s)
+	if p := strings.SplitN(s, ":", 2); len(p) == 2 {
+		if enc, ok := encryptions[p[0]]; ok {
+			return enc.ParseKey(p[1])
+		}
+	}
+	return encryptions[SchemeEnvelope].ParseKey(s)
+}
+
+// keySpecs splits the encryption keys config string in the key of each account
+// Example: "test=<base64 X25519 public key>,guerrilla=age:age1...,flashmob=tink:/etc/cryptomail/flashmob.json"
+func keySpecs(keys string) (ret map[string]string, err error) {
+	ret = make(map[string]string, 0)
+	if len(keys) == 0 {
+		return
+	}
+	records := strings.Split(keys, ",")
+	for i := range records {
+		// base64 keys may end with =, split on the first one only
+		r := strings.SplitN(records[i], "=", 2)
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid encryption key record %q", records[i])
+		}
+		ret[strings.ToLower(strings.TrimSpace(r[0]))] = strings.TrimSpace(r[1])
+	}
+	return
+}
+
+// encryptionKeys parses the encryption keys config string and returns the result in a map
+func encryptionKeys(keys string) (ret map[string]AccountKey, err error) {
+	specs, err := keySpecs(keys)
+	if err != nil {
+		return nil, err
+	}
+	ret = make(map[string]AccountKey, len(specs))
+	for u, s := range specs {
+		k, err := parseAccountKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key for [%s]: %s", u, err)
+		}
+		ret[u] = k
+	}
+	return
+}
+
+// escrowKeys parses the escrow keys config string, keys separated by ",".
+// An escrow key is added to the messages of the accounts using the same scheme.
+func escrowKeys(keys string) (ret []AccountKey, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, s := range strings.Split(keys, ",") {
+		k, err := parseAccountKey(s)
+		if err != nil {
+			return nil, err
+		}
+		if !encryptions[k.Scheme()].Shared() {
+			return nil, fmt.Errorf("%s keys can't be used as escrow keys", k.Scheme())
+		}
+		if ek, ok := k.(envelopeKey); ok {
+			ek.Kind = envelope.KindEscrow
+			k = ek
+		}
+		ret = append(ret, k)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+func TestSealOnceForAllRecipients(t *testing.T) {
+	dir, remove := testDir(t, "seal")
+	defer remove()
+
+	keys := make([]*envelope.PrivateKey, 3)
+	for i := range keys {
+		keys[i] = testEnvelopeKey(t)
+	}
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:        "test=-1:-1,guerrilla=-1:-1,flashmob=-1:-1",
+		EncryptionKeys: "test=" + keys[0].Public().String() + ",guerrilla=" + keys[1].Public().String(),
+		EscrowKeys:     keys[2].Public().String(),
+	})
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hi\r\n\r\nbody\r\n")
+	e.RcptTo = []mail.Address{{User: "test"}, {User: "Guerrilla"}, {User: "flashmob"}, {User: "test"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 3 {
+		t.Fatalf("expected 3 deliveries, got %+v", saved)
+	}
+	files := make(map[string][]byte, len(saved))
+	for _, d := range saved {
+		if files[d.user], err = ioutil.ReadFile(d.filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(files["flashmob"]) != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Fatalf("flashmob has no key, expected the plain message, got %q", files["flashmob"])
+	}
+	// encrypted once, the same ciphertext is stored for both accounts
+	sealed := files["test"]
+	if !bytes.Equal(sealed, files["guerrilla"]) {
+		t.Fatal("expected the same ciphertext for test and guerrilla")
+	}
+	h, err := envelope.ReadHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// test and guerrilla once each plus the escrow key
+	if len(h.Stanzas) != 3 || h.Stanzas[2].Kind != envelope.KindEscrow {
+		t.Fatalf("expected 2 recipient and 1 escrow stanzas, got %+v", h.Stanzas)
+	}
+	for i, k := range keys {
+		r, err := envelope.NewReader(bytes.NewReader(sealed), k)
+		if err != nil {
+			t.Fatalf("key %d: %s", i, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("key %d: %s", i, err)
+		}
+		if string(got) != "Subject: hi\r\n\r\nbody\r\n" {
+			t.Fatalf("key %d: unexpected plaintext %q", i, got)
+		}
+	}
+}
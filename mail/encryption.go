@@ -0,0 +1,181 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+// Encryption is a scheme messages are encrypted with. The scheme of an account is set by
+// the prefix of its key in maildir_encryption_keys, eg. "test=age:age1..."
+type Encryption interface {
+	// ParseKey parses a key of the scheme, as found in the config after the prefix
+	ParseKey(s string) (AccountKey, error)
+	// Encrypt returns a writer encrypting the message written to it for keys, all of this
+	// scheme, and writing the ciphertext to w. Close must be called to end the message.
+	Encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error)
+	// Shared reports if a single ciphertext can be encrypted for several keys.
+	// Messages to accounts of a scheme that can't are encrypted for each account.
+	Shared() bool
+}
+
+// AccountKey is the public key messages to an account are encrypted to
+type AccountKey interface {
+	Scheme() string
+}
+
+// Decrypter decrypts a message encrypted to one of the account keys, for clients and tests.
+// See EnvelopeDecrypter, AgeDecrypter, TinkDecrypter and PGPDecrypter.
+type Decrypter func(r io.Reader) (io.Reader, error)
+
+const (
+	SchemeEnvelope = "envelope"
+	SchemeAge      = "age"
+	SchemeTink     = "tink"
+	SchemePGP      = "pgp"
+)
+
+// encryptions are the available schemes, envelope is used for keys without a prefix
+var encryptions = map[string]Encryption{
+	SchemeEnvelope: envelopeEncryption{},
+	SchemeAge:      ageEncryption{},
+	SchemeTink:     tinkEncryption{},
+	SchemePGP:      pgpEncryption{},
+}
+
+var errKeyScheme = errors.New("key of another encryption scheme")
+
+// envelopeKey is a key of the envelope package format
+type envelopeKey struct {
+	envelope.Recipient
+}
+
+func (envelopeKey) Scheme() string {
+	return SchemeEnvelope
+}
+
+// envelopeEncryption encrypts with the envelope package format
+type envelopeEncryption struct{}
+
+func (envelopeEncryption) ParseKey(s string) (AccountKey, error) {
+	k, err := envelope.ParsePublicKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return envelopeKey{envelope.Recipient{Key: k, Kind: envelope.KindRecipient}}, nil
+}
+
+func (envelopeEncryption) Encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error) {
+	recipients := make([]envelope.Recipient, len(keys))
+	for i := range keys {
+		k, ok := keys[i].(envelopeKey)
+		if !ok {
+			return nil, errKeyScheme
+		}
+		recipients[i] = k.Recipient
+	}
+	return envelope.NewWriter(w, recipients)
+}
+
+func (envelopeEncryption) Shared() bool {
+	return true
+}
+
+// EnvelopeDecrypter decrypts messages of the envelope scheme with key
+func EnvelopeDecrypter(key *envelope.PrivateKey) Decrypter {
+	return func(r io.Reader) (io.Reader, error) {
+		return envelope.NewReader(r, key)
+	}
+}
+
+// ageKey is an age X25519 recipient, age1...
+type ageKey struct {
+	*age.X25519Recipient
+}
+
+func (ageKey) Scheme() string {
+	return SchemeAge
+}
+
+// ageEncryption encrypts with age (https://age-encryption.org/v1)
+type ageEncryption struct{}
+
+func (ageEncryption) ParseKey(s string) (AccountKey, error) {
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, err
+	}
+	return ageKey{r}, nil
+}
+
+func (ageEncryption) Encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error) {
+	recipients := make([]age.Recipient, len(keys))
+	for i := range keys {
+		k, ok := keys[i].(ageKey)
+		if !ok {
+			return nil, errKeyScheme
+		}
+		recipients[i] = k.X25519Recipient
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+func (ageEncryption) Shared() bool {
+	return true
+}
+
+// AgeDecrypter decrypts messages of the age scheme with identity
+func AgeDecrypter(identity age.Identity) Decrypter {
+	return func(r io.Reader) (io.Reader, error) {
+		return age.Decrypt(r, identity)
+	}
+}
+
+// encrypt returns a writer encrypting a message for keys, which all use the same scheme,
+// and the escrow keys of the scheme
+func (m *MailDir) encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no recipients to encrypt to")
+	}
+	scheme := keys[0].Scheme()
+	enc := encryptions[scheme]
+	all := make([]AccountKey, 0, len(keys)+len(m.escrowKeys))
+	for _, k := range keys {
+		if k.Scheme() != scheme {
+			return nil, fmt.Errorf("can't encrypt to %s and %s keys at once", scheme, k.Scheme())
+		}
+		all = append(all, k)
+	}
+	if enc.Shared() {
+		for _, k := range m.escrowKeys {
+			if k.Scheme() == scheme {
+				all = append(all, k)
+			}
+		}
+	}
+	return enc.Encrypt(w, all)
+}
+
+// encryptionGroups splits users in groups encrypted at once with their keys: the users of
+// a scheme sharing the ciphertext are grouped, the others are on their own
+func encryptionGroups(users []string, keys map[string]currentKey) [][]string {
+	groups := make([][]string, 0, len(users))
+	shared := make(map[string]int)
+	for _, u := range users {
+		scheme := keys[u].Scheme()
+		if !encryptions[scheme].Shared() {
+			groups = append(groups, []string{u})
+			continue
+		}
+		if i, ok := shared[scheme]; ok {
+			groups[i] = append(groups[i], u)
+			continue
+		}
+		shared[scheme] = len(groups)
+		groups = append(groups, []string{u})
+	}
+	return groups
+}
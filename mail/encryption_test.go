@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+// TestEncryptionSchemes delivers a message to accounts using the envelope, age and tink schemes
+// and decrypts each copy with the account key
+func TestEncryptionSchemes(t *testing.T) {
+	dir, remove := testDir(t, "schemes")
+	defer remove()
+
+	envKey := testEnvelopeKey(t)
+	var err error
+	ageIDs := make([]*age.X25519Identity, 3)
+	for i := range ageIDs {
+		if ageIDs[i], err = age.GenerateX25519Identity(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tinkKeys := make([]*keyset.Handle, 2)
+	tinkPaths := make([]string, 2)
+	for i := range tinkKeys {
+		if tinkKeys[i], err = keyset.NewHandle(hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_CHACHA20_POLY1305_Key_Template()); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := tinkKeys[i].Public()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := pub.WriteWithNoSecrets(keyset.NewJSONWriter(buf)); err != nil {
+			t.Fatal(err)
+		}
+		tinkPaths[i] = filepath.Join(dir, fmt.Sprintf("tink%d.json", i))
+		if err := ioutil.WriteFile(tinkPaths[i], buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap: "envelope=-1:-1,age1=-1:-1,age2=-1:-1,tink1=-1:-1,tink2=-1:-1",
+		EncryptionKeys: "envelope=" + envKey.Public().String() +
+			",age1=age:" + ageIDs[0].Recipient().String() +
+			",age2=age:" + ageIDs[1].Recipient().String() +
+			",tink1=tink:" + tinkPaths[0] +
+			",tink2=tink:" + tinkPaths[1],
+		EscrowKeys: "age:" + ageIDs[2].Recipient().String(),
+	})
+
+	const msg = "Subject: hi\r\n\r\nbody\r\n"
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(msg)
+	e.RcptTo = []mail.Address{{User: "tink1"}, {User: "age1"}, {User: "envelope"}, {User: "age2"}, {User: "tink2"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte, len(saved))
+	for _, d := range saved {
+		if files[d.user], err = ioutil.ReadFile(d.filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(files) != 5 {
+		t.Fatalf("expected 5 deliveries, got %+v", saved)
+	}
+	if !bytes.Equal(files["age1"], files["age2"]) {
+		t.Error("expected the age accounts to share the ciphertext")
+	}
+	if bytes.Equal(files["tink1"], files["tink2"]) {
+		t.Error("expected a ciphertext for each tink account")
+	}
+
+	tinkDecrypt := make([]Decrypter, 2)
+	for i := range tinkKeys {
+		dec, err := hybrid.NewHybridDecrypt(tinkKeys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tinkDecrypt[i] = TinkDecrypter(dec)
+	}
+	cases := []struct {
+		user    string
+		decrypt Decrypter
+	}{
+		{"envelope", EnvelopeDecrypter(envKey)},
+		{"age1", AgeDecrypter(ageIDs[0])},
+		{"age2", AgeDecrypter(ageIDs[1])},
+		{"age1", AgeDecrypter(ageIDs[2])}, // escrow
+		{"tink1", tinkDecrypt[0]},
+		{"tink2", tinkDecrypt[1]},
+	}
+	for _, c := range cases {
+		r, err := c.decrypt(bytes.NewReader(files[c.user]))
+		if err != nil {
+			t.Fatalf("%s: %s", c.user, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %s", c.user, err)
+		}
+		if string(got) != msg {
+			t.Errorf("%s: unexpected plaintext %q", c.user, got)
+		}
+	}
+	// a tink message can't be opened with the key of another account
+	if r, err := tinkDecrypt[1](bytes.NewReader(files["tink1"])); err == nil {
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Error("tink1 message decrypted with the tink2 key")
+		}
+	}
+}
+
+func TestEscrowKeys(t *testing.T) {
+	keys, err := escrowKeys(testEnvelopeKey(t).Public().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ek, ok := keys[0].(envelopeKey); !ok || ek.Kind != envelope.KindEscrow {
+		t.Errorf("expected an envelope escrow key, got %+v", keys[0])
+	}
+}
@@ -0,0 +1,85 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/pentateu/email-cloud-service/envelope"
+	"github.com/pentateu/email-cloud-service/kms"
+)
+
+// testDir creates a temporary directory for the test name, remove deletes it
+func testDir(tb testing.TB, name string) (dir string, remove func()) {
+	dir, err := ioutil.TempDir("", "cryptomail-"+name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// testMailDir opens the Maildirs of cfg, in dir/[user] unless cfg has a path
+func testMailDir(tb testing.TB, dir string, cfg *maildirConfig) *MailDir {
+	if cfg.Path == "" {
+		cfg.Path = dir + "/[user]"
+	}
+	m, err := newMailDir(cfg, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+// testEnvelopeKey generates an envelope key
+func testEnvelopeKey(tb testing.TB) *envelope.PrivateKey {
+	k, err := envelope.GenerateKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return k
+}
+
+// testPGPKey generates an OpenPGP key for name@example.com and writes its armored public key
+// to dir/name.asc, as configured with pgp:<path>
+func testPGPKey(tb testing.TB, dir, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".asc")
+	writePGPKey(tb, entity, path)
+	return entity, path
+}
+
+// writePGPKey writes the armored public key of entity to path
+func writePGPKey(tb testing.TB, entity *openpgp.Entity, path string) {
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		tb.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// testKMS opens a local keystore in dir and makes it the KMS of the package, restore puts
+// back the previous one
+func testKMS(tb testing.TB, dir string) (ks *kms.Keystore, restore func()) {
+	ks, err := kms.OpenKeystore(filepath.Join(dir, "keystore.json"), []byte("test"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prev := openKMS
+	openKMS = func() (kms.KMS, error) { return ks, nil }
+	return ks, func() { openKMS = prev }
+}
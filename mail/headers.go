@@ -0,0 +1,66 @@
+package mail
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maxHeaderSize bounds the header section buffered to inspect a message while it is streamed
+const maxHeaderSize = 64 * 1024
+
+// splitHeader returns the header section at the start of buf, without the blank line
+// that ends it, and the size of the header section including the blank line.
+// ok is false when buf does not hold the whole header section yet.
+func splitHeader(buf []byte) (header []byte, size int, ok bool) {
+	if bytes.HasPrefix(buf, []byte("\r\n")) {
+		return nil, 2, true
+	}
+	if bytes.HasPrefix(buf, []byte("\n")) {
+		return nil, 1, true
+	}
+	crlf := bytes.Index(buf, []byte("\r\n\r\n"))
+	lf := bytes.Index(buf, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return buf[:crlf+2], crlf + 4, true
+	case lf >= 0:
+		return buf[:lf+1], lf + 2, true
+	}
+	return nil, 0, false
+}
+
+// headerFields splits a header section in its fields, keeping the folded lines
+// and the line endings of each field
+func headerFields(header []byte) []string {
+	fields := make([]string, 0)
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// fieldName returns the lower case name of a header field
+func fieldName(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(field[:i]))
+}
+
+// fieldValue returns the unfolded value of a header field
+func fieldValue(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	v := strings.NewReplacer("\r\n", "", "\n", "").Replace(field[i+1:])
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,182 @@
+package mail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IndexFileName is the name of the file, kept in the root of each Maildir,
+// that lists the messages stored for the account and their IPFS CIDs
+const IndexFileName = "cryptomail-index.json"
+
+// recentMessages is the number of message hashes kept to recognise a message sent again
+const recentMessages = 1000
+
+// indexEntry describes a single message stored for an account
+type indexEntry struct {
+	// Seq increases with every message added to the index, clients use it as a cursor
+	Seq uint64 `json:"seq"`
+	// CID of the message in IPFS, empty if it was not stored in IPFS (yet)
+	CID string `json:"cid,omitempty"`
+	// Filename is the full path of the message in the Maildir
+	Filename string    `json:"filename"`
+	Date     time.Time `json:"date"`
+	Size     int64     `json:"size,omitempty"`
+	// Encryption is the scheme the message is encrypted with, empty for plain messages
+	Encryption string `json:"encryption,omitempty"`
+	// KeyID is the account key the message is encrypted to, see KeyRecord
+	KeyID string `json:"key_id,omitempty"`
+	// EndToEnd is the encryption applied by the sender, messages stored as they were
+	// received have it without Encryption
+	EndToEnd string `json:"end_to_end,omitempty"`
+	// Folder is the Maildir folder of the subaddress the message was sent to, empty for the inbox
+	Folder string `json:"folder,omitempty"`
+	// Meta is the date, the size and the sender encryption encrypted to the account key,
+	// set instead of Date, Size and EndToEnd when the metadata is protected
+	Meta []byte `json:"meta,omitempty"`
+	// hash identifies the message, see messageHash. It is kept in Recent, not with the entry.
+	hash string
+}
+
+// mailIndex keeps track of the messages stored for one account.
+// It is persisted as JSON in the root of the account's Maildir.
+type mailIndex struct {
+	sync.Mutex
+	path    string
+	LastSeq uint64       `json:"last_seq"`
+	Entries []indexEntry `json:"entries"`
+	// Recent are the hashes of the last recentMessages messages, oldest first, so a message sent
+	// again by a client that missed the reply to DATA is not stored twice. A hash is recorded
+	// with its entry, in the same write of the index.
+	Recent []string `json:"recent,omitempty"`
+}
+
+// indexes are the indexes opened, by path
+var indexes registry
+
+// openIndex returns the index of the Maildir located at dir, loaded the first time
+func openIndex(dir string) (*mailIndex, error) {
+	path := filepath.Join(dir, IndexFileName)
+	v, err := indexes.get(path, func() (interface{}, error) {
+		idx := &mailIndex{path: path}
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, idx); err != nil {
+				return nil, err
+			}
+		}
+		return idx, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*mailIndex), nil
+}
+
+// add appends e to the index, assigning the next sequence number.
+// The index is left as it was when it can't be saved.
+func (idx *mailIndex) add(e indexEntry) (indexEntry, error) {
+	idx.Lock()
+	defer idx.Unlock()
+	entries, recent := idx.Entries, idx.Recent
+	idx.LastSeq++
+	e.Seq = idx.LastSeq
+	idx.Entries = append(idx.Entries, e)
+	if e.hash != "" {
+		kept := recent
+		if len(kept) >= recentMessages {
+			kept = kept[len(kept)-recentMessages+1:]
+		}
+		idx.Recent = append(append(make([]string, 0, len(kept)+1), kept...), e.hash)
+	}
+	if err := idx.save(); err != nil {
+		idx.LastSeq--
+		idx.Entries, idx.Recent = entries, recent
+		return e, err
+	}
+	return e, nil
+}
+
+// delivered reports if the message with hash is one of the recent messages
+func (idx *mailIndex) delivered(hash string) bool {
+	idx.Lock()
+	defer idx.Unlock()
+	for _, h := range idx.Recent {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// since returns the entries added after the seq cursor
+func (idx *mailIndex) since(seq uint64) []indexEntry {
+	idx.Lock()
+	defer idx.Unlock()
+	ret := make([]indexEntry, 0)
+	for _, e := range idx.Entries {
+		if e.Seq > seq {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// byCID finds the entry for a message CID
+func (idx *mailIndex) byCID(cid string) (indexEntry, bool) {
+	idx.Lock()
+	defer idx.Unlock()
+	for _, e := range idx.Entries {
+		if e.CID != "" && e.CID == cid {
+			return e, true
+		}
+	}
+	return indexEntry{}, false
+}
+
+// setCID records the IPFS CID of the entry with sequence seq
+func (idx *mailIndex) setCID(seq uint64, cid string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	for i := range idx.Entries {
+		if idx.Entries[i].Seq == seq {
+			idx.Entries[i].CID = cid
+			return idx.save()
+		}
+	}
+	return os.ErrNotExist
+}
+
+// remove drops the entry with the given CID from the index
+func (idx *mailIndex) remove(cid string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	for i, e := range idx.Entries {
+		if e.CID != "" && e.CID == cid {
+			idx.Entries = append(idx.Entries[:i], idx.Entries[i+1:]...)
+			return idx.save()
+		}
+	}
+	return nil
+}
+
+// save writes the index to disk, the caller must hold the lock.
+// The file is replaced atomically so a crash never leaves a truncated index behind.
+func (idx *mailIndex) save() error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, MailDirFilePerms); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/pentateu/email-cloud-service/pinning"
+)
+
+// pinners are the Pinners of each remote_pinning_services config, the pins made by any
+// backend worker can be released by the others
+var pinners registry
+
+// errNotQueued is returned by indexMail for a message indexed but not queued for IPFS
+var errNotQueued = errors.New("could not queue the message for IPFS")
+
+// remotePinner returns the Pinner for the remote_pinning_services config
+func remotePinner(services string) (*pinning.Pinner, error) {
+	v, err := pinners.get(services, func() (interface{}, error) {
+		clients, err := pinning.ParseServices(services)
+		if err != nil {
+			return nil, err
+		}
+		p := pinning.New(clients)
+		p.OnFailure = func(cid string, service string, err error) {
+			backends.Log().WithError(err).Errorf("could not pin %s on remote pinning service [%s]", cid, service)
+		}
+		return p, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pinning.Pinner), nil
+}
+
+// storeIPFS adds the Maildir file to IPFS and pins it, returning the CID
+func (m *MailDir) storeIPFS(ctx context.Context, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	p, err := m.ipfs.Unixfs().Add(ctx, files.NewReaderFile(f), options.Unixfs.Pin(true))
+	if err != nil {
+		return "", err
+	}
+	return p.Cid().String(), nil
+}
+
+// indexMail records a message saved for a recipient. When a node is available the message
+// is queued to be stored in IPFS, so saving never waits for IPFS.
+func (m *MailDir) indexMail(d delivery) (indexEntry, error) {
+	u, filename := d.user, d.filename
+	var size int64
+	if fi, err := os.Stat(filename); err == nil {
+		size = fi.Size()
+	}
+	e, err := m.newIndexEntry(u, filename, d.encryption, d.keyID, IndexMeta{Date: time.Now(), Size: size, EndToEnd: d.endToEnd})
+	if err != nil {
+		return e, err
+	}
+	e.Folder, e.hash = d.folder, d.hash
+	e, err = m.indexes[u].add(e)
+	if err != nil {
+		return e, err
+	}
+	if m.queue != nil {
+		if err = m.queue.push(&uploadJob{User: u, Filename: filename, Seq: e.Seq}); err != nil {
+			// the message is indexed, it is queued again at the next start
+			err = fmt.Errorf("%w: %s", errNotQueued, err)
+		}
+	}
+	return e, err
+}
+
+// requeueMissing queues the indexed messages that have no CID and no pending upload,
+// eg. when the service stopped between saving a message and queueing it
+func (m *MailDir) requeueMissing() error {
+	pending := make(map[string]bool)
+	m.queue.mu.Lock()
+	for _, j := range m.queue.jobs {
+		pending[j.Filename] = true
+	}
+	m.queue.mu.Unlock()
+	for u, idx := range m.indexes {
+		for _, e := range idx.since(0) {
+			if e.CID != "" || pending[e.Filename] {
+				continue
+			}
+			if err := m.queue.push(&uploadJob{User: u, Filename: e.Filename, Seq: e.Seq}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uploadJob stores a queued message in IPFS and records its CID in the index
+func (m *MailDir) uploadJob(j *uploadJob) error {
+	idx, ok := m.indexes[j.User]
+	if !ok {
+		return fmt.Errorf("upload for unknown user [%s]", j.User)
+	}
+	c, err := m.storeIPFS(context.Background(), j.Filename)
+	if err != nil {
+		return err
+	}
+	if err := idx.setCID(j.Seq, c); err != nil {
+		return err
+	}
+	if m.pinner != nil && m.pinner.Len() > 0 {
+		m.pinner.Pin(context.Background(), c, c)
+	}
+	backends.Log().Debug("stored email in IPFS as ", c)
+	return nil
+}
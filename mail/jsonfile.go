@@ -0,0 +1,72 @@
+package mail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// jsonFile is a JSON file the commands change while the service runs: it is read again when
+// its modification time changes, and replaced atomically when saved. The caller serializes
+// the loads and saves.
+type jsonFile struct {
+	path    string
+	modTime time.Time
+	loaded  bool
+}
+
+// load decodes the file into v when it changed since the last load and calls apply, which
+// takes the values of v. A missing file leaves v as it is. The file is read again on the
+// next load when apply fails.
+func (f *jsonFile) load(v interface{}, apply func() error) error {
+	fi, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		if f.loaded && f.modTime.IsZero() {
+			return nil
+		}
+		if err := apply(); err != nil {
+			return err
+		}
+		f.modTime, f.loaded = time.Time{}, true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.loaded && fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("could not parse %s: %s", f.path, err)
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	f.modTime, f.loaded = fi.ModTime(), true
+	return nil
+}
+
+// save writes v to the file, through a temporary file renamed over it
+func (f *jsonFile) save(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, MailDirFilePerms); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(f.path); err == nil {
+		f.modTime, f.loaded = fi.ModTime(), true
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONFile(t *testing.T) {
+	dir, remove := testDir(t, "jsonfile")
+	defer remove()
+	type doc struct {
+		Value string `json:"value"`
+	}
+	f := &jsonFile{path: filepath.Join(dir, "doc.json")}
+	applied := 0
+	load := func() (string, error) {
+		loaded := &doc{}
+		err := f.load(loaded, func() error {
+			applied++
+			if loaded.Value == "invalid" {
+				return errors.New("invalid value")
+			}
+			return nil
+		})
+		return loaded.Value, err
+	}
+
+	if v, err := load(); err != nil || v != "" || applied != 1 {
+		t.Fatalf("expected a missing file to be applied empty, got %q (%v)", v, err)
+	}
+	if _, err := load(); err != nil || applied != 1 {
+		t.Errorf("expected a missing file to be applied once, got %d (%v)", applied, err)
+	}
+	if err := f.save(&doc{Value: "saved"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(); err != nil || applied != 1 {
+		t.Errorf("expected the file saved not to be read again, got %d (%v)", applied, err)
+	}
+
+	// another process changes the file
+	write := func(data string) {
+		if err := ioutil.WriteFile(f.path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Duration(applied) * time.Second)
+		if err := os.Chtimes(f.path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"value": "changed"}`)
+	if v, err := load(); err != nil || v != "changed" {
+		t.Errorf("expected the changed file to be read, got %q (%v)", v, err)
+	}
+	write(`{"value": "invalid"}`)
+	for i := 0; i < 2; i++ {
+		if _, err := load(); err == nil {
+			t.Error("expected an error applying the file")
+		}
+	}
+	write(`{"value"`)
+	if _, err := load(); err == nil {
+		t.Error("expected an error parsing the file")
+	}
+}
@@ -0,0 +1,360 @@
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+// KeyringFileName is the name of the file, kept in the root of each Maildir,
+// with the history of the keys messages to the account are encrypted to
+const KeyringFileName = "cryptomail-keys.json"
+
+var (
+	errNoValidKey = errors.New("no valid encryption key")
+	// errKeyExpired is a history whose keys are not revoked but none is valid now, until the
+	// next rotation
+	errKeyExpired = errors.New("the encryption keys expired, rotate to a new key")
+)
+
+// keyExpiryWarning is how long before the current key of an account expires, with no key
+// following it, the expiry is logged
+const keyExpiryWarning = 7 * 24 * time.Hour
+
+// KeyRecord is a key in the history of an account. Messages are encrypted to the current key,
+// the newest key within its validity window and not revoked. Older keys are kept so clients
+// know which private key decrypts the messages recorded with their ID.
+type KeyRecord struct {
+	// ID is recorded in the index with every message encrypted to the key
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+	// Key as in maildir_encryption_keys, <scheme>:<key>
+	Key       string    `json:"key"`
+	NotBefore time.Time `json:"not_before"`
+	// NotAfter ends the validity of the key, zero for no end
+	NotAfter time.Time `json:"not_after"`
+	Revoked  bool      `json:"revoked,omitempty"`
+
+	parsed AccountKey
+}
+
+// Valid reports if messages can be encrypted to the key at t
+func (r *KeyRecord) Valid(t time.Time) bool {
+	return !r.Revoked && !t.Before(r.NotBefore) && (r.NotAfter.IsZero() || t.Before(r.NotAfter))
+}
+
+// keyring is the key history of an account, persisted as JSON in the root of its Maildir.
+// It is changed by the keys command while the service runs, so it is reloaded when the file changes.
+type keyring struct {
+	sync.Mutex
+	file jsonFile
+	Keys []*KeyRecord `json:"keys"`
+	// warned is the time the expiry of the current key was last logged
+	warned time.Time
+}
+
+// keyrings are the key histories opened, by path
+var keyrings registry
+
+// openKeyring returns the key history of the Maildir located at dir, loaded the first time
+func openKeyring(dir string) (*keyring, error) {
+	kr := newKeyring(dir)
+	v, err := keyrings.get(kr.file.path, func() (interface{}, error) {
+		kr.Lock()
+		defer kr.Unlock()
+		return kr, kr.load()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*keyring), nil
+}
+
+// newKeyring returns the key history of the Maildir located at dir, not loaded yet
+func newKeyring(dir string) *keyring {
+	return &keyring{file: jsonFile{path: filepath.Join(dir, KeyringFileName)}}
+}
+
+// load reads the keyring again if the file changed, the caller must hold the lock
+func (kr *keyring) load() error {
+	loaded := &keyring{}
+	return kr.file.load(loaded, func() error {
+		for _, r := range loaded.Keys {
+			var err error
+			if r.parsed, err = parseAccountKey(r.Key); err != nil {
+				return fmt.Errorf("invalid key %s in %s: %s", r.ID, kr.file.path, err)
+			}
+		}
+		kr.Keys = loaded.Keys
+		return nil
+	})
+}
+
+// save writes the keyring to disk, the caller must hold the lock
+func (kr *keyring) save() error {
+	return kr.file.save(kr)
+}
+
+// current returns the key messages are encrypted to at t. It returns nil when the account
+// has no key history, the key of maildir_encryption_keys is used then.
+func (kr *keyring) current(t time.Time) (*KeyRecord, error) {
+	kr.Lock()
+	defer kr.Unlock()
+	if err := kr.load(); err != nil {
+		return nil, err
+	}
+	if len(kr.Keys) == 0 {
+		return nil, nil
+	}
+	var cur *KeyRecord
+	for _, r := range kr.Keys {
+		if r.Valid(t) && (cur == nil || r.Version > cur.Version) {
+			cur = r
+		}
+	}
+	if cur == nil {
+		for _, r := range kr.Keys {
+			if !r.Revoked {
+				return nil, errKeyExpired
+			}
+		}
+		return nil, errNoValidKey
+	}
+	kr.warnExpiry(cur, t)
+	return cur, nil
+}
+
+// warnExpiry logs, once a day, that cur expires within keyExpiryWarning and no key follows it.
+// The messages to the account are refused for now from then on. The caller must hold the lock.
+func (kr *keyring) warnExpiry(cur *KeyRecord, t time.Time) {
+	if cur.NotAfter.IsZero() || cur.NotAfter.Sub(t) > keyExpiryWarning || t.Sub(kr.warned) < 24*time.Hour {
+		return
+	}
+	for _, r := range kr.Keys {
+		if r.Valid(cur.NotAfter) {
+			return
+		}
+	}
+	kr.warned = t
+	backends.Log().Errorf("the encryption key %s in %s expires on %s and no key follows it, "+
+		"rotate to a new key or messages to the account are refused", cur.ID, kr.file.path, cur.NotAfter.Format(time.RFC3339))
+}
+
+// list returns a copy of the key history
+func (kr *keyring) list() ([]KeyRecord, error) {
+	kr.Lock()
+	defer kr.Unlock()
+	if err := kr.load(); err != nil {
+		return nil, err
+	}
+	ret := make([]KeyRecord, len(kr.Keys))
+	for i := range kr.Keys {
+		ret[i] = *kr.Keys[i]
+	}
+	return ret, nil
+}
+
+// rotate makes key the current key from t, valid for validFor (0 for no end), and ends the
+// validity of the previous keys. initial is the key of maildir_encryption_keys, recorded as
+// the first version when the account has no history yet.
+func (kr *keyring) rotate(key, initial string, t time.Time, validFor time.Duration) (*KeyRecord, error) {
+	k, err := parseAccountKey(key)
+	if err != nil {
+		return nil, err
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	if err := kr.load(); err != nil {
+		return nil, err
+	}
+	if len(kr.Keys) == 0 && initial != "" {
+		ik, err := parseAccountKey(initial)
+		if err != nil {
+			return nil, err
+		}
+		kr.Keys = append(kr.Keys, &KeyRecord{ID: keyID(initial, ik), Version: 1, Key: canonicalKey(initial, ik), parsed: ik})
+	}
+	r := &KeyRecord{ID: keyID(key, k), Version: 1, Key: canonicalKey(key, k), NotBefore: t, parsed: k}
+	for _, old := range kr.Keys {
+		if old.ID == r.ID {
+			return nil, fmt.Errorf("key %s is already in the history", r.ID)
+		}
+		if old.Version >= r.Version {
+			r.Version = old.Version + 1
+		}
+		if old.NotAfter.IsZero() || old.NotAfter.After(t) {
+			old.NotAfter = t
+		}
+	}
+	if validFor > 0 {
+		r.NotAfter = t.Add(validFor)
+	}
+	kr.Keys = append(kr.Keys, r)
+	return r, kr.save()
+}
+
+// revoke marks the key id revoked, no message is encrypted to it anymore. The current key
+// can only be revoked once a newer key is valid, rotate first.
+func (kr *keyring) revoke(id string, t time.Time) error {
+	kr.Lock()
+	defer kr.Unlock()
+	if err := kr.load(); err != nil {
+		return err
+	}
+	var target *KeyRecord
+	replaced := false
+	for _, r := range kr.Keys {
+		if r.ID == id {
+			target = r
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no key %s in the history", id)
+	}
+	for _, r := range kr.Keys {
+		if r != target && r.Valid(t) {
+			replaced = true
+		}
+	}
+	if target.Valid(t) && !replaced {
+		return fmt.Errorf("key %s is the current key, rotate to a new key before revoking it", id)
+	}
+	target.Revoked = true
+	return kr.save()
+}
+
+// canonicalKey returns key s of scheme k.Scheme() with its scheme prefix
+func canonicalKey(s string, k AccountKey) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, k.Scheme()+":") {
+		return s
+	}
+	return k.Scheme() + ":" + s
+}
+
+// keyID identifies key s. Envelope keys use the key ID of their stanzas, the other schemes
+// a hash of the key as configured: tink and pgp keys need a new file for every key.
+func keyID(s string, k AccountKey) string {
+	if ek, ok := k.(envelopeKey); ok {
+		return ek.Key.ID().String()
+	}
+	sum := sha256.Sum256([]byte(canonicalKey(s, k)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// currentKey is the key messages to an account are encrypted to and its ID
+type currentKey struct {
+	AccountKey
+	id string
+}
+
+// sealedAccount reports if messages to u are encrypted
+func (m *MailDir) sealedAccount(u string) bool {
+	if _, ok := m.encryptionKeys[u]; ok {
+		return true
+	}
+	kr, ok := m.keyrings[u]
+	if !ok {
+		return false
+	}
+	keys, err := kr.list()
+	// a keyring that can't be read fails the delivery rather than storing in plain text
+	return err != nil || len(keys) > 0
+}
+
+// currentKey returns the key messages to u are encrypted to now: the current key of its
+// history, or the key of maildir_encryption_keys when it has none
+func (m *MailDir) currentKey(u string) (currentKey, error) {
+	if kr, ok := m.keyrings[u]; ok {
+		r, err := kr.current(time.Now())
+		if err != nil {
+			return currentKey{}, err
+		}
+		if r != nil {
+			return currentKey{r.parsed, r.ID}, nil
+		}
+	}
+	k, ok := m.encryptionKeys[u]
+	if !ok {
+		return currentKey{}, errNoValidKey
+	}
+	return currentKey{k, keyID(m.configKeys[u], k)}, nil
+}
+
+// currentKeys returns the current key of each of users, and the users that have none
+func (m *MailDir) currentKeys(users []string) (map[string]currentKey, deliveryErrors) {
+	ret := make(map[string]currentKey, len(users))
+	var failed deliveryErrors
+	for _, u := range users {
+		k, err := m.currentKey(u)
+		if err != nil {
+			code := statusNoKey
+			if !errors.Is(err, errNoValidKey) {
+				code = statusKeyExpired
+			}
+			failed = append(failed, &deliveryError{user: u, err: err, code: code})
+			continue
+		}
+		ret[u] = k
+	}
+	return ret, failed
+}
+
+// keyring returns the key history of account
+func (m *MailDir) keyring(account string) (*keyring, error) {
+	kr, ok := m.keyrings[strings.ToLower(account)]
+	if !ok {
+		return nil, fmt.Errorf("no such account [%s]", account)
+	}
+	return kr, nil
+}
+
+// RotateKey makes key, as in maildir_encryption_keys, the current key of account, for the
+// keys command. validFor limits the validity of the key, 0 for no end.
+func RotateKey(configPath, account, key string, validFor time.Duration) (*KeyRecord, error) {
+	m, err := loadMailDir(configPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := m.keyring(account)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := parseAccountKey(key); err == nil && k.Scheme() == SchemePGP && m.config.ProtectMetadata {
+		return nil, errors.New("pgp keys can't be used with maildir_protect_metadata")
+	}
+	return kr.rotate(key, m.configKeys[strings.ToLower(account)], time.Now(), validFor)
+}
+
+// ListKeys returns the key history of account, for the keys command
+func ListKeys(configPath, account string) ([]KeyRecord, error) {
+	m, err := loadMailDir(configPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := m.keyring(account)
+	if err != nil {
+		return nil, err
+	}
+	return kr.list()
+}
+
+// RevokeKey revokes the key id of account, for the keys command
+func RevokeKey(configPath, account, id string) error {
+	m, err := loadMailDir(configPath, nil)
+	if err != nil {
+		return err
+	}
+	kr, err := m.keyring(account)
+	if err != nil {
+		return err
+	}
+	return kr.revoke(id, time.Now())
+}
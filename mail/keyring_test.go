@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/pentateu/email-cloud-service/envelope"
+)
+
+// TestKeyRotation rotates the key of an account while the MailDir runs, as the keys command
+// does, and checks new messages are encrypted to the new key and recorded with its ID
+func TestKeyRotation(t *testing.T) {
+	dir, remove := testDir(t, "keyring")
+	defer remove()
+	old, current := testEnvelopeKey(t), testEnvelopeKey(t)
+
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:        "test=-1:-1",
+		EncryptionKeys: "test=" + old.Public().String(),
+	})
+	sent := 0
+	deliver := func() (indexEntry, []byte) {
+		// a different message each time, the same one would be skipped as sent again
+		sent++
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(fmt.Sprintf("Message-ID: <%d@example.com>\r\nSubject: hello\r\n\r\nbody\r\n", sent))
+		e.RcptTo = []mail.Address{{User: "test"}}
+		saved, err := m.save(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := m.indexMail(saved[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadFile(saved[0].filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry, stored
+	}
+
+	entry, _ := deliver()
+	if entry.KeyID != old.Public().ID().String() {
+		t.Errorf("expected the key ID of the configured key, got %+v", entry)
+	}
+
+	// another process rotates the key
+	kr := newKeyring(filepath.Join(dir, "test"))
+	now := time.Now()
+	r, err := kr.rotate(current.Public().String(), m.configKeys["test"], now.Add(-time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != 2 || r.ID != current.Public().ID().String() {
+		t.Fatalf("unexpected key record %+v", r)
+	}
+	if _, err := kr.rotate(current.Public().String(), "", now, 0); err == nil {
+		t.Error("expected an error rotating to a key already in the history")
+	}
+
+	entry, stored := deliver()
+	if entry.KeyID != r.ID {
+		t.Errorf("expected the key ID of the rotated key, got %+v", entry)
+	}
+	if _, err := envelope.NewReader(bytes.NewReader(stored), current); err != nil {
+		t.Errorf("could not decrypt with the current key: %s", err)
+	}
+	if _, err := envelope.NewReader(bytes.NewReader(stored), old); err == nil {
+		t.Error("the message is still encrypted to the retired key")
+	}
+
+	keys, err := kr.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Valid(now) || !keys[1].Valid(now) {
+		t.Fatalf("expected the configured key retired and the new one valid, got %+v", keys)
+	}
+	if err := kr.revoke(r.ID, now); err == nil {
+		t.Error("expected an error revoking the current key")
+	}
+	if err := kr.revoke(keys[0].ID, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key past its validity leaves the account without key, messages are not stored in clear
+	// but refused for now, until the next rotation
+	expiring, err := kr.rotate("age:age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p", "", now.Add(-2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hello\r\n\r\nbody\r\n")
+	e.RcptTo = []mail.Address{{User: "test"}}
+	_, err = m.save(e)
+	var failed deliveryErrors
+	if !errors.As(err, &failed) || len(failed) != 1 || !failed[0].temporary() {
+		t.Errorf("expected a transient error saving for an account whose key expired, got %v", err)
+	}
+	// once every key is revoked the account does not accept messages anymore
+	for _, id := range []string{r.ID, expiring.ID} {
+		if err := kr.revoke(id, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = m.save(e); !errors.As(err, &failed) || len(failed) != 1 || failed[0].temporary() {
+		t.Errorf("expected a permanent error saving for an account without valid key, got %v", err)
+	}
+}
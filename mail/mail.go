@@ -12,6 +12,7 @@ import (
 	"github.com/flashmob/go-guerrilla"
 	"github.com/flashmob/go-guerrilla/log"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/pentateu/email-cloud-service/config"
 	"github.com/spf13/cobra"
 )
@@ -21,8 +22,9 @@ const (
 )
 
 var (
-	configPath string
-	pidFile    string
+	configPath  string
+	pidFile     string
+	metricsAddr string
 
 	serveCmd = &cobra.Command{
 		Use:   "serve",
@@ -48,6 +50,8 @@ func Init(rootCmd *cobra.Command) {
 	// intentionally didn't specify default pidFile; value from config is used if flag is empty
 	serveCmd.PersistentFlags().StringVarP(&pidFile, "pidFile", "p",
 		"", "Path to the pid file")
+	serveCmd.PersistentFlags().StringVarP(&metricsAddr, "metrics", "m",
+		"", "Address to serve prometheus metrics on, eg. 127.0.0.1:9100")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -86,25 +90,32 @@ func logVersion() {
 }
 
 //Start - start smtp server
-func Start(cmd *cobra.Command, args []string, mailConfig *config.MailConfig, ipfs iface.CoreAPI) error {
+func Start(cmd *cobra.Command, args []string, mailConfig *config.MailConfig, ipfs iface.CoreAPI, h host.Host) error {
 	logVersion()
 	// Here we initialize our Guerrilla Daemon
 	d = guerrilla.Daemon{Logger: mainlog}
 
 	// add the Processor to be identified as "MailDir"
-	d.AddProcessor("MailDir", IPFSProcessor(mailConfig, ipfs))
+	d.AddProcessor("MailDir", IPFSProcessor(mailConfig, ipfs, h))
 
 	err := readConfig(configPath, pidFile)
 	if err != nil {
 		mainlog.WithError(err).Fatal("Error while reading config")
 	}
+	if err := readSubmissionConfig(configPath, d.Config.AllowedHosts); err != nil {
+		mainlog.WithError(err).Fatal("Error while reading submission_servers")
+	}
 	checkFileLimit()
+	setMaxMessageSize()
 
 	err = d.Start()
 	if err != nil {
 		mainlog.WithError(err).Error("Error(s) when starting server(s)")
 		return err
 	}
+	if len(metricsAddr) > 0 {
+		go serveMetrics(metricsAddr)
+	}
 
 	sigHandler()
 	return nil
@@ -125,6 +136,16 @@ func checkFileLimit() {
 	}
 }
 
+// setMaxMessageSize limits the messages saved to the largest max_size of the enabled servers
+func setMaxMessageSize() {
+	maxMessageSize = 0
+	for _, s := range d.Config.Servers {
+		if s.IsEnabled && s.MaxSize > maxMessageSize {
+			maxMessageSize = s.MaxSize
+		}
+	}
+}
+
 // Superset of `guerrilla.AppConfig` containing options specific
 // the the command line interface.
 type CmdConfig struct {
@@ -1,7 +1,7 @@
 package mail
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"os/user"
 	"strconv"
@@ -12,7 +12,11 @@ import (
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/response"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/pentateu/email-cloud-service/config"
+	"github.com/pentateu/email-cloud-service/pinning"
+	"github.com/pentateu/email-cloud-service/relay"
 	maildir "github.com/pentateu/go-crypto-maildir"
 )
 
@@ -28,12 +32,114 @@ type maildirConfig struct {
 	// use -1 for <id> & <group> if you want to ignore these, otherwise get these numbers from /etc/passwd
 	// Example: "test=1002:2003,guerrilla=1001:1001"
 	UserMap string `json:"maildir_user_map"`
+	// Account keys used to verify acknowledgements sent by client nodes, optional
+	// Each record separated by ","
+	// Records have the following format: <username>=<peer id of the client node>
+	// Example: "test=12D3KooWB...,guerrilla=12D3KooWC..."
+	AccountKeys string `json:"maildir_account_keys,omitempty"`
+	// Remote pinning services every stored message is pinned to, optional
+	// Each record separated by ","
+	// Records have the following format: <name>=<endpoint>|<access token>
+	// Example: "pinata=https://api.pinata.cloud/psa|eyJhbGciOi..."
+	RemotePinning string `json:"remote_pinning_services,omitempty"`
+	// Directory of the queue of messages waiting to be stored in IPFS, optional
+	// defaults to /var/spool/cryptomail/queue
+	QueuePath string `json:"ipfs_queue_path,omitempty"`
+	// Keys messages are encrypted to before they are stored, optional
+	// Messages to accounts without a key are stored in plain text
+	// Each record separated by ","
+	// Records have the following format: <username>=<scheme>:<key>
+	// scheme is envelope (the default, key is a base64 X25519 public key), age (key is age1...),
+	// tink (key is the path of a hybrid public keyset in JSON) or pgp (key is the path of an
+	// armored OpenPGP public key, messages are stored as PGP/MIME)
+	// Example: "test=ZHpH0...=,guerrilla=age:age1ql3z7...,flashmob=tink:/etc/cryptomail/flashmob.json"
+	EncryptionKeys string `json:"maildir_encryption_keys,omitempty"`
+	// Escrow keys every encrypted message is also encrypted to, optional
+	// keys as in maildir_encryption_keys separated by ",", they are added to the messages
+	// of the accounts of the same scheme. tink keys can't be escrow keys
+	EscrowKeys string `json:"maildir_escrow_keys,omitempty"`
+	// Protect the metadata of the messages, optional
+	// Every account must have an encryption key. Messages are stored with random names
+	// and the index only keeps their date and size encrypted to the account key.
+	// The hashes of the messages are keyed with a secret of the KMS
+	ProtectMetadata bool `json:"maildir_protect_metadata,omitempty"`
+	// What to do with messages already encrypted by the sender (PGP/MIME, inline PGP
+	// or S/MIME), optional: "store" keeps them as they are, "wrap" encrypts them to the
+	// account key too. Defaults to "wrap" with maildir_protect_metadata, "store" otherwise
+	EncryptedPolicy string `json:"maildir_encrypted_policy,omitempty"`
+	// Path of the file mapping the aliases issued with the aliases command to their account,
+	// optional, eg. /var/lib/cryptomail/aliases.json. It is encrypted with a secret of the KMS
+	AliasesPath string `json:"maildir_aliases_path,omitempty"`
+	// Aliases delivering to one or more accounts, optional
+	// Each record separated by ","
+	// Records have the following format: <alias>=<target>[|<target>...]
+	// alias is a local part or a full address, targets are accounts or other aliases.
+	// An account listed more than once gets a single copy
+	// Example: "postmaster=test,team@example.com=test|guerrilla|postmaster"
+	AliasMap string `json:"maildir_alias_map,omitempty"`
+	// Account getting the mail to unknown recipients of a domain, optional
+	// Each record separated by ","
+	// Records have the following format: <domain>=<username>
+	// Example: "example.com=test"
+	CatchAll string `json:"maildir_catch_all,omitempty"`
+	// Characters separating a local part from its subaddress tag, optional, eg. "+" or "+-"
+	// Mail to test+news@example.com is delivered to test. Empty disables subaddressing
+	SubaddressSeparators string `json:"maildir_subaddress_separators,omitempty"`
+	// Deliver subaddressed mail to a Maildir folder named after the tag, optional
+	// eg. test+news goes to the .news folder of test, created on demand. It can't be used
+	// with maildir_protect_metadata, folder names are stored in clear
+	SubaddressFolders bool `json:"maildir_subaddress_folders,omitempty"`
+	// Path of the file with the passwords the accounts submit mail with, optional
+	// eg. /var/lib/cryptomail/credentials.json. Set them with the passwd command
+	CredentialsPath string `json:"maildir_credentials_path,omitempty"`
+	// Directory of the queue of messages sent to other servers, optional
+	// eg. /var/spool/cryptomail/outbound. Without it the service does not send mail
+	OutboundQueuePath string `json:"outbound_queue_path,omitempty"`
+	// Host name sent with EHLO to the other servers, optional, defaults to the host name
+	OutboundHostname string `json:"outbound_hostname,omitempty"`
+	// STARTTLS of the outbound connections, optional: "opportunistic" (the default) encrypts
+	// when the server offers it, "required" only delivers over TLS with a valid certificate
+	// for the MX host and "none" never encrypts
+	OutboundTLS string `json:"outbound_tls,omitempty"`
+	// DKIM keys of the domains mail is sent for, optional, eg. "example.com=mail2026:/etc/cryptomail/example.com.pem"
+	// maps the domain to its selector and the PKCS#8 or PKCS#1 key file, or kms:<name> for a key of the KMS
+	OutboundDKIMKeys string `json:"outbound_dkim_keys,omitempty"`
+	// Headers signed, optional, eg. "From,To,Subject,Date", defaults to dkim.DefaultHeaders
+	OutboundDKIMHeaders string `json:"outbound_dkim_headers,omitempty"`
+	// Serve the Web Key Directory on this address, optional, eg. ":443"
+	// The keys of the accounts using pgp encryption are published for the domains of wkd_domains
+	WKDListen  string `json:"wkd_listen_interface,omitempty"`
+	WKDDomains string `json:"wkd_domains,omitempty"`
+	// TLS certificate and key of the Web Key Directory, optional
+	// Without them it serves plain HTTP, for a proxy terminating TLS
+	WKDTLSCert string `json:"wkd_tls_cert_file,omitempty"`
+	WKDTLSKey  string `json:"wkd_tls_key_file,omitempty"`
 }
 
 type MailDir struct {
-	userMap map[string][]int
-	dirs    map[string]*maildir.Maildir
-	config  *maildirConfig
+	userMap     map[string][]int
+	dirs        map[string]*maildir.Maildir
+	indexes     map[string]*mailIndex
+	accountKeys map[string]crypto.PubKey
+	// encryptionKeys and escrowKeys are the keys messages are encrypted to, configKeys the
+	// keys of maildir_encryption_keys as configured. The keyrings override encryptionKeys
+	// once an account key is rotated.
+	encryptionKeys map[string]AccountKey
+	configKeys     map[string]string
+	escrowKeys     []AccountKey
+	keyrings       map[string]*keyring
+	autocrypt      map[string]*autocryptLog
+	aliases        *aliasStore
+	aliasMap       map[string][]string
+	relay          *relay.Queue
+	credentials    *credentialStore
+	catchAll       map[string]string
+	config         *maildirConfig
+	ipfs           iface.CoreAPI
+	pinner         *pinning.Pinner
+	queue          *uploadQueue
+	// hashKey keys the message hashes of the indexes when the metadata is protected
+	hashKey []byte
 }
 
 // check to see if we have configured
@@ -53,6 +159,15 @@ func (m *MailDir) initDirs() error {
 	if m.dirs == nil {
 		m.dirs = make(map[string]*maildir.Maildir, 0)
 	}
+	if m.indexes == nil {
+		m.indexes = make(map[string]*mailIndex, 0)
+	}
+	if m.keyrings == nil {
+		m.keyrings = make(map[string]*keyring, 0)
+	}
+	if m.autocrypt == nil {
+		m.autocrypt = make(map[string]*autocryptLog, 0)
+	}
 	// initialize some maildirs
 	mdirMux.Lock()
 	defer mdirMux.Unlock()
@@ -64,18 +179,37 @@ func (m *MailDir) initDirs() error {
 			backends.Log().WithError(err).Error("could not create Maildir. Please check the config")
 			return err
 		}
+		idx, err := openIndex(path)
+		if err != nil {
+			backends.Log().WithError(err).Error("could not open the Maildir index")
+			return err
+		}
+		m.indexes[str] = idx
+		kr, err := openKeyring(path)
+		if err != nil {
+			backends.Log().WithError(err).Error("could not open the Maildir keyring")
+			return err
+		}
+		m.keyrings[str] = kr
+		l, err := openAutocryptLog(path)
+		if err != nil {
+			backends.Log().WithError(err).Error("could not open the Autocrypt log")
+			return err
+		}
+		m.autocrypt[str] = l
 	}
 	return nil
 }
 
 func (m *MailDir) validateRcpt(addr *mail.Address) backends.RcptError {
-	u := strings.ToLower(addr.User)
-	mdir, ok := m.dirs[u]
-	if !ok {
+	targets := m.targets(addr)
+	if len(targets) == 0 {
 		return backends.NoSuchUser
 	}
-	if _, err := os.Stat(mdir.Path); err != nil {
-		return backends.StorageNotAvailable
+	for _, t := range targets {
+		if _, err := os.Stat(m.dirs[t.account].Path); err != nil {
+			return backends.StorageNotAvailable
+		}
 	}
 	return nil
 }
@@ -86,18 +220,100 @@ func newMailDir(config *maildirConfig, ipfs iface.CoreAPI) (*MailDir, error) {
 	m.ipfs = ipfs
 	m.config = config
 	m.userMap = usermap(m.config.UserMap)
-	if strings.Index(m.config.Path, "~/") == 0 {
+	keys, err := accountKeys(m.config.AccountKeys)
+	if err != nil {
+		backends.Log().WithError(err).Error("could not parse maildir_account_keys")
+		return nil, err
+	}
+	m.accountKeys = keys
+	if m.encryptionKeys, err = encryptionKeys(m.config.EncryptionKeys); err != nil {
+		backends.Log().WithError(err).Error("could not parse maildir_encryption_keys")
+		return nil, err
+	}
+	// already validated by encryptionKeys
+	m.configKeys, _ = keySpecs(m.config.EncryptionKeys)
+	if m.escrowKeys, err = escrowKeys(m.config.EscrowKeys); err != nil {
+		backends.Log().WithError(err).Error("could not parse maildir_escrow_keys")
+		return nil, err
+	}
+	if err := m.checkEncryptedPolicy(); err != nil {
+		backends.Log().WithError(err).Error("invalid maildir_encrypted_policy")
+		return nil, err
+	}
+	if m.aliasMap, err = aliasMap(m.config.AliasMap, m.userMap); err != nil {
+		backends.Log().WithError(err).Error("could not parse maildir_alias_map")
+		return nil, err
+	}
+	if m.catchAll, err = catchAll(m.config.CatchAll, m.userMap); err != nil {
+		backends.Log().WithError(err).Error("could not parse maildir_catch_all")
+		return nil, err
+	}
+	if err := m.checkSubaddress(); err != nil {
+		backends.Log().WithError(err).Error("invalid maildir_subaddress_folders")
+		return nil, err
+	}
+	if len(m.config.AliasesPath) > 0 {
+		if m.aliases, err = openAliases(m.config.AliasesPath); err != nil {
+			backends.Log().WithError(err).Error("could not open maildir_aliases_path")
+			return nil, err
+		}
+	}
+	if m.pinner, err = remotePinner(m.config.RemotePinning); err != nil {
+		backends.Log().WithError(err).Error("could not parse remote_pinning_services")
+		return nil, err
+	}
+	if len(m.config.QueuePath) == 0 {
+		m.config.QueuePath = defaultQueuePath
+	}
+	if strings.Index(m.config.Path, "~/") == 0 || strings.Index(m.config.QueuePath, "~/") == 0 {
 		// expand the ~/ to home dir
 		usr, err := user.Current()
 		if err != nil {
 			backends.Log().WithError(err).Error("could not expand ~/ to homedir")
 			return nil, err
 		}
-		m.config.Path = usr.HomeDir + m.config.Path[1:]
+		if strings.Index(m.config.Path, "~/") == 0 {
+			m.config.Path = usr.HomeDir + m.config.Path[1:]
+		}
+		if strings.Index(m.config.QueuePath, "~/") == 0 {
+			m.config.QueuePath = usr.HomeDir + m.config.QueuePath[1:]
+		}
+	}
+	if len(m.config.CredentialsPath) > 0 {
+		if m.credentials, err = openCredentials(m.config.CredentialsPath); err != nil {
+			backends.Log().WithError(err).Error("could not open maildir_credentials_path")
+			return nil, err
+		}
+	}
+	if len(m.config.OutboundQueuePath) > 0 {
+		if m.relay, err = openRelay(m.config); err != nil {
+			backends.Log().WithError(err).Error("could not open the outbound queue")
+			return nil, err
+		}
 	}
 	if err := m.initDirs(); err != nil {
 		return nil, err
 	}
+	// the current keys are in the keyrings of the Maildirs
+	if err := m.checkProtectMetadata(); err != nil {
+		backends.Log().WithError(err).Error("invalid maildir_protect_metadata")
+		return nil, err
+	}
+	if m.ipfs != nil {
+		if m.queue, err = openQueue(m.config.QueuePath); err != nil {
+			backends.Log().WithError(err).Error("could not open the IPFS upload queue")
+			return nil, err
+		}
+		if err := m.requeueMissing(); err != nil {
+			backends.Log().WithError(err).Error("could not queue messages missing from IPFS")
+			return nil, err
+		}
+		m.queue.setUploader(m.uploadJob)
+		if err := m.listenAcks(); err != nil {
+			backends.Log().WithError(err).Error("could not subscribe to acknowledgements")
+			return nil, err
+		}
+	}
 	return m, nil
 }
 
@@ -128,7 +344,9 @@ func usermap(usermap string) (ret map[string][]int) {
 }
 
 //IPFSProcessor - Create a Processor that stores encrypted mail using maildir format in IPFS
-func IPFSProcessor(mailConfig *config.MailConfig, ipfs iface.CoreAPI) func() backends.Decorator {
+// h is the libp2p host of the embedded node, used to serve the sync protocol. It is nil when
+// the service talks to an external node.
+func IPFSProcessor(mailConfig *config.MailConfig, ipfs iface.CoreAPI, h host.Host) func() backends.Decorator {
 	return func() backends.Decorator {
 		// The following initialization is run when the program first starts
 
@@ -150,6 +368,14 @@ func IPFSProcessor(mailConfig *config.MailConfig, ipfs iface.CoreAPI) func() bac
 			if err != nil {
 				return err
 			}
+			if h != nil {
+				m.serveSync(h)
+			}
+			m.serveWKD()
+			if m.relay != nil {
+				m.relay.Start(context.Background())
+			}
+			m.serveSubmission()
 			return nil
 		})
 		// register our initializer
@@ -175,19 +401,8 @@ func IPFSProcessor(mailConfig *config.MailConfig, ipfs iface.CoreAPI) func() bac
 					}
 					return c.Process(e, task)
 				} else if task == backends.TaskSaveMail {
-					for i := range e.RcptTo {
-						u := strings.ToLower(e.RcptTo[i].User)
-						mdir, ok := m.dirs[u]
-						if !ok {
-							// no such user
-							continue
-						}
-						if filename, err := mdir.CreateMail(e.NewReader()); err != nil {
-							backends.Log().WithError(err).Error("Could not save email")
-							return backends.NewResult(fmt.Sprintf("554 Error: could not save email for [%s]", u)), err
-						} else {
-							backends.Log().Debug("saved email as", filename)
-						}
+					if result, err := m.deliver(e); result != nil {
+						return result, err
 					}
 					// continue to the next Processor in the decorator chain
 					return c.Process(e, task)
@@ -0,0 +1,108 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IndexMeta is the metadata of a stored message. When maildir_protect_metadata is set
+// it is only kept encrypted to the account key, see OpenIndexMeta.
+type IndexMeta struct {
+	Date time.Time `json:"date"`
+	Size int64     `json:"size"`
+	// EndToEnd is the encryption applied by the sender, if any: pgp-mime, pgp-inline or smime
+	EndToEnd string `json:"end_to_end,omitempty"`
+}
+
+// OpenIndexMeta decrypts the metadata of a message listed by the sync protocol with the account key
+func OpenIndexMeta(meta []byte, decrypt Decrypter) (*IndexMeta, error) {
+	r, err := decrypt(bytes.NewReader(meta))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ret := &IndexMeta{}
+	return ret, json.Unmarshal(data, ret)
+}
+
+// hashSecretName is the KMS secret the message hashes are keyed with when the metadata is protected
+const hashSecretName = "message-hashes"
+
+// checkProtectMetadata makes sure every account has an encryption key when the metadata
+// is protected, messages to an account without a key would be stored in plain text.
+// It reads the key of the message hashes from the KMS.
+func (m *MailDir) checkProtectMetadata() error {
+	if !m.config.ProtectMetadata {
+		return nil
+	}
+	for u := range m.userMap {
+		k, err := m.currentKey(u)
+		if err != nil {
+			return fmt.Errorf("maildir_protect_metadata is set but [%s] has no encryption key: %s", u, err)
+		}
+		if k.Scheme() == SchemePGP {
+			// PGP/MIME messages keep the headers in clear for the clients
+			return fmt.Errorf("maildir_protect_metadata is set but [%s] uses pgp encryption", u)
+		}
+	}
+	var err error
+	if m.hashKey, err = kmsSecret(hashSecretName); err != nil {
+		return fmt.Errorf("maildir_protect_metadata needs a KMS for the message hashes: %s", err)
+	}
+	return nil
+}
+
+// newIndexEntry describes the message filename of user u, encrypted with the scheme encryption
+// to the key keyID. The metadata is only kept encrypted when it is protected.
+func (m *MailDir) newIndexEntry(u, filename, encryption, keyID string, meta IndexMeta) (indexEntry, error) {
+	if !m.config.ProtectMetadata {
+		return indexEntry{Filename: filename, Encryption: encryption, KeyID: keyID, Date: meta.Date, Size: meta.Size, EndToEnd: meta.EndToEnd}, nil
+	}
+	data, err := json.Marshal(&meta)
+	if err != nil {
+		return indexEntry{}, err
+	}
+	k, err := m.currentKey(u)
+	if err != nil {
+		return indexEntry{}, err
+	}
+	buf := &bytes.Buffer{}
+	w, err := m.encrypt(buf, []AccountKey{k.AccountKey})
+	if err != nil {
+		return indexEntry{}, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return indexEntry{}, err
+	}
+	if err := w.Close(); err != nil {
+		return indexEntry{}, err
+	}
+	return indexEntry{Filename: filename, Encryption: encryption, KeyID: keyID, Meta: buf.Bytes()}, nil
+}
+
+// opaqueName renames a message saved in a Maildir to a random name. Maildir names carry
+// the delivery time and the size, they are dropped when the metadata is protected.
+func (m *MailDir) opaqueName(filename string) (string, error) {
+	if !m.config.ProtectMetadata {
+		return filename, nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	name := filepath.Join(filepath.Dir(filename), hex.EncodeToString(id))
+	if err := os.Rename(filename, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestProtectMetadata(t *testing.T) {
+	dir, remove := testDir(t, "metadata")
+	defer remove()
+	_, restore := testKMS(t, dir)
+	defer restore()
+	k := testEnvelopeKey(t)
+
+	cfg := &maildirConfig{
+		Path:            dir + "/[user]",
+		UserMap:         "test=-1:-1,guerrilla=-1:-1",
+		EncryptionKeys:  "test=" + k.Public().String(),
+		ProtectMetadata: true,
+	}
+	if _, err := newMailDir(cfg, nil); err == nil {
+		t.Fatal("expected an error for an account without encryption key")
+	}
+	cfg.UserMap = "test=-1:-1"
+	m := testMailDir(t, dir, cfg)
+
+	newEnvelope := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("From: alice@example.com\r\nTo: test@example.com\r\nSubject: secret plans\r\n\r\nbody\r\n")
+		e.MailFrom = mail.Address{User: "alice", Host: "example.com"}
+		e.RcptTo = []mail.Address{{User: "test"}}
+		return e
+	}
+	saved, err := m.save(newEnvelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("expected 1 delivery, got %+v", saved)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(filepath.Base(saved[0].filename)) {
+		t.Errorf("expected an opaque file name, got %s", saved[0].filename)
+	}
+	before := time.Now()
+	entry, err := m.indexMail(saved[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Date.IsZero() || entry.Size != 0 || len(entry.Meta) == 0 {
+		t.Fatalf("expected only encrypted metadata in the index, got %+v", entry)
+	}
+
+	// nothing about the sender, the subject or the date is kept in plain text
+	for _, path := range []string{saved[0].filename, filepath.Join(dir, "test", IndexFileName)} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, leak := range []string{"alice", "secret plans", before.Format("2006-01-02")} {
+			if bytes.Contains(data, []byte(leak)) {
+				t.Errorf("%s contains %q", path, leak)
+			}
+		}
+	}
+
+	// the message sent again is recognised with the keyed hash, its plain hash is not recorded
+	if result, err := m.deliver(newEnvelope()); result != nil {
+		t.Fatalf("expected the message sent again to be accepted, got %s (%v)", result, err)
+	}
+	if n := len(m.indexes["test"].since(0)); n != 1 {
+		t.Errorf("expected the message sent again to be skipped, got %d messages", n)
+	}
+	if plain := (&MailDir{}).messageHash(newEnvelope()); m.indexes["test"].delivered(plain) {
+		t.Error("the index records the plain hash of the message")
+	}
+
+	meta, err := OpenIndexMeta(entry.Meta, EnvelopeDecrypter(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(saved[0].filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != fi.Size() || meta.Date.Before(before.Add(-time.Second)) {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+}
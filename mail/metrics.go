@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queueDepthGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cryptomail",
+		Name:      "ipfs_queue_depth",
+		Help:      "Number of messages waiting to be stored in IPFS.",
+	}, func() float64 {
+		depth, _ := queueStats()
+		return float64(depth)
+	})
+	queueAgeGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cryptomail",
+		Name:      "ipfs_queue_oldest_seconds",
+		Help:      "Age of the oldest message waiting to be stored in IPFS.",
+	}, func() float64 {
+		_, age := queueStats()
+		return age.Seconds()
+	})
+)
+
+var (
+	statusProviders   = make(map[string]func() interface{})
+	statusProvidersMu sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(queueDepthGauge, queueAgeGauge)
+	RegisterStatus("ipfs_queue", func() interface{} {
+		depth, age := queueStats()
+		return map[string]interface{}{"depth": depth, "oldest_seconds": age.Seconds()}
+	})
+}
+
+// RegisterStatus adds a section to the /status document served next to the metrics.
+// f is called on every request.
+func RegisterStatus(name string, f func() interface{}) {
+	statusProvidersMu.Lock()
+	defer statusProvidersMu.Unlock()
+	statusProviders[name] = f
+}
+
+// serveStatus writes the status document as JSON
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	statusProvidersMu.Lock()
+	status := make(map[string]interface{}, len(statusProviders))
+	for name, f := range statusProviders {
+		status[name] = f()
+	}
+	statusProvidersMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// queueStats returns the total depth and the oldest age of all upload queues
+func queueStats() (depth int, age time.Duration) {
+	queues.each(func(v interface{}) {
+		q := v.(*uploadQueue)
+		depth += q.Depth()
+		if a := q.OldestAge(); a > age {
+			age = a
+		}
+	})
+	return
+}
+
+// serveMetrics exposes the prometheus metrics and the status document on addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", serveStatus)
+	mainlog.Infof("serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		mainlog.WithError(err).Error("metrics listener stopped")
+	}
+}
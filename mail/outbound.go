@@ -0,0 +1,151 @@
+package mail
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/pentateu/email-cloud-service/dkim"
+	"github.com/pentateu/email-cloud-service/kms"
+	"github.com/pentateu/email-cloud-service/relay"
+)
+
+// relays are the outbound queues opened, by path
+var relays registry
+
+// outboundSettings are the settings of a queue that only apply when it is opened
+type outboundSettings struct {
+	dkimKeys, dkimHeaders, tls, hostname string
+}
+
+// outboundRelay is an outbound queue opened
+type outboundRelay struct {
+	sync.Mutex
+	q *relay.Queue
+	// settings are the last settings seen, their changes are logged once
+	settings outboundSettings
+}
+
+// openRelay returns the outbound queue of outbound_queue_path, opened the first time.
+// The queue is running, a reload changing its DKIM keys, TLS mode or host name only logs that
+// a restart is needed.
+func openRelay(c *maildirConfig) (*relay.Queue, error) {
+	switch c.OutboundTLS {
+	case "":
+		c.OutboundTLS = relay.TLSOpportunistic
+	case relay.TLSNone, relay.TLSOpportunistic, relay.TLSRequired:
+	default:
+		return nil, fmt.Errorf("unknown outbound_tls mode %q", c.OutboundTLS)
+	}
+	settings := outboundSettings{c.OutboundDKIMKeys, c.OutboundDKIMHeaders, c.OutboundTLS, c.OutboundHostname}
+	v, err := relays.get(c.OutboundQueuePath, func() (interface{}, error) {
+		q, err := newRelay(c)
+		if err != nil {
+			return nil, err
+		}
+		return &outboundRelay{q: q, settings: settings}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := v.(*outboundRelay)
+	r.Lock()
+	defer r.Unlock()
+	if r.settings != settings {
+		backends.Log().Warnf("outbound_dkim_keys, outbound_dkim_headers, outbound_tls and outbound_hostname of %s apply after a restart", c.OutboundQueuePath)
+		r.settings = settings
+	}
+	return r.q, nil
+}
+
+// newRelay opens the outbound queue of outbound_queue_path, the service starts delivering it.
+// Messages are signed with the DKIM key of their From domain when outbound_dkim_keys has one.
+func newRelay(c *maildirConfig) (*relay.Queue, error) {
+	keys, err := dkimKeyring(c.OutboundDKIMKeys, c.OutboundDKIMHeaders)
+	if err != nil {
+		return nil, err
+	}
+	q, err := relay.Open(c.OutboundQueuePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		q.Sign = keys.Sign
+	}
+	if len(c.OutboundHostname) > 0 {
+		q.Hostname = c.OutboundHostname
+	}
+	q.TLS = c.OutboundTLS
+	q.OnFailure = func(id string, rcpt relay.Recipient) {
+		if rcpt.Address == "" {
+			backends.Log().Errorf("outbound message %s: %s", id, rcpt.Diagnostic)
+			return
+		}
+		backends.Log().Infof("outbound message %s to %s: %s %s (%s)", id, rcpt.Address, rcpt.Status, rcpt.Code, rcpt.Diagnostic)
+	}
+	return q, nil
+}
+
+// dkimKeyring parses outbound_dkim_keys, eg. "example.com=mail2026:/etc/cryptomail/example.com.pem",
+// loading the keys from their file or, for kms:<name>, from the KMS. A domain listed with several
+// selectors gets a signature for each.
+func dkimKeyring(spec, headers string) (dkim.Keyring, error) {
+	var names []string
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			names = append(names, h)
+		}
+	}
+	keys := make(dkim.Keyring)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		var selector, path string
+		if len(kv) == 2 {
+			if i := strings.IndexByte(kv[1], ':'); i > 0 {
+				selector, path = kv[1][:i], kv[1][i+1:]
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("invalid outbound_dkim_keys entry %q, expected domain=selector:path", entry)
+		}
+		key, err := dkimKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the DKIM key of %s: %s", kv[0], err)
+		}
+		s, err := dkim.NewSigner(strings.TrimSpace(kv[0]), selector, key, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range keys[s.Domain] {
+			if strings.EqualFold(other.Selector, s.Selector) {
+				return nil, fmt.Errorf("duplicate DKIM selector %s for %s", s.Selector, s.Domain)
+			}
+		}
+		keys.Add(s)
+	}
+	return keys, nil
+}
+
+// dkimKey loads a private key from a file, or from the KMS for kms:<name>
+func dkimKey(path string) (crypto.Signer, error) {
+	if name := strings.TrimPrefix(path, kms.SecretPrefix); name != path {
+		k, err := openKMS()
+		if err != nil {
+			return nil, err
+		}
+		return k.Signer(context.Background(), name)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return kms.ParsePrivateKey(data)
+}
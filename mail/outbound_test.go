@@ -0,0 +1,84 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboundDKIM(t *testing.T) {
+	dir, remove := testDir(t, "outbound")
+	defer remove()
+	ks, restore := testKMS(t, dir)
+	defer restore()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "example.com.pem")
+	der := x509.MarshalPKCS1PrivateKey(rsaKey)
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	if der, err = x509.MarshalPKCS8PrivateKey(edKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Import(context.Background(), "dkim-example.org", der); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"example.com", "example.com=:" + keyFile, "example.com=s1:" + filepath.Join(dir, "missing"),
+		"example.com=s1:kms:missing", "example.com=s1:" + keyFile + ",Example.com=S1:" + keyFile} {
+		if _, err := dkimKeyring(spec, ""); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+	keys, err := dkimKeyring("example.com=rsa:"+keyFile+",example.com=ed:kms:dkim-example.org", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys["example.com"]) != 2 {
+		t.Errorf("expected 2 signers for example.com, got %d", len(keys["example.com"]))
+	}
+	q, err := openRelay(&maildirConfig{
+		OutboundQueuePath:   filepath.Join(dir, "outbound"),
+		OutboundDKIMKeys:    "example.com=mail2026:" + keyFile + ", example.org=ed:kms:dkim-example.org",
+		OutboundDKIMHeaders: "Subject, To",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for from, want := range map[string]string{
+		"test@example.com": "a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=mail2026;",
+		"test@example.org": "a=ed25519-sha256; c=relaxed/relaxed; d=example.org; s=ed;",
+		"test@example.net": "",
+	} {
+		id, err := q.Enqueue(from, []string{"bob@remote.test"},
+			strings.NewReader("From: "+from+"\r\nTo: bob@remote.test\r\nSubject: x\r\n\r\nhi\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "outbound", id+".eml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = bytes.ReplaceAll(data, []byte(";\r\n\t"), []byte("; "))
+		if want == "" {
+			if !bytes.HasPrefix(data, []byte("From: ")) {
+				t.Errorf("%s: expected the message as it is, got %q", from, data)
+			}
+		} else if !bytes.HasPrefix(data, []byte("DKIM-Signature: v=1; "+want)) || !bytes.Contains(data, []byte("h=from:subject:to;")) {
+			t.Errorf("%s: unexpected signature %q", from, data)
+		}
+	}
+}
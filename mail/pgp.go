@@ -0,0 +1,195 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// pgpKey is an OpenPGP public key
+type pgpKey struct {
+	openpgp.EntityList
+}
+
+func (pgpKey) Scheme() string {
+	return SchemePGP
+}
+
+// pgpEncryption writes PGP/MIME (RFC 3156) messages, for clients that only read OpenPGP mail.
+// The original message, headers included, is the encrypted MIME entity. The outer message
+// keeps the original headers, except the ones describing the content, so clients can list it.
+// Keys are the path to an armored public key, every key of the file must be able to encrypt.
+type pgpEncryption struct{}
+
+func (pgpEncryption) ParseKey(s string) (AccountKey, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	el, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, e := range el {
+		// signing only keys, or keys whose encryption subkeys expired, would fail every message
+		if _, ok := e.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("OpenPGP key %X in %s can't encrypt", e.PrimaryKey.Fingerprint, s)
+		}
+	}
+	return pgpKey{el}, nil
+}
+
+func (pgpEncryption) Encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error) {
+	to := make([]*openpgp.Entity, 0, len(keys))
+	for i := range keys {
+		k, ok := keys[i].(pgpKey)
+		if !ok {
+			return nil, errKeyScheme
+		}
+		to = append(to, k.EntityList...)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &pgpMIMEWriter{w: w, to: to, boundary: "cryptomail-" + hex.EncodeToString(b)}, nil
+}
+
+func (pgpEncryption) Shared() bool {
+	return true
+}
+
+// pgpMIMEWriter buffers the header section of the message to write the outer headers,
+// then streams the whole message to the OpenPGP encryption
+type pgpMIMEWriter struct {
+	w        io.Writer
+	to       []*openpgp.Entity
+	boundary string
+	header   bytes.Buffer
+	armor    io.WriteCloser
+	body     io.WriteCloser
+}
+
+func (p *pgpMIMEWriter) Write(b []byte) (int, error) {
+	if p.body != nil {
+		return p.body.Write(b)
+	}
+	p.header.Write(b)
+	if _, _, ok := splitHeader(p.header.Bytes()); ok || p.header.Len() > maxHeaderSize {
+		if err := p.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start writes the outer message up to the encrypted part and the buffered data to the encryption
+func (p *pgpMIMEWriter) start() error {
+	header, _, _ := splitHeader(p.header.Bytes())
+	outer := &bytes.Buffer{}
+	for _, f := range headerFields(header) {
+		name := fieldName(f)
+		if strings.HasPrefix(name, "content-") || name == "mime-version" {
+			continue
+		}
+		outer.WriteString(strings.TrimRight(f, "\r\n") + "\r\n")
+	}
+	fmt.Fprintf(outer, "MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"%s\"\r\n"+
+		"\r\n"+
+		"This is an OpenPGP/MIME encrypted message (RFC 3156)\r\n"+
+		"--%s\r\n"+
+		"Content-Type: application/pgp-encrypted\r\n"+
+		"Content-Description: PGP/MIME version identification\r\n"+
+		"\r\n"+
+		"Version: 1\r\n"+
+		"\r\n"+
+		"--%s\r\n"+
+		"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n"+
+		"Content-Description: OpenPGP encrypted message\r\n"+
+		"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n"+
+		"\r\n", p.boundary, p.boundary, p.boundary)
+	if _, err := p.w.Write(outer.Bytes()); err != nil {
+		return err
+	}
+	var err error
+	if p.armor, err = armor.Encode(p.w, "PGP MESSAGE", nil); err != nil {
+		return err
+	}
+	if p.body, err = openpgp.Encrypt(p.armor, p.to, nil, nil, nil); err != nil {
+		return err
+	}
+	_, err = p.body.Write(p.header.Bytes())
+	p.header = bytes.Buffer{}
+	return err
+}
+
+func (p *pgpMIMEWriter) Close() error {
+	if p.body == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	if err := p.body.Close(); err != nil {
+		return err
+	}
+	if err := p.armor.Close(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(p.w, "\r\n\r\n--%s--\r\n", p.boundary)
+	return err
+}
+
+// PGPDecrypter decrypts PGP/MIME messages of the pgp scheme with keyring, it returns the
+// original message
+func PGPDecrypter(keyring openpgp.KeyRing) Decrypter {
+	return func(r io.Reader) (io.Reader, error) {
+		msg, err := netmail.ReadMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+		if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+			return nil, errors.New("not a PGP/MIME message")
+		}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, errors.New("PGP/MIME message without encrypted part")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if t, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); t != "application/octet-stream" {
+				continue
+			}
+			block, err := armor.Decode(part)
+			if err != nil {
+				return nil, err
+			}
+			md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			return md.UnverifiedBody, nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestPGPMIME(t *testing.T) {
+	dir, remove := testDir(t, "pgp")
+	defer remove()
+	entity, keyPath := testPGPKey(t, dir, "test")
+
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:        "test=-1:-1",
+		EncryptionKeys: "test=pgp:" + keyPath,
+	})
+
+	const msg = "From: alice@example.com\r\n" +
+		"To: test@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"body\r\n"
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(msg)
+	e.RcptTo = []mail.Address{{User: "test"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(saved[0].filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer, err := netmail.ReadMessage(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outer.Header.Get("Subject") != "hello" || outer.Header.Get("From") != "alice@example.com" {
+		t.Errorf("expected the original headers on the outer message, got %v", outer.Header)
+	}
+	mediaType, params, err := mime.ParseMediaType(outer.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("expected a PGP/MIME message, got %s %v", mediaType, params)
+	}
+	if bytes.Contains(stored, []byte("text/plain")) || bytes.Contains(stored, []byte("body")) {
+		t.Error("the original content is visible in the stored message")
+	}
+
+	r, err := PGPDecrypter(openpgp.EntityList{entity})(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(inner) != msg {
+		t.Errorf("expected the original message as the inner entity, got %q", inner)
+	}
+
+	// a key without an encryption subkey is refused when it is loaded
+	entity.Subkeys = nil
+	signingPath := filepath.Join(dir, "signing.asc")
+	writePGPKey(t, entity, signingPath)
+	if _, err := (pgpEncryption{}).ParseKey(signingPath); err == nil || !strings.Contains(err.Error(), "can't encrypt") {
+		t.Error("expected a signing only key to be refused, got", err)
+	}
+}
+
+func TestSplitHeader(t *testing.T) {
+	cases := []struct {
+		in     string
+		header string
+		size   int
+		ok     bool
+	}{
+		{"Subject: a\r\n\r\nbody", "Subject: a\r\n", 14, true},
+		{"Subject: a\n\nbody", "Subject: a\n", 12, true},
+		{"\r\nbody", "", 2, true},
+		{"Subject: a\r\nFrom: b", "", 0, false},
+	}
+	for _, c := range cases {
+		header, size, ok := splitHeader([]byte(c.in))
+		if string(header) != c.header || size != c.size || ok != c.ok {
+			t.Errorf("splitHeader(%q) = %q, %d, %v", c.in, header, size, ok)
+		}
+	}
+	fields := headerFields([]byte("Subject: a\r\n folded\r\nFrom: b\r\n"))
+	if len(fields) != 2 || fieldName(fields[0]) != "subject" || fieldValue(fields[0]) != "a folded" {
+		t.Errorf("unexpected fields %q", fields)
+	}
+}
@@ -0,0 +1,259 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+const (
+	// defaultQueuePath is used when ipfs_queue_path is not configured
+	defaultQueuePath = "/var/spool/cryptomail/queue"
+
+	queueMinBackoff = 5 * time.Second
+	queueMaxBackoff = time.Hour
+	jobFileExt      = ".job"
+)
+
+// uploadJob is a message saved in the Maildir that still has to be stored in IPFS
+type uploadJob struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Filename    string    `json:"filename"`
+	Seq         uint64    `json:"seq"`
+	Enqueued    time.Time `json:"enqueued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// uploadQueue is a persistent queue of messages to upload to IPFS.
+// Each job is a file in the queue directory, so pending uploads survive restarts.
+type uploadQueue struct {
+	dir    string
+	mu     sync.Mutex
+	jobs   map[string]*uploadJob
+	upload func(j *uploadJob) error
+	wake   chan struct{}
+	start  sync.Once
+}
+
+// queues are the upload queues opened, by dir
+var queues registry
+
+// openQueue returns the queue stored in dir, loaded the first time
+func openQueue(dir string) (*uploadQueue, error) {
+	v, err := queues.get(dir, func() (interface{}, error) {
+		return loadQueue(dir)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*uploadQueue), nil
+}
+
+// loadQueue loads the queue stored in dir, creating the directory if needed
+func loadQueue(dir string) (*uploadQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &uploadQueue{dir: dir, jobs: make(map[string]*uploadJob), wake: make(chan struct{}, 1)}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+jobFileExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		j := &uploadJob{}
+		if err := json.Unmarshal(data, j); err != nil {
+			backends.Log().WithError(err).Error("skipping corrupt upload job ", name)
+			continue
+		}
+		q.jobs[j.ID] = j
+	}
+	return q, nil
+}
+
+// setUploader sets the function that stores a job in IPFS and starts the queue worker.
+// The latest uploader wins, eg. after a config reload.
+func (q *uploadQueue) setUploader(upload func(j *uploadJob) error) {
+	q.mu.Lock()
+	q.upload = upload
+	q.mu.Unlock()
+	q.start.Do(func() {
+		go q.run(context.Background())
+	})
+	q.notify()
+}
+
+// push persists j and wakes up the worker
+func (q *uploadQueue) push(j *uploadJob) error {
+	if j.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		j.ID = hex.EncodeToString(b)
+	}
+	if j.Enqueued.IsZero() {
+		j.Enqueued = time.Now()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.save(j); err != nil {
+		return err
+	}
+	q.jobs[j.ID] = j
+	q.notify()
+	return nil
+}
+
+func (q *uploadQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the job file, the caller must hold the lock
+func (q *uploadQueue) save(j *uploadJob) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(q.dir, j.ID+jobFileExt)
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// the message was accepted once the job is on disk
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Depth returns the number of pending uploads
+func (q *uploadQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// OldestAge returns how long the oldest pending upload has been waiting
+func (q *uploadQueue) OldestAge() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var oldest time.Time
+	for _, j := range q.jobs {
+		if oldest.IsZero() || j.Enqueued.Before(oldest) {
+			oldest = j.Enqueued
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// due returns the jobs ready to be attempted and when the next one becomes ready
+func (q *uploadQueue) due(now time.Time) ([]*uploadJob, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ready := make([]*uploadJob, 0)
+	var next time.Time
+	for _, j := range q.jobs {
+		if !j.NextAttempt.After(now) {
+			ready = append(ready, j)
+		} else if next.IsZero() || j.NextAttempt.Before(next) {
+			next = j.NextAttempt
+		}
+	}
+	return ready, next
+}
+
+// run uploads the due jobs until ctx is done
+func (q *uploadQueue) run(ctx context.Context) {
+	for {
+		ready, next := q.due(time.Now())
+		for _, j := range ready {
+			q.attempt(j)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+		wait := queueMaxBackoff
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-q.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// attempt uploads j, removing it from the queue on success or scheduling a retry with exponential backoff
+func (q *uploadQueue) attempt(j *uploadJob) {
+	q.mu.Lock()
+	upload := q.upload
+	q.mu.Unlock()
+	err := upload(j)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil || os.IsNotExist(err) {
+		if os.IsNotExist(err) {
+			backends.Log().WithError(err).Error("dropping upload of a message no longer in the Maildir")
+		}
+		delete(q.jobs, j.ID)
+		if err := os.Remove(filepath.Join(q.dir, j.ID+jobFileExt)); err != nil && !os.IsNotExist(err) {
+			backends.Log().WithError(err).Error("could not remove upload job ", j.ID)
+		}
+		return
+	}
+	j.Attempts++
+	j.LastError = err.Error()
+	j.NextAttempt = time.Now().Add(queueBackoff(j.Attempts))
+	backends.Log().WithError(err).Infof("upload of %s failed, attempt %d, retrying at %s",
+		j.Filename, j.Attempts, j.NextAttempt.Format(time.RFC3339))
+	if err := q.save(j); err != nil {
+		backends.Log().WithError(err).Error("could not update upload job ", j.ID)
+	}
+}
+
+// queueBackoff returns the delay before the next attempt, doubling from queueMinBackoff up to queueMaxBackoff
+func queueBackoff(attempts int) time.Duration {
+	d := queueMinBackoff
+	for i := 1; i < attempts && d < queueMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > queueMaxBackoff {
+		d = queueMaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadQueueSurvivesRestart(t *testing.T) {
+	dir, remove := testDir(t, "queue")
+	defer remove()
+
+	q, err := openQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &uploadJob{User: "test", Filename: "/tmp/msg", Seq: 1}
+	if err := q.push(job); err != nil {
+		t.Fatal(err)
+	}
+	if q.Depth() != 1 {
+		t.Fatal("expected 1 pending upload, got", q.Depth())
+	}
+
+	// IPFS is down, the job is scheduled for a retry
+	q.upload = func(j *uploadJob) error { return errors.New("no route to DHT") }
+	ready, _ := q.due(time.Now())
+	q.attempt(ready[0])
+	ready, next := q.due(time.Now())
+	if len(ready) != 0 || next.Before(time.Now().Add(queueMinBackoff/2)) {
+		t.Fatal("failed upload was not delayed by the backoff")
+	}
+
+	// simulate a restart
+	queues.forget(dir)
+	q, err = openQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Depth() != 1 || q.OldestAge() <= 0 {
+		t.Fatalf("pending upload lost on restart, depth %d age %s", q.Depth(), q.OldestAge())
+	}
+	j, ok := q.jobs[job.ID]
+	if !ok || j.Attempts != 1 || j.LastError == "" {
+		t.Fatalf("attempts not persisted %+v", j)
+	}
+
+	uploaded := ""
+	q.upload = func(j *uploadJob) error {
+		uploaded = j.Filename
+		return nil
+	}
+	q.attempt(j)
+	if uploaded != "/tmp/msg" || q.Depth() != 0 || q.OldestAge() != 0 {
+		t.Error("job was not uploaded and removed from the queue")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Error("job files left behind", names)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	if queueBackoff(1) != queueMinBackoff || queueBackoff(2) != 2*queueMinBackoff {
+		t.Error("backoff does not double from the minimum")
+	}
+	if queueBackoff(100) != queueMaxBackoff {
+		t.Error("backoff is not capped")
+	}
+}
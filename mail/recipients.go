@@ -0,0 +1,165 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// maxAliasDepth is how deep aliases can point at other aliases
+const maxAliasDepth = 8
+
+// target is an account a recipient is delivered to, with the tag of its subaddress
+type target struct {
+	account string
+	tag     string
+}
+
+// aliasMap parses maildir_alias_map and returns the accounts of each alias, once each and in
+// the order they are listed. An alias points at accounts or at other aliases.
+// Each record separated by ","
+// Records have the following format: <alias>=<target>[|<target>...]
+// alias is a local part, for every domain, or a full address
+// Example: "postmaster=test,team@example.com=test|guerrilla|postmaster"
+func aliasMap(aliases string, userMap map[string][]int) (map[string][]string, error) {
+	targets := make(map[string][]string)
+	if len(aliases) == 0 {
+		return targets, nil
+	}
+	records := strings.Split(aliases, ",")
+	for i := range records {
+		r := strings.Split(records[i], "=")
+		if len(r) != 2 || len(strings.TrimSpace(r[0])) == 0 {
+			return nil, fmt.Errorf("invalid alias record %q", records[i])
+		}
+		alias := strings.ToLower(strings.TrimSpace(r[0]))
+		if _, ok := userMap[alias]; ok {
+			return nil, fmt.Errorf("alias [%s] is an account", alias)
+		}
+		if _, ok := targets[alias]; ok {
+			return nil, fmt.Errorf("alias [%s] is listed twice", alias)
+		}
+		for _, t := range strings.Split(r[1], "|") {
+			if t = strings.ToLower(strings.TrimSpace(t)); len(t) > 0 {
+				targets[alias] = append(targets[alias], t)
+			}
+		}
+		if len(targets[alias]) == 0 {
+			return nil, fmt.Errorf("alias [%s] has no target", alias)
+		}
+	}
+	ret := make(map[string][]string, len(targets))
+	for alias := range targets {
+		accounts, err := expandAlias(alias, targets, userMap, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret[alias] = accounts
+	}
+	return ret, nil
+}
+
+// expandAlias returns the accounts alias points at, appended to accounts when not listed yet
+func expandAlias(alias string, targets map[string][]string, userMap map[string][]int, depth int, accounts []string) ([]string, error) {
+	if depth > maxAliasDepth {
+		return nil, fmt.Errorf("alias [%s] is part of a loop or nested too deep", alias)
+	}
+	for _, t := range targets[alias] {
+		if _, ok := userMap[t]; ok {
+			if !contains(accounts, t) {
+				accounts = append(accounts, t)
+			}
+			continue
+		}
+		if _, ok := targets[t]; !ok {
+			return nil, fmt.Errorf("alias [%s] points at [%s], which is not an account or an alias", alias, t)
+		}
+		var err error
+		if accounts, err = expandAlias(t, targets, userMap, depth+1, accounts); err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// catchAll parses maildir_catch_all, the account getting the mail to unknown recipients of a domain
+// Each record separated by ","
+// Records have the following format: <domain>=<username>
+// Example: "example.com=test,example.org=guerrilla"
+func catchAll(domains string, userMap map[string][]int) (map[string]string, error) {
+	ret := make(map[string]string)
+	if len(domains) == 0 {
+		return ret, nil
+	}
+	records := strings.Split(domains, ",")
+	for i := range records {
+		r := strings.Split(records[i], "=")
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid catch-all record %q", records[i])
+		}
+		domain, u := strings.ToLower(strings.TrimSpace(r[0])), strings.ToLower(strings.TrimSpace(r[1]))
+		if _, ok := userMap[u]; !ok {
+			return nil, fmt.Errorf("catch-all of [%s] is not an account: [%s]", domain, u)
+		}
+		ret[domain] = u
+	}
+	return ret, nil
+}
+
+// targets returns the accounts mail to addr is delivered to, none if it must be refused.
+// In order: the account or per-correspondent alias of the local part, with its subaddress,
+// the aliases of maildir_alias_map for the address then the local part, and the catch-all
+// of the domain.
+func (m *MailDir) targets(addr *mail.Address) []target {
+	if ret := m.addressTargets(addr); len(ret) > 0 {
+		return ret
+	}
+	if a, ok := m.catchAll[strings.ToLower(addr.Host)]; ok {
+		return []target{{account: a}}
+	}
+	return nil
+}
+
+// addressTargets returns the accounts of addr itself, without the catch-all
+func (m *MailDir) addressTargets(addr *mail.Address) []target {
+	if a, tag, ok := m.account(addr.User); ok {
+		return []target{{account: a, tag: tag}}
+	}
+	u, host := strings.ToLower(addr.User), strings.ToLower(addr.Host)
+	locals := []target{{account: u}}
+	if base, tag := m.subaddress(u); tag != "" {
+		locals = append(locals, target{account: base, tag: tag})
+	}
+	for _, local := range locals {
+		accounts, ok := m.aliasMap[local.account+"@"+host]
+		if !ok {
+			accounts, ok = m.aliasMap[local.account]
+		}
+		if ok {
+			ret := make([]target, len(accounts))
+			for i := range accounts {
+				ret[i] = target{account: accounts[i], tag: local.tag}
+			}
+			return ret
+		}
+	}
+	return nil
+}
+
+// owns tells if account may send mail as addr: the address is delivered to the account only,
+// as the account itself, one of its per-correspondent aliases or an alias of maildir_alias_map
+// with no other account, but not through a catch-all. The members of a list can't send as it.
+func (m *MailDir) owns(account string, addr *mail.Address) bool {
+	t := m.addressTargets(addr)
+	return len(t) == 1 && t[0].account == account
+}
@@ -0,0 +1,89 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAliasMap(t *testing.T) {
+	users := usermap("test=-1:-1,guerrilla=-1:-1,flashmob=-1:-1")
+	for _, bad := range []string{
+		"postmaster",
+		"test=guerrilla",
+		"postmaster=nobody",
+		"a=b,b=a",
+		"a=test,a=guerrilla",
+		"a= | ",
+	} {
+		if _, err := aliasMap(bad, users); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	aliases, err := aliasMap("postmaster=test,team=guerrilla|postmaster|test,all=team|flashmob", users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aliases["all"]; len(got) != 3 || got[0] != "guerrilla" || got[1] != "test" || got[2] != "flashmob" {
+		t.Errorf("unexpected expansion %v", got)
+	}
+	if _, err := catchAll("example.com=nobody", users); err == nil {
+		t.Error("expected an error for a catch-all that is not an account")
+	}
+}
+
+func TestTargets(t *testing.T) {
+	dir, remove := testDir(t, "targets")
+	defer remove()
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:              "test=-1:-1,guerrilla=-1:-1",
+		AliasMap:             "postmaster=test,team@example.com=test|guerrilla,team@example.org=guerrilla",
+		CatchAll:             "example.net=guerrilla",
+		SubaddressSeparators: "+",
+	})
+
+	for _, c := range []struct {
+		addr     mail.Address
+		accounts []string
+	}{
+		{mail.Address{User: "test", Host: "example.net"}, []string{"test"}},
+		{mail.Address{User: "Postmaster", Host: "example.com"}, []string{"test"}},
+		{mail.Address{User: "team", Host: "Example.com"}, []string{"test", "guerrilla"}},
+		{mail.Address{User: "team+x", Host: "example.com"}, []string{"test", "guerrilla"}},
+		{mail.Address{User: "team", Host: "example.org"}, []string{"guerrilla"}},
+		{mail.Address{User: "team", Host: "example.info"}, nil},
+		{mail.Address{User: "anyone", Host: "example.net"}, []string{"guerrilla"}},
+		{mail.Address{User: "anyone", Host: "example.com"}, nil},
+	} {
+		targets := m.targets(&c.addr)
+		ok := len(targets) == len(c.accounts)
+		for i := 0; ok && i < len(targets); i++ {
+			ok = targets[i].account == c.accounts[i]
+		}
+		if !ok {
+			t.Errorf("targets(%s) = %+v, expected %v", c.addr.String(), targets, c.accounts)
+		}
+	}
+	if err := m.validateRcpt(&mail.Address{User: "anyone", Host: "example.com"}); err != backends.NoSuchUser {
+		t.Errorf("expected NoSuchUser, got %v", err)
+	}
+	if err := m.validateRcpt(&mail.Address{User: "anyone", Host: "example.net"}); err != nil {
+		t.Errorf("catch-all rejected: %v", err)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hello\r\n\r\nbody\r\n")
+	e.RcptTo = []mail.Address{
+		{User: "team", Host: "example.com"},
+		{User: "postmaster", Host: "example.com"},
+		{User: "guerrilla", Host: "example.com"},
+	}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].user == saved[1].user {
+		t.Errorf("expected one copy for each account, got %+v", saved)
+	}
+}
@@ -0,0 +1,44 @@
+package mail
+
+import "sync"
+
+// registry holds the instances of a kind opened by the process, by path or config. The backend
+// workers share them, so they see the same state and serialize their changes on the same lock.
+type registry struct {
+	sync.Mutex
+	instances map[string]interface{}
+}
+
+// get returns the instance of key, opened with open the first time
+func (r *registry) get(key string, open func() (interface{}, error)) (interface{}, error) {
+	r.Lock()
+	defer r.Unlock()
+	if v, ok := r.instances[key]; ok {
+		return v, nil
+	}
+	v, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if r.instances == nil {
+		r.instances = make(map[string]interface{})
+	}
+	r.instances[key] = v
+	return v, nil
+}
+
+// forget drops the instance of key, the next get opens it again
+func (r *registry) forget(key string) {
+	r.Lock()
+	delete(r.instances, key)
+	r.Unlock()
+}
+
+// each calls f with every instance, no instance is opened meanwhile
+func (r *registry) each(f func(v interface{})) {
+	r.Lock()
+	defer r.Unlock()
+	for _, v := range r.instances {
+		f(v)
+	}
+}
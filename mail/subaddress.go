@@ -0,0 +1,75 @@
+package mail
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	maildir "github.com/pentateu/go-crypto-maildir"
+)
+
+// folderTag is a tag that can name a Maildir folder, other tags are delivered to the inbox
+var folderTag = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+var errSubaddressFolders = errors.New("maildir_subaddress_folders is set but folder names are stored in clear")
+
+// subaddressFolders caches the folders of the subaddress tags, created on demand
+var subaddressFolders = struct {
+	sync.Mutex
+	dirs map[string]*maildir.Maildir
+}{dirs: make(map[string]*maildir.Maildir)}
+
+// checkSubaddress makes sure subaddress folders don't reveal the tags when the metadata is protected
+func (m *MailDir) checkSubaddress() error {
+	if m.config.SubaddressFolders && m.config.ProtectMetadata {
+		return errSubaddressFolders
+	}
+	return nil
+}
+
+// subaddress splits the local part user at the first of maildir_subaddress_separators,
+// eg. test+news gives test and news. tag is empty when user has no separator.
+func (m *MailDir) subaddress(user string) (base, tag string) {
+	if len(m.config.SubaddressSeparators) == 0 {
+		return user, ""
+	}
+	i := strings.IndexAny(user, m.config.SubaddressSeparators)
+	if i <= 0 {
+		return user, ""
+	}
+	return user[:i], user[i+1:]
+}
+
+// folder returns the Maildir folder a message to the subaddress tag is delivered to,
+// empty for the inbox. Only tags made of letters, digits, '.', '_' and '-' get a folder.
+func (m *MailDir) folder(tag string) string {
+	if !m.config.SubaddressFolders {
+		return ""
+	}
+	tag = strings.ToLower(tag)
+	if !folderTag.MatchString(tag) {
+		return ""
+	}
+	return tag
+}
+
+// mailbox returns the Maildir of account u or its folder, created on demand. Folders are
+// Maildir++ children of the account Maildir, owned by the uid and gid of the user map.
+func (m *MailDir) mailbox(u, folder string) (*maildir.Maildir, error) {
+	if folder == "" {
+		return m.dirs[u], nil
+	}
+	key := m.dirs[u].Path + "\x00" + folder
+	subaddressFolders.Lock()
+	defer subaddressFolders.Unlock()
+	if mdir, ok := subaddressFolders.dirs[key]; ok {
+		return mdir, nil
+	}
+	mdir, err := m.dirs[u].Child(folder, true)
+	if err != nil {
+		return nil, err
+	}
+	subaddressFolders.dirs[key] = mdir
+	return mdir, nil
+}
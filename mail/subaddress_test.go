@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestSubaddress(t *testing.T) {
+	dir, remove := testDir(t, "subaddress")
+	defer remove()
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:              "test=-1:-1,guerrilla=-1:-1,a+b=-1:-1",
+		SubaddressSeparators: "+-",
+		SubaddressFolders:    true,
+	})
+
+	for _, c := range []struct {
+		user, account, tag string
+	}{
+		{"test", "test", ""},
+		{"test+news", "test", "news"},
+		{"Test-Lists+x", "test", "lists+x"},
+		{"a+b", "a+b", ""},
+		{"a+c", "", ""},
+		{"+news", "", ""},
+	} {
+		a, tag, ok := m.account(c.user)
+		if a != c.account || tag != c.tag || ok != (c.account != "") {
+			t.Errorf("account(%q) = %q, %q, %v", c.user, a, tag, ok)
+		}
+	}
+	if err := m.validateRcpt(&mail.Address{User: "test+news"}); err != nil {
+		t.Errorf("subaddress rejected: %v", err)
+	}
+	if err := m.validateRcpt(&mail.Address{User: "nobody+news"}); err != backends.NoSuchUser {
+		t.Errorf("expected NoSuchUser, got %v", err)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hello\r\n\r\nbody\r\n")
+	e.RcptTo = []mail.Address{{User: "test+News"}, {User: "test"}, {User: "guerrilla+../x"}}
+	saved, err := m.save(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 deliveries, got %+v", saved)
+	}
+	for _, d := range saved {
+		switch d.user {
+		case "test":
+			if d.folder != "news" || !strings.HasPrefix(d.filename, filepath.Join(dir, "test", ".news", "new")) {
+				t.Errorf("expected a delivery to the news folder, got %+v", d)
+			}
+		case "guerrilla":
+			if d.folder != "" || !strings.HasPrefix(d.filename, filepath.Join(dir, "guerrilla", "new")) {
+				t.Errorf("expected a delivery to the inbox, got %+v", d)
+			}
+		}
+		if _, err := os.Stat(d.filename); err != nil {
+			t.Error(err)
+		}
+	}
+
+	m.config.ProtectMetadata = true
+	if err := m.checkSubaddress(); err != errSubaddressFolders {
+		t.Errorf("expected errSubaddressFolders, got %v", err)
+	}
+}
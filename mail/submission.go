@@ -0,0 +1,555 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	// submissionMaxRcpts is the number of recipients of a submitted message
+	submissionMaxRcpts = 100
+	// submissionMaxAuthFailures closes the connection after that many failed AUTH commands
+	submissionMaxAuthFailures = 3
+	// submissionMaxSize is the max_size of a listener without one, messages are read in memory
+	submissionMaxSize = 10 << 20
+)
+
+// submissionConfig is a listener of submission_servers in the configuration file, the
+// servers users send their mail through. tls is a tls block as in servers: start_tls_on
+// offers STARTTLS, on port 587, and tls_always_on is implicit TLS, on port 465.
+type submissionConfig struct {
+	IsEnabled       bool                      `json:"is_enabled"`
+	Hostname        string                    `json:"host_name"`
+	ListenInterface string                    `json:"listen_interface"`
+	MaxSize         int64                     `json:"max_size"`
+	Timeout         int                       `json:"timeout"`
+	MaxClients      int                       `json:"max_clients"`
+	TLS             guerrilla.ServerTLSConfig `json:"tls"`
+}
+
+// submission holds the submission listeners, one set per process. They hand the messages
+// to the MailDir of the last configuration.
+var submission struct {
+	sync.Mutex
+	servers []*submissionServer
+	m       *MailDir
+	started bool
+}
+
+// readSubmissionConfig reads submission_servers of the configuration file at path.
+// allowedHosts are the local domains, users can only send from addresses of these domains.
+func readSubmissionConfig(path string, allowedHosts []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c := struct {
+		Servers []submissionConfig `json:"submission_servers"`
+	}{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	servers := make([]*submissionServer, 0, len(c.Servers))
+	for _, sc := range c.Servers {
+		if !sc.IsEnabled {
+			continue
+		}
+		s, err := newSubmissionServer(sc, allowedHosts)
+		if err != nil {
+			return fmt.Errorf("submission server %s: %s", sc.ListenInterface, err)
+		}
+		servers = append(servers, s)
+	}
+	submission.Lock()
+	defer submission.Unlock()
+	submission.servers = servers
+	return nil
+}
+
+// serveSubmission starts the submission listeners the first time, later calls, eg. after
+// a config reload, replace the MailDir they hand the messages to. A MailDir without outbound
+// queue or credentials is not used, the listeners keep the previous one.
+func (m *MailDir) serveSubmission() {
+	submission.Lock()
+	defer submission.Unlock()
+	if len(submission.servers) == 0 {
+		return
+	}
+	if m.relay == nil || m.credentials == nil {
+		if submission.started {
+			backends.Log().Error("submission servers need outbound_queue_path and maildir_credentials_path, keeping the previous configuration")
+		} else {
+			backends.Log().Error("submission servers need outbound_queue_path and maildir_credentials_path, not starting them")
+		}
+		return
+	}
+	submission.m = m
+	if submission.started {
+		return
+	}
+	submission.started = true
+	for _, s := range submission.servers {
+		l, err := s.listen()
+		if err != nil {
+			backends.Log().WithError(err).Error("could not start the submission server on ", s.config.ListenInterface)
+			continue
+		}
+		backends.Log().Infof("serving submission on %s", s.config.ListenInterface)
+		go s.serve(l)
+	}
+}
+
+// submissionMailDir returns the MailDir of the last configuration
+func submissionMailDir() *MailDir {
+	submission.Lock()
+	defer submission.Unlock()
+	return submission.m
+}
+
+// submissionServer is an SMTP server for the accounts, requiring AUTH over TLS
+type submissionServer struct {
+	config  submissionConfig
+	tls     *tls.Config
+	hosts   []string
+	mailDir func() *MailDir
+	clients chan struct{}
+}
+
+func newSubmissionServer(c submissionConfig, allowedHosts []string) (*submissionServer, error) {
+	if !c.TLS.StartTLSOn && !c.TLS.AlwaysOn {
+		return nil, errors.New("tls needs start_tls_on or tls_always_on, credentials are never sent in clear")
+	}
+	if c.Hostname == "" {
+		c.Hostname = "localhost"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 180
+	}
+	if c.MaxClients <= 0 {
+		c.MaxClients = 100
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = submissionMaxSize
+	}
+	cfg, err := submissionTLS(&c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(allowedHosts))
+	for i := range allowedHosts {
+		hosts[i] = strings.ToLower(allowedHosts[i])
+	}
+	return &submissionServer{
+		config:  c,
+		tls:     cfg,
+		hosts:   hosts,
+		mailDir: submissionMailDir,
+		clients: make(chan struct{}, c.MaxClients),
+	}, nil
+}
+
+// submissionTLS returns the TLS config of a tls block, as the servers use it
+func submissionTLS(c *guerrilla.ServerTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.PublicKeyFile, c.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+	}
+	if len(c.Protocols) > 0 {
+		cfg.MinVersion = guerrilla.TLSProtocols[c.Protocols[0]]
+	}
+	if len(c.Protocols) > 1 {
+		cfg.MaxVersion = guerrilla.TLSProtocols[c.Protocols[1]]
+	}
+	for _, name := range c.Ciphers {
+		if id, ok := guerrilla.TLSCiphers[name]; ok {
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	for _, name := range c.Curves {
+		if id, ok := guerrilla.TLSCurves[name]; ok {
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	return cfg, nil
+}
+
+func (s *submissionServer) listen() (net.Listener, error) {
+	if s.config.TLS.AlwaysOn {
+		return tls.Listen("tcp", s.config.ListenInterface, s.tls)
+	}
+	return net.Listen("tcp", s.config.ListenInterface)
+}
+
+// serve accepts connections on l until it is closed
+func (s *submissionServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		select {
+		case s.clients <- struct{}{}:
+			go func() {
+				defer func() { <-s.clients }()
+				s.handle(conn)
+			}()
+		default:
+			conn.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+			conn.Close()
+		}
+	}
+}
+
+// localDomain tells if host is one of the allowed_hosts
+func (s *submissionServer) localDomain(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range s.hosts {
+		if h == "." || h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// submissionSession is the state of a submission connection
+type submissionSession struct {
+	s       *submissionServer
+	conn    net.Conn
+	tp      *textproto.Conn
+	tls     bool
+	helo    string
+	account string
+	from    string
+	rcpts   []string
+}
+
+func (ss *submissionSession) reply(format string, args ...interface{}) {
+	ss.tp.PrintfLine(format, args...)
+}
+
+func (ss *submissionSession) reset() {
+	ss.from, ss.rcpts = "", nil
+}
+
+// handle runs the SMTP session of conn
+func (s *submissionServer) handle(conn net.Conn) {
+	defer conn.Close()
+	ss := &submissionSession{s: s, conn: conn, tp: textproto.NewConn(conn)}
+	_, ss.tls = conn.(*tls.Conn)
+	timeout := time.Duration(s.config.Timeout) * time.Second
+	conn.SetDeadline(time.Now().Add(timeout))
+	ss.reply("220 %s ESMTP cryptomail submission", s.config.Hostname)
+	failures := 0
+	for {
+		conn.SetDeadline(time.Now().Add(timeout))
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ss.ehlo(strings.ToUpper(verb), arg)
+		case "STARTTLS":
+			if !ss.startTLS() {
+				return
+			}
+		case "AUTH":
+			if !ss.auth(arg) {
+				if failures++; failures >= submissionMaxAuthFailures {
+					ss.reply("421 4.7.0 Too many authentication failures")
+					return
+				}
+			}
+		case "MAIL":
+			ss.mail(arg)
+		case "RCPT":
+			ss.rcpt(arg)
+		case "DATA":
+			if !ss.data() {
+				return
+			}
+		case "RSET":
+			ss.reset()
+			ss.reply("250 2.0.0 Ok")
+		case "NOOP":
+			ss.reply("250 2.0.0 Ok")
+		case "QUIT":
+			ss.reply("221 2.0.0 Bye")
+			return
+		default:
+			ss.reply("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (ss *submissionSession) ehlo(verb, helo string) {
+	if helo == "" {
+		ss.reply("501 5.5.4 Syntax: %s hostname", verb)
+		return
+	}
+	ss.helo = helo
+	ss.reset()
+	if verb == "HELO" {
+		ss.reply("250 %s", ss.s.config.Hostname)
+		return
+	}
+	lines := []string{ss.s.config.Hostname, "8BITMIME", "ENHANCEDSTATUSCODES", fmt.Sprintf("SIZE %d", ss.s.config.MaxSize)}
+	if ss.tls {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	} else if ss.s.config.TLS.StartTLSOn {
+		lines = append(lines, "STARTTLS")
+	}
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		ss.reply("250%s%s", sep, l)
+	}
+}
+
+// startTLS upgrades the connection, it returns false when the connection must be closed
+func (ss *submissionSession) startTLS() bool {
+	if ss.tls || !ss.s.config.TLS.StartTLSOn {
+		ss.reply("503 5.5.1 TLS already active or not available")
+		return true
+	}
+	ss.reply("220 2.0.0 Ready to start TLS")
+	tc := tls.Server(ss.conn, ss.s.tls)
+	if err := tc.Handshake(); err != nil {
+		return false
+	}
+	// the client starts over, RFC 3207
+	ss.conn, ss.tp, ss.tls, ss.helo = tc, textproto.NewConn(tc), true, ""
+	ss.reset()
+	return true
+}
+
+// auth runs AUTH PLAIN or LOGIN, it returns false when the credentials were refused
+func (ss *submissionSession) auth(arg string) bool {
+	switch {
+	case !ss.tls:
+		ss.reply("538 5.7.11 Encryption required for requested authentication mechanism")
+		return true
+	case ss.account != "":
+		ss.reply("503 5.5.1 Already authenticated")
+		return true
+	case ss.helo == "":
+		ss.reply("503 5.5.1 Send EHLO first")
+		return true
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		ss.reply("501 5.5.4 Syntax: AUTH mechanism")
+		return true
+	}
+	var user, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp := ""
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else if resp = ss.challenge(""); resp == "*" {
+			ss.reply("501 5.0.0 Authentication cancelled")
+			return true
+		}
+		decoded, err := base64.StdEncoding.DecodeString(resp)
+		parts := strings.Split(string(decoded), "\x00")
+		if err != nil || len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+			ss.reply("501 5.5.2 Invalid PLAIN response")
+			return true
+		}
+		user, password = parts[1], parts[2]
+	case "LOGIN":
+		resp := ""
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else {
+			resp = ss.challenge("Username:")
+		}
+		b, err := base64.StdEncoding.DecodeString(resp)
+		if resp == "*" || err != nil {
+			ss.reply("501 5.0.0 Authentication cancelled")
+			return true
+		}
+		user = string(b)
+		resp = ss.challenge("Password:")
+		if b, err = base64.StdEncoding.DecodeString(resp); resp == "*" || err != nil {
+			ss.reply("501 5.0.0 Authentication cancelled")
+			return true
+		}
+		password = string(b)
+	default:
+		ss.reply("504 5.5.4 Unrecognized authentication mechanism")
+		return true
+	}
+	m := ss.s.mailDir()
+	account := strings.ToLower(user)
+	if _, ok := m.dirs[account]; !ok || !m.credentials.verify(account, password) {
+		backends.Log().Info("submission authentication failed for ", user)
+		ss.reply("535 5.7.8 Authentication credentials invalid")
+		return false
+	}
+	ss.account = account
+	ss.reply("235 2.7.0 Authentication successful")
+	return true
+}
+
+// challenge sends a 334 challenge and returns the response of the client
+func (ss *submissionSession) challenge(prompt string) string {
+	ss.reply("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := ss.tp.ReadLine()
+	if err != nil {
+		return "*"
+	}
+	return strings.TrimSpace(line)
+}
+
+// smtpPath parses the address of a MAIL FROM or RCPT TO argument, eg. FROM:<a@example.com> SIZE=10
+func smtpPath(arg, prefix string) (*mail.Address, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return nil, errors.New("syntax error")
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(arg, '>')
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return nil, errors.New("syntax error")
+	}
+	return mail.NewAddress(arg[1:end])
+}
+
+// owned tells if the authenticated account may send as addr, an address of a local domain
+func (ss *submissionSession) owned(addr *mail.Address) bool {
+	return ss.s.localDomain(addr.Host) && ss.s.mailDir().owns(ss.account, addr)
+}
+
+func (ss *submissionSession) mail(arg string) {
+	if ss.account == "" {
+		ss.reply("530 5.7.0 Authentication required")
+		return
+	}
+	if ss.from != "" {
+		ss.reply("503 5.5.1 Sender already given")
+		return
+	}
+	addr, err := smtpPath(arg, "FROM:")
+	if err != nil || addr.IsEmpty() {
+		ss.reply("501 5.1.7 Invalid sender address")
+		return
+	}
+	if !ss.owned(addr) {
+		ss.reply("553 5.7.1 Sender address rejected: not owned by %s", ss.account)
+		return
+	}
+	ss.from = addr.String()
+	ss.reply("250 2.1.0 Ok")
+}
+
+func (ss *submissionSession) rcpt(arg string) {
+	if ss.from == "" {
+		ss.reply("503 5.5.1 Need MAIL first")
+		return
+	}
+	if len(ss.rcpts) >= submissionMaxRcpts {
+		ss.reply("452 4.5.3 Too many recipients")
+		return
+	}
+	addr, err := smtpPath(arg, "TO:")
+	if err != nil || addr.Host == "" {
+		ss.reply("501 5.1.3 Invalid recipient address")
+		return
+	}
+	ss.rcpts = append(ss.rcpts, addr.String())
+	ss.reply("250 2.1.5 Ok")
+}
+
+// data reads the message and queues it, it returns false when the connection must be closed
+func (ss *submissionSession) data() bool {
+	if len(ss.rcpts) == 0 {
+		ss.reply("503 5.5.1 Need RCPT first")
+		return true
+	}
+	ss.reply("354 End data with <CR><LF>.<CR><LF>")
+	dr := ss.tp.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dr, ss.s.config.MaxSize+1))
+	if err != nil {
+		return false
+	}
+	defer ss.reset()
+	if int64(len(data)) > ss.s.config.MaxSize {
+		// read the rest of the message before replying
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return false
+		}
+		ss.reply("552 5.3.4 Message size exceeds fixed limit")
+		return true
+	}
+	// the dot reader returns bare LF line endings
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	if err := ss.checkHeaders(data); err != nil {
+		ss.reply("550 5.7.1 %s", err)
+		return true
+	}
+	id, err := ss.s.mailDir().relay.Enqueue(ss.from, ss.rcpts, bytes.NewReader(data))
+	if err != nil {
+		backends.Log().WithError(err).Error("could not queue a submitted message")
+		ss.reply("451 4.3.0 Could not queue the message, try again later")
+		return true
+	}
+	backends.Log().Infof("queued message %s submitted by %s for %d recipients", id, ss.account, len(ss.rcpts))
+	ss.reply("250 2.0.0 Ok: queued as %s", id)
+	return true
+}
+
+// checkHeaders makes sure the From and Sender addresses belong to the authenticated account
+func (ss *submissionSession) checkHeaders(data []byte) error {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("invalid message headers")
+	}
+	for _, h := range []string{"From", "Sender"} {
+		if h == "Sender" && msg.Header.Get(h) == "" {
+			continue
+		}
+		list, err := msg.Header.AddressList(h)
+		if err != nil || len(list) == 0 {
+			return fmt.Errorf("invalid %s header", h)
+		}
+		for _, a := range list {
+			at := strings.LastIndexByte(a.Address, '@')
+			if at < 0 || !ss.owned(&mail.Address{User: a.Address[:at], Host: a.Address[at+1:]}) {
+				return fmt.Errorf("%s address %s not owned by %s", h, a.Address, ss.account)
+			}
+		}
+	}
+	return nil
+}
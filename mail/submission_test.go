@@ -0,0 +1,268 @@
+package mail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/pentateu/email-cloud-service/relay"
+)
+
+// writeCertificate writes a self-signed certificate and its key in dir
+func writeCertificate(t *testing.T, dir string) (cert, key string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// loginAuth is the LOGIN mechanism, net/smtp only has PLAIN
+type loginAuth struct {
+	user, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.user), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected challenge")
+}
+
+// submit sends msg with c, returning the error of the failed step
+func submit(c *smtp.Client, from string, to []string, msg string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func replyCode(err error) int {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return 0
+}
+
+func TestSubmission(t *testing.T) {
+	dir, remove := testDir(t, "submission")
+	defer remove()
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:              "test=-1:-1,guerrilla=-1:-1",
+		AliasMap:             "team=test|guerrilla,sales=guerrilla,info=test",
+		SubaddressSeparators: "+",
+		CredentialsPath:      filepath.Join(dir, "credentials.json"),
+	})
+	var err error
+	if m.relay, err = relay.Open(filepath.Join(dir, "outbound")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.credentials.set("test", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := writeCertificate(t, dir)
+
+	newServer := func(tlsConfig guerrilla.ServerTLSConfig) (*submissionServer, net.Listener) {
+		tlsConfig.PublicKeyFile, tlsConfig.PrivateKeyFile = cert, key
+		s, err := newSubmissionServer(submissionConfig{
+			Hostname:        "mail.example.com",
+			ListenInterface: "127.0.0.1:0",
+			MaxSize:         1 << 20,
+			TLS:             tlsConfig,
+		}, []string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.mailDir = func() *MailDir { return m }
+		l, err := s.listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.serve(l)
+		return s, l
+	}
+	if _, err := newSubmissionServer(submissionConfig{}, nil); err == nil {
+		t.Error("expected an error for a submission server without TLS")
+	}
+	s, err := newSubmissionServer(submissionConfig{TLS: guerrilla.ServerTLSConfig{StartTLSOn: true, PublicKeyFile: cert, PrivateKeyFile: key}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.config.MaxSize != submissionMaxSize {
+		t.Errorf("expected the default max_size %d, got %d", submissionMaxSize, s.config.MaxSize)
+	}
+
+	// port 587, STARTTLS
+	_, l := newServer(guerrilla.ServerTLSConfig{StartTLSOn: true})
+	defer l.Close()
+	// net/smtp closes the client when AUTH fails, so every failure gets its own connection
+	dial := func(startTLS bool) *smtp.Client {
+		c, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if startTLS {
+			if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c
+	}
+	c := dial(false)
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH offered without TLS")
+	}
+	// net/smtp sends PLAIN in clear to 127.0.0.1
+	if err := c.Auth(smtp.PlainAuth("", "test", "s3cret", "127.0.0.1")); replyCode(err) != 538 {
+		t.Errorf("expected AUTH to require TLS, got %v", err)
+	}
+	c.Close()
+	c = dial(true)
+	if ok, _ := c.Extension("AUTH"); !ok {
+		t.Error("AUTH not offered after STARTTLS")
+	}
+	if err := c.Mail("test@example.com"); replyCode(err) != 530 {
+		t.Errorf("expected MAIL to require AUTH, got %v", err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "test", "wrong", "127.0.0.1")); replyCode(err) != 535 {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+	c.Close()
+	c = dial(true)
+	defer c.Close()
+	if err := c.Auth(smtp.PlainAuth("", "test", "s3cret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []string{"guerrilla@example.com", "sales@example.com", "team@example.com", "test@example.org"} {
+		if err := c.Mail(from); replyCode(err) != 553 {
+			t.Errorf("expected %s to be refused, got %v", from, err)
+		}
+		c.Reset()
+	}
+	to := []string{"bob@remote.test", "carol@remote.test"}
+	if err := submit(c, "test@example.com", to, "From: guerrilla@example.com\r\nSubject: x\r\n\r\nhi\r\n"); replyCode(err) != 550 {
+		t.Errorf("expected a From header of another account to be refused, got %v", err)
+	}
+	// a list is shared, its members can't send as it
+	if err := submit(c, "test@example.com", to, "From: Test <test@example.com>\r\nSender: team@example.com\r\nSubject: x\r\n\r\nhi\r\n"); replyCode(err) != 550 {
+		t.Errorf("expected a Sender header of a list to be refused, got %v", err)
+	}
+	if err := submit(c, "test@example.com", to, "From: Test <test@example.com>\r\nSender: info@example.com\r\nSubject: x\r\n\r\nhi\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	messages := m.relay.Messages()
+	if len(messages) != 1 || messages[0].From != "test@example.com" || len(messages[0].Recipients) != 2 {
+		t.Fatalf("unexpected queue %+v", messages)
+	}
+
+	// port 465, implicit TLS and LOGIN
+	_, l = newServer(guerrilla.ServerTLSConfig{AlwaysOn: true})
+	defer l.Close()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = smtp.NewClient(conn, "mail.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Auth(&loginAuth{user: "test", password: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := submit(c, "test+lists@example.com", to[:1], "From: test+lists@example.com\r\n\r\nhi\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if m.relay.Depth() != 2 {
+		t.Errorf("expected 2 queued messages, got %d", m.relay.Depth())
+	}
+	for _, msg := range m.relay.Messages() {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "outbound", msg.ID+".eml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(data), "\r\n\r\nhi\r\n") {
+			t.Errorf("unexpected queued message %q", data)
+		}
+	}
+}
+
+func TestServeSubmissionReload(t *testing.T) {
+	defer func(servers []*submissionServer, m *MailDir, started bool) {
+		submission.servers, submission.m, submission.started = servers, m, started
+	}(submission.servers, submission.m, submission.started)
+	running := &MailDir{relay: &relay.Queue{}, credentials: &credentialStore{}}
+	submission.servers = []*submissionServer{{}}
+	submission.m, submission.started = running, true
+
+	// the reloaded configuration has no outbound queue
+	(&MailDir{credentials: &credentialStore{}}).serveSubmission()
+	if submissionMailDir() != running {
+		t.Error("expected the submission servers to keep the MailDir with an outbound queue")
+	}
+}
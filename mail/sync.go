@@ -0,0 +1,264 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// SyncProtocol is the libp2p protocol client nodes use to pull their mailbox.
+//
+// Every request and response is a single JSON document on its own line.
+// The account is the one whose key matches the remote peer of the stream,
+// libp2p has already authenticated the peer when the stream is opened.
+const SyncProtocol = protocol.ID("/cryptomail/sync/1.0.0")
+
+const (
+	syncOpList  = "list"
+	syncOpFetch = "fetch"
+	syncOpAck   = "ack"
+	// syncOpAutocrypt returns the Autocrypt log, see AutocryptFileName
+	syncOpAutocrypt = "autocrypt"
+
+	// syncTimeout bounds how long a stream may stay idle
+	syncTimeout = time.Minute
+	// syncMaxFetch is the maximum number of messages returned by a single fetch
+	syncMaxFetch = 32
+	// syncMaxAutocrypt is the maximum number of Autocrypt records returned by a single request
+	syncMaxAutocrypt = 256
+)
+
+var errSyncUnauthorized = errors.New("peer is not authorized for any account")
+
+// SyncRequest is sent by the client node
+type SyncRequest struct {
+	Op string `json:"op"`
+	// Cursor for list and autocrypt, only entries with a greater sequence are returned
+	Cursor uint64 `json:"cursor,omitempty"`
+	// CIDs for fetch
+	CIDs []string `json:"cids,omitempty"`
+	// Ack for ack, it must be signed for the authenticated account
+	Ack *Ack `json:"ack,omitempty"`
+}
+
+// SyncEntry describes a message in a list response
+type SyncEntry struct {
+	Seq  uint64    `json:"seq"`
+	CID  string    `json:"cid"`
+	Date time.Time `json:"date"`
+	Size int64     `json:"size,omitempty"`
+	// Encryption is the scheme of the service the message is encrypted with, empty if none
+	Encryption string `json:"encryption,omitempty"`
+	// KeyID is the account key the message is encrypted to, clients pick the private key with it
+	KeyID string `json:"key_id,omitempty"`
+	// EndToEnd is the encryption applied by the sender: pgp-mime, pgp-inline or smime.
+	// Clients decrypt Encryption first, then EndToEnd.
+	EndToEnd string `json:"end_to_end,omitempty"`
+	// Folder is the Maildir folder of the subaddress the message was sent to, empty for the inbox
+	Folder string `json:"folder,omitempty"`
+	// Meta is set instead of Date, Size and EndToEnd when the metadata is protected, see OpenIndexMeta
+	Meta []byte `json:"meta,omitempty"`
+}
+
+// SyncMessage is a message returned by fetch
+type SyncMessage struct {
+	CID  string `json:"cid"`
+	Data []byte `json:"data"`
+}
+
+// SyncResponse is sent by the service for every request
+type SyncResponse struct {
+	Error    string        `json:"error,omitempty"`
+	Cursor   uint64        `json:"cursor,omitempty"`
+	Entries  []SyncEntry   `json:"entries,omitempty"`
+	Messages []SyncMessage `json:"messages,omitempty"`
+	// Autocrypt lists the records of the Autocrypt log for autocrypt
+	Autocrypt []SyncAutocrypt `json:"autocrypt,omitempty"`
+}
+
+// peerAccount returns the account whose key belongs to peer p
+func (m *MailDir) peerAccount(p peer.ID) (string, bool) {
+	for u, pub := range m.accountKeys {
+		if p.MatchesPublicKey(pub) {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// serveSync registers the sync protocol on h. Registering again,
+// eg. after a config reload, replaces the previous handler.
+func (m *MailDir) serveSync(h host.Host) {
+	h.SetStreamHandler(SyncProtocol, m.handleSyncStream)
+}
+
+// handleSyncStream serves the requests of one client stream until it is closed
+func (m *MailDir) handleSyncStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	u, ok := m.peerAccount(remote)
+	enc := json.NewEncoder(s)
+	if !ok {
+		backends.Log().WithError(errSyncUnauthorized).Info("sync stream rejected for ", remote)
+		enc.Encode(&SyncResponse{Error: errSyncUnauthorized.Error()})
+		s.Reset()
+		return
+	}
+	dec := json.NewDecoder(bufio.NewReader(s))
+	for {
+		s.SetDeadline(time.Now().Add(syncTimeout))
+		req := &SyncRequest{}
+		if err := dec.Decode(req); err != nil {
+			// client closed the stream or went idle
+			return
+		}
+		resp := m.syncRequest(u, req)
+		if err := enc.Encode(resp); err != nil {
+			backends.Log().WithError(err).Info("could not write sync response to ", remote)
+			s.Reset()
+			return
+		}
+	}
+}
+
+// syncRequest handles a single request of user u
+func (m *MailDir) syncRequest(u string, req *SyncRequest) *SyncResponse {
+	idx, ok := m.indexes[u]
+	if !ok {
+		return &SyncResponse{Error: errSyncUnauthorized.Error()}
+	}
+	resp := &SyncResponse{}
+	switch req.Op {
+	case syncOpList:
+		resp.Cursor = req.Cursor
+		for _, e := range idx.since(req.Cursor) {
+			if e.CID == "" {
+				// not in IPFS yet, the client will get it with a later cursor
+				break
+			}
+			resp.Entries = append(resp.Entries, SyncEntry{Seq: e.Seq, CID: e.CID, Date: e.Date, Size: e.Size, Encryption: e.Encryption, KeyID: e.KeyID, EndToEnd: e.EndToEnd, Folder: e.Folder, Meta: e.Meta})
+			resp.Cursor = e.Seq
+		}
+	case syncOpFetch:
+		if len(req.CIDs) > syncMaxFetch {
+			resp.Error = "too many messages requested"
+			break
+		}
+		for _, c := range req.CIDs {
+			e, ok := idx.byCID(c)
+			if !ok {
+				continue
+			}
+			data, err := ioutil.ReadFile(e.Filename)
+			if err != nil {
+				backends.Log().WithError(err).Error("could not read message for sync ", c)
+				continue
+			}
+			resp.Messages = append(resp.Messages, SyncMessage{CID: c, Data: data})
+		}
+	case syncOpAck:
+		if req.Ack == nil || req.Ack.Account != u {
+			resp.Error = errAckUnknownAccount.Error()
+			break
+		}
+		if err := m.handleAck(context.Background(), req.Ack); err != nil {
+			resp.Error = err.Error()
+		}
+	case syncOpAutocrypt:
+		resp.Cursor = req.Cursor
+		records, err := m.autocrypt[u].since(req.Cursor)
+		if err != nil {
+			backends.Log().WithError(err).Error("could not read the Autocrypt log of ", u)
+			resp.Error = "could not read the Autocrypt log"
+			break
+		}
+		if len(records) > syncMaxAutocrypt {
+			records = records[:syncMaxAutocrypt]
+		}
+		for _, r := range records {
+			resp.Autocrypt = append(resp.Autocrypt, r)
+			resp.Cursor = r.Seq
+		}
+	default:
+		resp.Error = "unknown operation " + req.Op
+	}
+	return resp
+}
+
+// SyncClient pulls a mailbox from a service node over the sync protocol
+type SyncClient struct {
+	s   network.Stream
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+// NewSyncClient opens a sync stream from h to the service node p
+func NewSyncClient(ctx context.Context, h host.Host, p peer.ID) (*SyncClient, error) {
+	s, err := h.NewStream(ctx, p, SyncProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncClient{s: s, enc: json.NewEncoder(s), dec: json.NewDecoder(bufio.NewReader(s))}, nil
+}
+
+func (c *SyncClient) do(req *SyncRequest) (*SyncResponse, error) {
+	if err := c.enc.Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &SyncResponse{}
+	if err := c.dec.Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// List returns the messages stored after cursor and the cursor to use next
+func (c *SyncClient) List(cursor uint64) ([]SyncEntry, uint64, error) {
+	resp, err := c.do(&SyncRequest{Op: syncOpList, Cursor: cursor})
+	if err != nil {
+		return nil, cursor, err
+	}
+	return resp.Entries, resp.Cursor, nil
+}
+
+// Fetch returns the stored messages for cids
+func (c *SyncClient) Fetch(cids []string) ([]SyncMessage, error) {
+	resp, err := c.do(&SyncRequest{Op: syncOpFetch, CIDs: cids})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// Ack acknowledges fetched messages so the service releases them
+func (c *SyncClient) Ack(a *Ack) error {
+	_, err := c.do(&SyncRequest{Op: syncOpAck, Ack: a})
+	return err
+}
+
+// Autocrypt returns the Autocrypt records logged after cursor and the cursor to use next.
+// Apply them to an AutocryptPeers to get the keys of the senders.
+func (c *SyncClient) Autocrypt(cursor uint64) ([]SyncAutocrypt, uint64, error) {
+	resp, err := c.do(&SyncRequest{Op: syncOpAutocrypt, Cursor: cursor})
+	if err != nil {
+		return nil, cursor, err
+	}
+	return resp.Autocrypt, resp.Cursor, nil
+}
+
+// Close closes the stream
+func (c *SyncClient) Close() error {
+	return c.s.Close()
+}
@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestSyncRequests(t *testing.T) {
+	dir, remove := testDir(t, "sync")
+	defer remove()
+
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPub, _ := crypto.GenerateEd25519Key(rand.Reader)
+	stranger, _ := peer.IDFromPublicKey(otherPub)
+
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:     "test=-1:-1",
+		AccountKeys: "test=" + client.Pretty(),
+	})
+	if u, ok := m.peerAccount(client); !ok || u != "test" {
+		t.Fatal("client peer not matched to its account")
+	}
+	if _, ok := m.peerAccount(stranger); ok {
+		t.Fatal("peer without an account was matched")
+	}
+
+	filename, err := m.dirs["test"].CreateMail(strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.indexes["test"].add(indexEntry{CID: "bafytest", Filename: filename, Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := m.syncRequest("test", &SyncRequest{Op: syncOpList})
+	if resp.Error != "" || len(resp.Entries) != 1 || resp.Entries[0].CID != "bafytest" {
+		t.Fatalf("unexpected list response %+v", resp)
+	}
+	if next := m.syncRequest("test", &SyncRequest{Op: syncOpList, Cursor: resp.Cursor}); len(next.Entries) != 0 {
+		t.Error("expected no entries after the cursor, got", next.Entries)
+	}
+	resp = m.syncRequest("test", &SyncRequest{Op: syncOpFetch, CIDs: []string{"bafytest"}})
+	if len(resp.Messages) != 1 || !strings.Contains(string(resp.Messages[0].Data), "Subject: hi") {
+		t.Fatalf("unexpected fetch response %+v", resp)
+	}
+
+	a := &Ack{Account: "test", CIDs: []string{"bafytest"}, Timestamp: time.Now().Unix()}
+	if err := a.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if resp = m.syncRequest("test", &SyncRequest{Op: syncOpAck, Ack: a}); resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("acknowledged message was not removed")
+	}
+}
@@ -0,0 +1,135 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+	"github.com/google/tink/go/tink"
+)
+
+// Messages of the tink scheme are written as:
+//
+//	magic      6 bytes "CMTINK"
+//	version    1 byte  0x01
+//	length     4 bytes big endian, length of the wrapped keyset
+//	wrapped    the data keyset, a binary AES256_GCM_HKDF_4KB streaming AEAD keyset,
+//	           encrypted with the account hybrid (HPKE) public keyset
+//	payload    the message encrypted with the data keyset streaming AEAD
+//
+// Tink hybrid encryption is not streaming, so it only wraps the fresh data keyset.
+// The magic is the associated data of both the hybrid encryption and the streaming AEAD.
+const (
+	tinkMagic   = "CMTINK"
+	tinkVersion = 1
+	// maxTinkWrappedSize bounds the wrapped keyset a reader accepts
+	maxTinkWrappedSize = 64 * 1024
+)
+
+var errNotTinkMessage = errors.New("not a tink encrypted message")
+
+// tinkKey is a Tink hybrid public keyset
+type tinkKey struct {
+	tink.HybridEncrypt
+}
+
+func (tinkKey) Scheme() string {
+	return SchemeTink
+}
+
+// tinkEncryption encrypts with a Tink hybrid encryption keyset, eg. DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_CHACHA20_POLY1305.
+// Keys are the path to the public keyset in JSON, as written by tinkey.
+type tinkEncryption struct{}
+
+func (tinkEncryption) ParseKey(s string) (AccountKey, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := keyset.ReadWithNoSecrets(keyset.NewJSONReader(f))
+	if err != nil {
+		return nil, err
+	}
+	enc, err := hybrid.NewHybridEncrypt(h)
+	if err != nil {
+		return nil, err
+	}
+	return tinkKey{enc}, nil
+}
+
+func (tinkEncryption) Encrypt(w io.Writer, keys []AccountKey) (io.WriteCloser, error) {
+	if len(keys) != 1 {
+		return nil, errors.New("tink messages are encrypted to a single key")
+	}
+	k, ok := keys[0].(tinkKey)
+	if !ok {
+		return nil, errKeyScheme
+	}
+	dek, err := keyset.NewHandle(streamingaead.AES256GCMHKDF4KBKeyTemplate())
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := insecurecleartextkeyset.Write(dek, keyset.NewBinaryWriter(buf)); err != nil {
+		return nil, err
+	}
+	wrapped, err := k.Encrypt(buf.Bytes(), []byte(tinkMagic))
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(tinkMagic), tinkVersion, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(tinkMagic)+1:], uint32(len(wrapped)))
+	if _, err := w.Write(append(header, wrapped...)); err != nil {
+		return nil, err
+	}
+	sa, err := streamingaead.New(dek)
+	if err != nil {
+		return nil, err
+	}
+	return sa.NewEncryptingWriter(w, []byte(tinkMagic))
+}
+
+func (tinkEncryption) Shared() bool {
+	return false
+}
+
+// TinkDecrypter decrypts messages of the tink scheme with the account hybrid private keyset
+func TinkDecrypter(dec tink.HybridDecrypt) Decrypter {
+	return func(r io.Reader) (io.Reader, error) {
+		header := make([]byte, len(tinkMagic)+5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errNotTinkMessage
+		}
+		if string(header[:len(tinkMagic)]) != tinkMagic || header[len(tinkMagic)] != tinkVersion {
+			return nil, errNotTinkMessage
+		}
+		size := binary.BigEndian.Uint32(header[len(tinkMagic)+1:])
+		if size > maxTinkWrappedSize {
+			return nil, errNotTinkMessage
+		}
+		wrapped := make([]byte, size)
+		if _, err := io.ReadFull(r, wrapped); err != nil {
+			return nil, err
+		}
+		data, err := dec.Decrypt(wrapped, []byte(tinkMagic))
+		if err != nil {
+			return nil, err
+		}
+		dek, err := insecurecleartextkeyset.Read(keyset.NewBinaryReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, err
+		}
+		sa, err := streamingaead.New(dek)
+		if err != nil {
+			return nil, err
+		}
+		return sa.NewDecryptingReader(r, []byte(tinkMagic))
+	}
+}
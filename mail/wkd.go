@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+// wkdPrefix is the path of the Web Key Directory (draft-koch-openpgp-webkey-service)
+const wkdPrefix = "/.well-known/openpgpkey/"
+
+// zbase32 is the z-base-32 encoding used for the WKD hashes
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// wkdHash returns the WKD hash of the local part of an address:
+// the z-base-32 encoded SHA-1 of the lower case local part
+func wkdHash(local string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	return zbase32.EncodeToString(sum[:])
+}
+
+// wkdServer is the Web Key Directory listener, one per process. It serves the keys of the
+// MailDir of the last configuration.
+var wkdServer struct {
+	sync.Mutex
+	m    *MailDir
+	addr string
+	srv  *http.Server
+}
+
+// serveWKD publishes the keys of the accounts using pgp encryption on wkd_listen_interface.
+// Serving again, eg. after a config reload, replaces the previous MailDir and restarts the
+// listener if its address changed.
+func (m *MailDir) serveWKD() {
+	wkdServer.Lock()
+	defer wkdServer.Unlock()
+	wkdServer.m = m
+	addr := m.config.WKDListen
+	if addr == wkdServer.addr {
+		return
+	}
+	if wkdServer.srv != nil {
+		wkdServer.srv.Close()
+		wkdServer.srv = nil
+	}
+	wkdServer.addr = addr
+	if addr == "" {
+		return
+	}
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(serveWKDRequest)}
+	wkdServer.srv = srv
+	cert, key := m.config.WKDTLSCert, m.config.WKDTLSKey
+	go func() {
+		var err error
+		if cert != "" {
+			backends.Log().Infof("serving the Web Key Directory on https://%s", addr)
+			err = srv.ListenAndServeTLS(cert, key)
+		} else {
+			// behind a proxy terminating TLS
+			backends.Log().Infof("serving the Web Key Directory on http://%s", addr)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			backends.Log().WithError(err).Error("Web Key Directory listener stopped")
+		}
+	}()
+}
+
+// serveWKDRequest serves a request with the current MailDir
+func serveWKDRequest(w http.ResponseWriter, r *http.Request) {
+	wkdServer.Lock()
+	m := wkdServer.m
+	wkdServer.Unlock()
+	m.ServeHTTP(w, r)
+}
+
+// ServeHTTP serves the Web Key Directory of wkd_domains, with the advanced method
+// (/.well-known/openpgpkey/<domain>/hu/<hash>) and the direct method
+// (/.well-known/openpgpkey/hu/<hash> on the domain itself)
+func (m *MailDir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, wkdPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, wkdPrefix), "/")
+	domain := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		domain = h
+	}
+	if len(parts) == 3 || (len(parts) == 2 && parts[1] == "policy") {
+		// advanced method, the domain is in the path
+		domain, parts = parts[0], parts[1:]
+	}
+	if !m.wkdDomain(domain) {
+		http.NotFound(w, r)
+		return
+	}
+	// keys can be fetched from any origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case len(parts) == 1 && parts[0] == "policy":
+		// an empty policy announces the directory
+		w.Header().Set("Content-Type", "text/plain")
+	case len(parts) == 2 && parts[0] == "hu":
+		key, ok := m.wkdKey(parts[1])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(key)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// wkdDomain reports if domain is one of wkd_domains
+func (m *MailDir) wkdDomain(domain string) bool {
+	for _, d := range strings.Split(m.config.WKDDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" && strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// wkdKey returns the binary OpenPGP public key of the account whose local part has the WKD
+// hash, if its current key is a pgp key
+func (m *MailDir) wkdKey(hash string) ([]byte, bool) {
+	for u := range m.userMap {
+		if wkdHash(u) != hash {
+			continue
+		}
+		k, err := m.currentKey(u)
+		if err != nil {
+			return nil, false
+		}
+		pk, ok := k.AccountKey.(pgpKey)
+		if !ok {
+			return nil, false
+		}
+		buf := &bytes.Buffer{}
+		for _, e := range pk.EntityList {
+			if err := e.Serialize(buf); err != nil {
+				backends.Log().WithError(err).Error("could not serialize the key of ", u)
+				return nil, false
+			}
+		}
+		return buf.Bytes(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestWKDHash(t *testing.T) {
+	// example of draft-koch-openpgp-webkey-service
+	if h := wkdHash("Joe.Doe"); h != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("unexpected hash %s", h)
+	}
+}
+
+func TestWKD(t *testing.T) {
+	dir, remove := testDir(t, "wkd")
+	defer remove()
+	entity, keyPath := testPGPKey(t, dir, "test")
+
+	m := testMailDir(t, dir, &maildirConfig{
+		UserMap:        "test=-1:-1,guerrilla=-1:-1,plain=-1:-1",
+		EncryptionKeys: "test=pgp:" + keyPath + ",guerrilla=" + testEnvelopeKey(t).Public().String(),
+		WKDDomains:     "example.com, example.org",
+	})
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	get := func(host, path string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+
+	for _, c := range []struct {
+		host, path string
+	}{
+		{"openpgpkey.example.com", "/.well-known/openpgpkey/example.com/hu/" + wkdHash("test") + "?l=test"},
+		{"example.org:443", "/.well-known/openpgpkey/hu/" + wkdHash("test")},
+	} {
+		status, data := get(c.host, c.path)
+		if status != http.StatusOK {
+			t.Fatalf("%s%s: status %d", c.host, c.path, status)
+		}
+		el, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el) != 1 || !bytes.Equal(el[0].PrimaryKey.Fingerprint, entity.PrimaryKey.Fingerprint) || el[0].PrivateKey != nil {
+			t.Errorf("%s%s: unexpected key %+v", c.host, c.path, el)
+		}
+	}
+	for _, c := range []struct {
+		host, path string
+		status     int
+	}{
+		{"openpgpkey.example.com", "/.well-known/openpgpkey/example.com/policy", http.StatusOK},
+		{"example.com", "/.well-known/openpgpkey/policy", http.StatusOK},
+		// not a pgp account, unknown account, unknown domain
+		{"example.com", "/.well-known/openpgpkey/hu/" + wkdHash("guerrilla"), http.StatusNotFound},
+		{"example.com", "/.well-known/openpgpkey/hu/" + wkdHash("plain"), http.StatusNotFound},
+		{"example.com", "/.well-known/openpgpkey/hu/" + wkdHash("nobody"), http.StatusNotFound},
+		{"openpgpkey.example.net", "/.well-known/openpgpkey/example.net/hu/" + wkdHash("test"), http.StatusNotFound},
+		{"example.com", "/", http.StatusNotFound},
+	} {
+		if status, _ := get(c.host, c.path); status != c.status {
+			t.Errorf("%s%s: expected status %d, got %d", c.host, c.path, c.status, status)
+		}
+	}
+}
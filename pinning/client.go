@@ -0,0 +1,149 @@
+// Package pinning implements a client for the IPFS Pinning Service API
+// (https://ipfs.github.io/pinning-services-api-spec/) used to keep stored
+// messages on remote pinning services.
+package pinning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Status of a pin request
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusPinning Status = "pinning"
+	StatusPinned  Status = "pinned"
+	StatusFailed  Status = "failed"
+)
+
+// Pin is the object pinned by a request
+type Pin struct {
+	CID     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus is returned by the service for every pin request
+type PinStatus struct {
+	RequestID string    `json:"requestid"`
+	Status    Status    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       Pin       `json:"pin"`
+	Delegates []string  `json:"delegates"`
+}
+
+// Error is returned when the service answers with an error
+type Error struct {
+	StatusCode int
+	Reason     string `json:"reason"`
+	Details    string `json:"details"`
+}
+
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("pinning service error %d %s: %s", e.StatusCode, e.Reason, e.Details)
+	}
+	return fmt.Sprintf("pinning service error %d %s", e.StatusCode, e.Reason)
+}
+
+// Client talks to a single remote pinning service
+type Client struct {
+	Name     string
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+// NewClient returns a client for the service at endpoint, authenticated with the access token
+func NewClient(name, endpoint, token string) *Client {
+	return &Client{
+		Name:     name,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		token:    token,
+		http:     &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Add asks the service to pin cid
+func (c *Client) Add(ctx context.Context, p Pin) (*PinStatus, error) {
+	body, err := json.Marshal(&p)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PinStatus{}
+	if err := c.do(ctx, http.MethodPost, "/pins", bytes.NewReader(body), ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Get returns the current status of a pin request
+func (c *Client) Get(ctx context.Context, requestID string) (*PinStatus, error) {
+	ps := &PinStatus{}
+	if err := c.do(ctx, http.MethodGet, "/pins/"+requestID, nil, ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Find returns the pin requests for cid
+func (c *Client) Find(ctx context.Context, cid string) ([]PinStatus, error) {
+	results := struct {
+		Count   int         `json:"count"`
+		Results []PinStatus `json:"results"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/pins?cid="+url.QueryEscape(cid), nil, &results); err != nil {
+		return nil, err
+	}
+	return results.Results, nil
+}
+
+// Remove removes a pin request, the service unpins the content
+func (c *Client) Remove(ctx context.Context, requestID string) error {
+	return c.do(ctx, http.MethodDelete, "/pins/"+requestID, nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := struct {
+			Error *Error `json:"error"`
+		}{&Error{}}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == nil {
+			e.Error = &Error{}
+		}
+		e.Error.StatusCode = resp.StatusCode
+		if e.Error.Reason == "" {
+			e.Error.Reason = http.StatusText(resp.StatusCode)
+		}
+		return e.Error
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
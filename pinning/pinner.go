@@ -0,0 +1,259 @@
+package pinning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries      = 5
+	defaultPollInterval    = 2 * time.Second
+	defaultMaxPollInterval = 5 * time.Minute
+	defaultAttemptTimeout  = time.Hour
+)
+
+var errPinFailed = errors.New("pinning service reported the pin as failed")
+
+// Tracked is the state of a cid on one service
+type Tracked struct {
+	RequestID string
+	Status    Status
+	Attempts  int
+	Err       error
+	Updated   time.Time
+}
+
+// Pinner pins content on every configured service and follows the pin
+// requests until they are pinned, retrying failed requests.
+type Pinner struct {
+	clients []*Client
+
+	// MaxRetries is the number of times a failed pin is requested again
+	MaxRetries int
+	// PollInterval is the initial interval between status checks and retries, it doubles up to MaxPollInterval
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// AttemptTimeout is how long a request may stay queued or pinning before it is retried
+	AttemptTimeout time.Duration
+	// OnFailure is called when a cid could not be pinned on a service after all retries
+	OnFailure func(cid string, service string, err error)
+
+	mu sync.Mutex
+	// pins holds the requests in flight, a service is dropped once its request settled
+	pins map[string]map[string]*Tracked
+	wg   sync.WaitGroup
+}
+
+// New returns a Pinner for the given services
+func New(clients []*Client) *Pinner {
+	return &Pinner{
+		clients:         clients,
+		MaxRetries:      defaultMaxRetries,
+		PollInterval:    defaultPollInterval,
+		MaxPollInterval: defaultMaxPollInterval,
+		AttemptTimeout:  defaultAttemptTimeout,
+		pins:            make(map[string]map[string]*Tracked),
+	}
+}
+
+// ParseServices parses the remote pinning services config string
+// Each record separated by ","
+// Records have the following format: <name>=<endpoint>|<access token>
+// Example: "pinata=https://api.pinata.cloud/psa|eyJhbGciOi..."
+func ParseServices(services string) ([]*Client, error) {
+	ret := make([]*Client, 0)
+	if len(strings.TrimSpace(services)) == 0 {
+		return ret, nil
+	}
+	for _, r := range strings.Split(services, ",") {
+		kv := strings.SplitN(strings.TrimSpace(r), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid pinning service record %q", r)
+		}
+		i := strings.LastIndex(kv[1], "|")
+		if i < 0 {
+			return nil, fmt.Errorf("pinning service [%s] has no access token", kv[0])
+		}
+		ret = append(ret, NewClient(kv[0], kv[1][:i], kv[1][i+1:]))
+	}
+	return ret, nil
+}
+
+// Len returns the number of services
+func (p *Pinner) Len() int {
+	return len(p.clients)
+}
+
+// Pin requests cid to be pinned on every service. It returns immediately,
+// the requests are followed in the background until they settle or ctx is done.
+func (p *Pinner) Pin(ctx context.Context, cid string, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[cid]; ok {
+		return
+	}
+	p.pins[cid] = make(map[string]*Tracked, len(p.clients))
+	for _, c := range p.clients {
+		t := &Tracked{Status: StatusQueued, Updated: time.Now()}
+		p.pins[cid][c.Name] = t
+		p.wg.Add(1)
+		go func(c *Client, t *Tracked) {
+			defer p.wg.Done()
+			p.track(ctx, c, Pin{CID: cid, Name: name})
+			p.settle(cid, c.Name, t)
+		}(c, t)
+	}
+}
+
+// Unpin removes the pin requests for cid from every service.
+// Requests that are not tracked, eg. made before a restart, are looked up on the service.
+func (p *Pinner) Unpin(ctx context.Context, cid string) error {
+	p.mu.Lock()
+	tracked := p.pins[cid]
+	delete(p.pins, cid)
+	p.mu.Unlock()
+	var firstErr error
+	for _, c := range p.clients {
+		ids := make([]string, 0, 1)
+		if t, ok := tracked[c.Name]; ok && t.RequestID != "" {
+			ids = append(ids, t.RequestID)
+		} else {
+			found, err := c.Find(ctx, cid)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("could not find pins of %s on %s: %s", cid, c.Name, err)
+			}
+			for _, ps := range found {
+				ids = append(ids, ps.RequestID)
+			}
+		}
+		for _, id := range ids {
+			if err := c.Remove(ctx, id); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("could not unpin %s from %s: %s", cid, c.Name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// Status returns a copy of the state of cid on each service still following its request
+func (p *Pinner) Status(cid string) map[string]Tracked {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make(map[string]Tracked, len(p.pins[cid]))
+	for name, t := range p.pins[cid] {
+		ret[name] = *t
+	}
+	return ret
+}
+
+// Wait blocks until every pin request has settled
+func (p *Pinner) Wait() {
+	p.wg.Wait()
+}
+
+// settle stops tracking cid on service, and cid once no service follows it anymore.
+// t is the request settled, cid may have been unpinned and pinned again meanwhile.
+func (p *Pinner) settle(cid string, service string, t *Tracked) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pins[cid][service] != t {
+		return
+	}
+	delete(p.pins[cid], service)
+	if len(p.pins[cid]) == 0 {
+		delete(p.pins, cid)
+	}
+}
+
+func (p *Pinner) update(cid string, service string, f func(t *Tracked)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.pins[cid][service]; ok {
+		f(t)
+		t.Updated = time.Now()
+	}
+}
+
+// track requests the pin on c and polls it until it is pinned,
+// requesting it again when the service reports a failure
+func (p *Pinner) track(ctx context.Context, c *Client, pin Pin) {
+	var err error
+	for attempt := 0; attempt <= p.MaxRetries; attempt++ {
+		if attempt > 0 && !p.sleep(ctx, p.backoff(attempt)) {
+			return
+		}
+		p.update(pin.CID, c.Name, func(t *Tracked) { t.Attempts = attempt + 1 })
+		if err = p.attempt(ctx, c, pin); err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		p.update(pin.CID, c.Name, func(t *Tracked) { t.Err = err })
+	}
+	p.update(pin.CID, c.Name, func(t *Tracked) { t.Status = StatusFailed })
+	if p.OnFailure != nil {
+		p.OnFailure(pin.CID, c.Name, err)
+	}
+}
+
+// attempt makes a single pin request and polls it until it settles
+func (p *Pinner) attempt(ctx context.Context, c *Client, pin Pin) error {
+	ps, err := c.Add(ctx, pin)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(p.AttemptTimeout)
+	for poll := 0; ; poll++ {
+		p.update(pin.CID, c.Name, func(t *Tracked) {
+			t.RequestID = ps.RequestID
+			t.Status = ps.Status
+		})
+		switch ps.Status {
+		case StatusPinned:
+			p.update(pin.CID, c.Name, func(t *Tracked) { t.Err = nil })
+			return nil
+		case StatusFailed:
+			return errPinFailed
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pin request %s still %s after %s", ps.RequestID, ps.Status, p.AttemptTimeout)
+		}
+		if !p.sleep(ctx, p.backoff(poll)) {
+			return ctx.Err()
+		}
+		next, err := c.Get(ctx, ps.RequestID)
+		if err != nil {
+			// keep polling, the service may be temporarily unavailable
+			continue
+		}
+		ps = next
+	}
+}
+
+// backoff returns the PollInterval doubled n times, capped at MaxPollInterval
+func (p *Pinner) backoff(n int) time.Duration {
+	d := p.PollInterval
+	for i := 0; i < n && d < p.MaxPollInterval; i++ {
+		d *= 2
+	}
+	if d > p.MaxPollInterval {
+		d = p.MaxPollInterval
+	}
+	return d
+}
+
+func (p *Pinner) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
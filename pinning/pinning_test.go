@@ -0,0 +1,204 @@
+package pinning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubService is a local stand-in for a remote pinning service.
+// Pin requests are queued when created and move to the status returned by settle on the next GET.
+type stubService struct {
+	sync.Mutex
+	token    string
+	requests map[string]*PinStatus
+	settle   func(attempt int) Status
+	adds     int
+	removed  []string
+}
+
+func newStubService(token string, settle func(attempt int) Status) (*stubService, *httptest.Server) {
+	s := &stubService{token: token, requests: make(map[string]*PinStatus), settle: settle}
+	return s, httptest.NewServer(s)
+}
+
+func (s *stubService) fail(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"reason":%q}}`, reason)
+}
+
+func (s *stubService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		s.fail(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pins":
+		pin := Pin{}
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil || pin.CID == "" {
+			s.fail(w, http.StatusBadRequest, "BAD_REQUEST")
+			return
+		}
+		s.adds++
+		ps := &PinStatus{
+			RequestID: fmt.Sprintf("req-%d", s.adds),
+			Status:    StatusQueued,
+			Created:   time.Now(),
+			Pin:       pin,
+		}
+		s.requests[ps.RequestID] = ps
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(ps)
+	case r.Method == http.MethodGet && r.URL.Path == "/pins":
+		results := make([]*PinStatus, 0)
+		for _, ps := range s.requests {
+			if ps.Pin.CID == r.URL.Query().Get("cid") {
+				results = append(results, ps)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(results), "results": results})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/pins/"):
+		ps, ok := s.requests[strings.TrimPrefix(r.URL.Path, "/pins/")]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		ps.Status = s.settle(s.adds)
+		json.NewEncoder(w).Encode(ps)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/pins/"):
+		id := strings.TrimPrefix(r.URL.Path, "/pins/")
+		delete(s.requests, id)
+		s.removed = append(s.removed, id)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.fail(w, http.StatusNotFound, "NOT_FOUND")
+	}
+}
+
+func fastPinner(clients []*Client) *Pinner {
+	p := New(clients)
+	p.MaxRetries = 2
+	p.PollInterval = time.Millisecond
+	p.MaxPollInterval = 10 * time.Millisecond
+	p.AttemptTimeout = time.Second
+	return p
+}
+
+func TestPinAndUnpin(t *testing.T) {
+	stub, srv := newStubService("secret", func(int) Status { return StatusPinned })
+	defer srv.Close()
+
+	p := fastPinner([]*Client{NewClient("stub", srv.URL, "secret")})
+	p.Pin(context.Background(), "bafytest", "message")
+	p.Wait()
+	if len(stub.requests) != 1 || stub.requests["req-1"].Status != StatusPinned {
+		t.Fatalf("expected cid to be pinned, got %+v", stub.requests)
+	}
+	if st := p.Status("bafytest"); len(st) != 0 {
+		t.Errorf("expected the settled request to be dropped, got %+v", st)
+	}
+	if err := p.Unpin(context.Background(), "bafytest"); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.removed) != 1 || stub.removed[0] != "req-1" {
+		t.Error("pin request was not removed from the service", stub.removed)
+	}
+
+	// a new Pinner, as after a restart, finds the request on the service
+	p.Pin(context.Background(), "bafyother", "message")
+	p.Wait()
+	restarted := fastPinner([]*Client{NewClient("stub", srv.URL, "secret")})
+	if err := restarted.Unpin(context.Background(), "bafyother"); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.removed) != 2 || len(stub.requests) != 0 {
+		t.Error("untracked pin request was not removed from the service", stub.removed)
+	}
+}
+
+func TestPinRetriesFailedRequests(t *testing.T) {
+	// the first request fails, the retry succeeds
+	stub, srv := newStubService("secret", func(attempt int) Status {
+		if attempt < 2 {
+			return StatusFailed
+		}
+		return StatusPinned
+	})
+	defer srv.Close()
+
+	p := fastPinner([]*Client{NewClient("stub", srv.URL, "secret")})
+	p.OnFailure = func(cid string, service string, err error) {
+		t.Error("unexpected failure", cid, service, err)
+	}
+	p.Pin(context.Background(), "bafytest", "message")
+	p.Wait()
+	if stub.adds != 2 || stub.requests["req-2"].Status != StatusPinned {
+		t.Errorf("expected cid to be pinned on the second attempt, got %+v after %d requests", stub.requests, stub.adds)
+	}
+	if len(p.pins) != 0 {
+		t.Errorf("expected the settled requests to be dropped, got %+v", p.pins)
+	}
+}
+
+func TestPinReportsFailures(t *testing.T) {
+	_, good := newStubService("secret", func(int) Status { return StatusPinned })
+	defer good.Close()
+	badStub, bad := newStubService("secret", func(int) Status { return StatusFailed })
+	defer bad.Close()
+
+	p := fastPinner([]*Client{
+		NewClient("good", good.URL, "secret"),
+		NewClient("bad", bad.URL, "secret"),
+		NewClient("unauthorized", good.URL, "wrong"),
+	})
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	p.OnFailure = func(cid string, service string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed[service] = err
+	}
+	p.Pin(context.Background(), "bafytest", "message")
+	p.Wait()
+
+	if len(failed) != 2 || failed["bad"] != errPinFailed {
+		t.Fatalf("expected failures for bad and unauthorized, got %v", failed)
+	}
+	if e, ok := failed["unauthorized"].(*Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Error("expected an unauthorized error, got", failed["unauthorized"])
+	}
+	if badStub.adds != 3 {
+		t.Errorf("expected 3 attempts on bad, got %d", badStub.adds)
+	}
+	if st := p.Status("bafytest"); len(st) != 0 {
+		t.Errorf("expected the settled requests to be dropped, got %+v", st)
+	}
+}
+
+func TestParseServices(t *testing.T) {
+	clients, err := ParseServices("a=https://a.example/psa|tok1, b=http://127.0.0.1:5000/|tok2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Fatal("expected 2 services, got", len(clients))
+	}
+	if clients[0].Name != "a" || clients[0].endpoint != "https://a.example/psa" || clients[0].token != "tok1" {
+		t.Errorf("unexpected client %+v", clients[0])
+	}
+	if clients[1].Name != "b" || clients[1].endpoint != "http://127.0.0.1:5000" || clients[1].token != "tok2" {
+		t.Errorf("unexpected client %+v", clients[1])
+	}
+	if _, err := ParseServices("a=https://a.example/psa"); err == nil {
+		t.Error("expected error for a record without a token")
+	}
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// maxReturnedHeaders limits the header section of the original message returned in a DSN
+const maxReturnedHeaders = 64 << 10
+
+// Report describes what happened to a message, for a delivery status notification
+type Report struct {
+	// ReportingMTA is the host name of the server sending the DSN
+	ReportingMTA string
+	// To is the envelope sender of the original message, the DSN is sent to it
+	To      string
+	Arrival time.Time
+	// Recipients are the recipients the DSN is about
+	Recipients []Recipient
+	// Headers is the header section of the original message, optional
+	Headers []byte
+}
+
+// action is the Action field of a recipient with status s
+func action(s Status) string {
+	switch s {
+	case StatusDelivered:
+		return "delivered"
+	case StatusPending:
+		return "delayed"
+	}
+	return "failed"
+}
+
+// DSN returns a delivery status notification for r, a multipart/report message (RFC 3464)
+// with a human readable part, the status of each recipient and the original headers.
+// It has to be sent with an empty envelope sender so it is never bounced itself.
+func DSN(r *Report) []byte {
+	b := make([]byte, 12)
+	rand.Read(b)
+	boundary := hex.EncodeToString(b)
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	w := func(format string, args ...interface{}) {
+		fmt.Fprintf(buf, format+"\r\n", args...)
+	}
+	w("From: Mail Delivery System <MAILER-DAEMON@%s>", r.ReportingMTA)
+	w("To: <%s>", r.To)
+	w("Subject: Undelivered Mail Returned to Sender")
+	w("Date: %s", now.Format(time.RFC1123Z))
+	w("Message-ID: <%s@%s>", boundary, r.ReportingMTA)
+	w("Auto-Submitted: auto-replied")
+	w("MIME-Version: 1.0")
+	w("Content-Type: multipart/report; report-type=delivery-status;")
+	w("\tboundary=\"%s\"", boundary)
+	w("")
+	w("--%s", boundary)
+	w("Content-Type: text/plain; charset=utf-8")
+	w("")
+	w("This is the mail system at %s.", r.ReportingMTA)
+	w("")
+	w("Your message could not be delivered to one or more recipients:")
+	w("")
+	for _, rcpt := range r.Recipients {
+		w("<%s>: %s", rcpt.Address, rcpt.Diagnostic)
+	}
+	w("")
+	w("--%s", boundary)
+	w("Content-Type: message/delivery-status")
+	w("")
+	w("Reporting-MTA: dns; %s", r.ReportingMTA)
+	if !r.Arrival.IsZero() {
+		w("Arrival-Date: %s", r.Arrival.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range r.Recipients {
+		w("")
+		w("Final-Recipient: rfc822; %s", rcpt.Address)
+		w("Action: %s", action(rcpt.Status))
+		w("Status: %s", rcpt.Code)
+		if rcpt.RemoteMTA != "" {
+			w("Remote-MTA: dns; %s", rcpt.RemoteMTA)
+			w("Diagnostic-Code: smtp; %s", rcpt.Diagnostic)
+		}
+		w("Last-Attempt-Date: %s", now.Format(time.RFC1123Z))
+	}
+	w("")
+	if len(r.Headers) > 0 {
+		w("--%s", boundary)
+		w("Content-Type: text/rfc822-headers")
+		w("")
+		buf.Write(r.Headers)
+		w("")
+	}
+	w("--%s--", boundary)
+	return buf.Bytes()
+}
+
+// Bounce queues a delivery status notification for r, eg. about the local recipients a
+// received message could not be saved for. It is sent to r.To with an empty envelope sender.
+func (q *Queue) Bounce(r *Report) (string, error) {
+	report := *r
+	report.ReportingMTA = q.Hostname
+	return q.Enqueue("", []string{r.To}, bytes.NewReader(DSN(&report)))
+}
+
+// ReadHeaders returns the header section of the message read from r, up to a size limit
+func ReadHeaders(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxReturnedHeaders))
+	buf := &bytes.Buffer{}
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return buf.Bytes(), nil
+		}
+		buf.Write(line)
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bounce queues a DSN to the sender of m for its failed recipients, the caller must hold the lock
+func (q *Queue) bounce(m *Message) error {
+	failed := make([]Recipient, 0)
+	for _, r := range m.Recipients {
+		if r.Status == StatusFailed {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 || m.From == "" {
+		return nil
+	}
+	f, err := os.Open(q.messagePath(m.ID))
+	if err != nil {
+		return err
+	}
+	headers, err := ReadHeaders(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	dsn := DSN(&Report{ReportingMTA: q.Hostname, To: m.From, Arrival: m.Enqueued, Recipients: failed, Headers: headers})
+	b, err := q.newMessage("", []string{m.From}, bytes.NewReader(dsn))
+	if err != nil {
+		return err
+	}
+	return q.add(b)
+}
@@ -0,0 +1,431 @@
+// Package relay delivers mail to remote SMTP servers: messages are kept in a persistent queue,
+// sent to the MX of each recipient domain and retried on temporary failures. The sender gets
+// a bounce once a recipient has failed for good.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS modes of the outbound connections
+const (
+	// TLSNone never uses STARTTLS
+	TLSNone = "none"
+	// TLSOpportunistic uses STARTTLS when the server offers it, without checking the
+	// certificate, and sends the message in clear otherwise
+	TLSOpportunistic = "opportunistic"
+	// TLSRequired only delivers over STARTTLS with a certificate valid for the MX host
+	TLSRequired = "required"
+)
+
+const (
+	messageFileExt = ".eml"
+	jobFileExt     = ".job"
+)
+
+// defaultRetries is the delay before each new attempt, a message is bounced once they are used up
+var defaultRetries = []time.Duration{
+	5 * time.Minute, 10 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour,
+	4 * time.Hour, 8 * time.Hour, 16 * time.Hour, 24 * time.Hour, 24 * time.Hour, 24 * time.Hour,
+}
+
+var errNoRecipients = errors.New("message has no recipients")
+
+// Status of a recipient of a queued message
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Recipient is a recipient of a queued message and the outcome of its last attempt
+type Recipient struct {
+	Address string `json:"address"`
+	Status  Status `json:"status"`
+	// Code is the enhanced status code of the last attempt, eg. 5.1.1
+	Code string `json:"code,omitempty"`
+	// Diagnostic is the reply of the remote server, or the error, of the last attempt
+	Diagnostic string `json:"diagnostic,omitempty"`
+	// RemoteMTA is the server that gave the reply
+	RemoteMTA string `json:"remote_mta,omitempty"`
+}
+
+// Message is a queued message. Its data is kept next to the job file.
+type Message struct {
+	ID string `json:"id"`
+	// From is the envelope sender, empty for bounces: they are never bounced
+	From        string      `json:"from"`
+	Recipients  []Recipient `json:"recipients"`
+	Enqueued    time.Time   `json:"enqueued"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+}
+
+// Resolver looks up the MX records of a domain, and its address when it has none.
+// It is net.DefaultResolver in production.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Queue is a persistent queue of outbound messages.
+// Each message is a job file and a message file in the queue directory, so they survive restarts.
+type Queue struct {
+	// Hostname is sent with EHLO and names this server in the bounces
+	Hostname string
+	// TLS is one of TLSNone, TLSOpportunistic or TLSRequired
+	TLS string
+	// TLSConfig is the base TLS config of STARTTLS, eg. with the root CAs, optional
+	TLSConfig *tls.Config
+	Resolver  Resolver
+	// Dial connects to the MX hosts, on Port
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	Port int
+	// Retries is the delay before each new attempt, a recipient still pending when they
+	// are used up is bounced
+	Retries []time.Duration
+	// Timeout limits each SMTP transaction
+	Timeout time.Duration
+	// OnFailure is called when an attempt leaves recipients of id pending or failed
+	OnFailure func(id string, rcpt Recipient)
+	// Sign returns the message with its DKIM signature, optional. It is called once, when the
+	// message is queued, bounces included.
+	Sign func(message []byte) ([]byte, error)
+
+	dir   string
+	mu    sync.Mutex
+	jobs  map[string]*Message
+	wake  chan struct{}
+	start sync.Once
+}
+
+// Open loads the queue stored in dir, creating the directory if needed. Set the fields
+// before calling Start.
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: time.Minute}
+	q := &Queue{
+		TLS:      TLSOpportunistic,
+		Resolver: net.DefaultResolver,
+		Dial:     dialer.DialContext,
+		Port:     25,
+		Retries:  defaultRetries,
+		Timeout:  10 * time.Minute,
+		dir:      dir,
+		jobs:     make(map[string]*Message),
+		wake:     make(chan struct{}, 1),
+	}
+	if q.Hostname, _ = os.Hostname(); q.Hostname == "" {
+		q.Hostname = "localhost"
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+jobFileExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		m := &Message{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("corrupt outbound job %s: %s", name, err)
+		}
+		q.jobs[m.ID] = m
+	}
+	return q, nil
+}
+
+// Start delivers the queued messages in the background until ctx is done
+func (q *Queue) Start(ctx context.Context) {
+	q.start.Do(func() {
+		go q.run(ctx)
+	})
+}
+
+// Enqueue queues the message read from data for to, from the envelope sender from.
+// The message is accepted once Enqueue returns, it is on disk.
+func (q *Queue) Enqueue(from string, to []string, data io.Reader) (string, error) {
+	m, err := q.newMessage(from, to, data)
+	if err != nil {
+		return "", err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.add(m); err != nil {
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// newMessage writes the message file of a new message, once each recipient
+func (q *Queue) newMessage(from string, to []string, data io.Reader) (*Message, error) {
+	if len(to) == 0 {
+		return nil, errNoRecipients
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	m := &Message{ID: hex.EncodeToString(b), From: from, Enqueued: time.Now()}
+	m.NextAttempt = m.Enqueued
+	seen := make(map[string]bool, len(to))
+	for _, addr := range to {
+		if k := strings.ToLower(addr); !seen[k] {
+			seen[k] = true
+			m.Recipients = append(m.Recipients, Recipient{Address: addr, Status: StatusPending})
+		}
+	}
+	if q.Sign != nil {
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = q.Sign(b); err != nil {
+			return nil, err
+		}
+		data = bytes.NewReader(b)
+	}
+	err := writeFile(q.messagePath(m.ID), func(w io.Writer) error {
+		_, err := io.Copy(w, data)
+		return err
+	})
+	return m, err
+}
+
+// add writes the job file of m and wakes up the worker, the caller must hold the lock
+func (q *Queue) add(m *Message) error {
+	if err := q.save(m); err != nil {
+		os.Remove(q.messagePath(m.ID))
+		return err
+	}
+	q.jobs[m.ID] = m
+	q.notify()
+	return nil
+}
+
+// Depth returns the number of queued messages
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// Messages returns a copy of the queued messages
+func (q *Queue) Messages() []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := make([]Message, 0, len(q.jobs))
+	for _, m := range q.jobs {
+		c := *m
+		c.Recipients = append([]Recipient(nil), m.Recipients...)
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) messagePath(id string) string {
+	return filepath.Join(q.dir, id+messageFileExt)
+}
+
+// save writes the job file of m, the caller must hold the lock
+func (q *Queue) save(m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(q.dir, m.ID+jobFileExt), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// remove deletes the files of m, the caller must hold the lock
+func (q *Queue) remove(m *Message) error {
+	delete(q.jobs, m.ID)
+	if err := os.Remove(filepath.Join(q.dir, m.ID+jobFileExt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(q.messagePath(m.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes name atomically with what write writes, synced to disk
+func writeFile(name string, write func(io.Writer) error) error {
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// due returns the messages ready to be attempted and when the next one becomes ready
+func (q *Queue) due(now time.Time) ([]*Message, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ready := make([]*Message, 0)
+	var next time.Time
+	for _, m := range q.jobs {
+		if !m.NextAttempt.After(now) {
+			ready = append(ready, m)
+		} else if next.IsZero() || m.NextAttempt.Before(next) {
+			next = m.NextAttempt
+		}
+	}
+	return ready, next
+}
+
+// run attempts the due messages until ctx is done
+func (q *Queue) run(ctx context.Context) {
+	for {
+		ready, next := q.due(time.Now())
+		for _, m := range ready {
+			q.attempt(ctx, m)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+		wait := 24 * time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-q.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// attempt delivers the pending recipients of m, domain by domain. Recipients still pending
+// are retried after the next delay of Retries, or failed when there is none. Once no recipient
+// is pending the message leaves the queue, with a bounce to the sender for the failed ones.
+func (q *Queue) attempt(ctx context.Context, m *Message) {
+	q.mu.Lock()
+	rcpts := append([]Recipient(nil), m.Recipients...)
+	q.mu.Unlock()
+
+	for domain, idx := range byDomain(rcpts) {
+		tctx, cancel := context.WithTimeout(ctx, q.Timeout)
+		q.deliver(tctx, m.ID, m.From, domain, rcpts, idx)
+		cancel()
+		if settled(rcpts, idx) {
+			// saved before the next domain, a shutdown does not send it again to the recipients done
+			q.mu.Lock()
+			m.Recipients = append([]Recipient(nil), rcpts...)
+			if err := q.save(m); err != nil && q.OnFailure != nil {
+				q.OnFailure(m.ID, Recipient{Diagnostic: "could not update the job: " + err.Error()})
+			}
+			q.mu.Unlock()
+		}
+	}
+	if ctx.Err() != nil {
+		// shutting down, the attempt is not counted
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m.Recipients = rcpts
+	m.Attempts++
+	final := m.Attempts > len(q.Retries)
+	pending := false
+	for i := range m.Recipients {
+		r := &m.Recipients[i]
+		if r.Status != StatusPending {
+			continue
+		}
+		if final {
+			// the DSN keeps the last temporary error
+			r.Status = StatusFailed
+		} else {
+			pending = true
+		}
+		if q.OnFailure != nil {
+			q.OnFailure(m.ID, *r)
+		}
+	}
+	if pending {
+		m.NextAttempt = time.Now().Add(q.Retries[m.Attempts-1])
+		if err := q.save(m); err != nil && q.OnFailure != nil {
+			q.OnFailure(m.ID, Recipient{Diagnostic: "could not update the job: " + err.Error()})
+		}
+		return
+	}
+	if err := q.bounce(m); err != nil && q.OnFailure != nil {
+		q.OnFailure(m.ID, Recipient{Diagnostic: "could not queue the bounce: " + err.Error()})
+	}
+	if err := q.remove(m); err != nil && q.OnFailure != nil {
+		q.OnFailure(m.ID, Recipient{Diagnostic: "could not remove the job: " + err.Error()})
+	}
+}
+
+// settled tells if some of the recipients idx of rcpts are not pending anymore
+func settled(rcpts []Recipient, idx []int) bool {
+	for _, i := range idx {
+		if rcpts[i].Status != StatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// byDomain groups the indexes of the pending recipients by domain
+func byDomain(rcpts []Recipient) map[string][]int {
+	ret := make(map[string][]int)
+	for i, r := range rcpts {
+		if r.Status != StatusPending {
+			continue
+		}
+		domain := ""
+		if at := strings.LastIndex(r.Address, "@"); at >= 0 {
+			domain = strings.ToLower(r.Address[at+1:])
+		}
+		ret[domain] = append(ret[domain], i)
+	}
+	return ret
+}
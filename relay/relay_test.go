@@ -0,0 +1,406 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinkMessage is a message received by the sink
+type sinkMessage struct {
+	from string
+	to   []string
+	data []byte
+	tls  bool
+}
+
+// smtpSink is a local SMTP server recording the messages it receives. Recipients in reject
+// are refused for good, the ones in later temporarily.
+type smtpSink struct {
+	sync.Mutex
+	l        net.Listener
+	tls      *tls.Config
+	reject   map[string]bool
+	later    map[string]bool
+	messages []sinkMessage
+}
+
+func newSMTPSink(t *testing.T, cfg *tls.Config) *smtpSink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{l: l, tls: cfg, reject: make(map[string]bool), later: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) received() []sinkMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]sinkMessage(nil), s.messages...)
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ESMTP")
+	m := sinkMessage{}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := ""
+		if i := strings.Index(line, "<"); i >= 0 {
+			arg = strings.ToLower(strings.Trim(line[i:], "<>"))
+		}
+		switch cmd {
+		case "EHLO":
+			if s.tls != nil && !m.tls {
+				tp.PrintfLine("250-sink")
+				tp.PrintfLine("250 STARTTLS")
+			} else {
+				tp.PrintfLine("250 sink")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 2.0.0 ready")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, tp, m.tls = tc, textproto.NewConn(tc), true
+		case "MAIL":
+			m.from, m.to = arg, nil
+			tp.PrintfLine("250 2.1.0 ok")
+		case "RCPT":
+			s.Lock()
+			reject, later := s.reject[arg], s.later[arg]
+			s.Unlock()
+			switch {
+			case reject:
+				tp.PrintfLine("550 5.1.1 no such user")
+			case later:
+				tp.PrintfLine("451 4.3.0 try again later")
+			default:
+				m.to = append(m.to, arg)
+				tp.PrintfLine("250 2.1.5 ok")
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			if m.data, err = tp.ReadDotBytes(); err != nil {
+				return
+			}
+			s.Lock()
+			s.messages = append(s.messages, m)
+			s.Unlock()
+			tp.PrintfLine("250 2.0.0 queued")
+		case "QUIT":
+			tp.PrintfLine("221 2.0.0 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// fakeResolver answers with the MX records of mx and the hosts of hosts, other names don't exist
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string]bool
+}
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if r.hosts[host] {
+		return []string{"127.0.0.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// testQueue returns a queue in a temporary directory using the sink, see useSink
+func testQueue(t *testing.T, sink *smtpSink) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "cryptomail-relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useSink(q, sink)
+	return q, func() {
+		sink.l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// useSink makes q deliver every MX host to the sink, but the ones named down
+func useSink(q *Queue, sink *smtpSink) {
+	q.Hostname = "relay.test"
+	q.Retries = []time.Duration{time.Minute}
+	q.Resolver = &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com":    {{Host: "mx2.example.com.", Pref: 20}, {Host: "down.example.com.", Pref: 10}},
+			"nullmx.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string]bool{"nomx.example": true},
+	}
+	q.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "down.") {
+			return nil, errors.New("connection refused")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, sink.l.Addr().String())
+	}
+}
+
+// certificate returns a self-signed certificate for host and a pool trusting it
+func certificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+const testMessage = "From: alice@local.test\r\nSubject: relay test\r\n\r\nhello\r\n"
+
+func recipient(m *Message, addr string) Recipient {
+	for _, r := range m.Recipients {
+		if r.Address == addr {
+			return r
+		}
+	}
+	return Recipient{}
+}
+
+func TestRelay(t *testing.T) {
+	cert, _ := certificate(t, "mx2.example.com")
+	sink := newSMTPSink(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	sink.reject["nobody@example.com"] = true
+	sink.later["later@example.com"] = true
+	q, cleanup := testQueue(t, sink)
+	defer cleanup()
+
+	id, err := q.Enqueue("alice@local.test", []string{
+		"bob@example.com", "Bob@example.com", "nobody@example.com", "later@example.com",
+		"carol@nomx.example", "dave@nxdomain.example", "erin@nullmx.example",
+	}, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue survives a restart
+	if q, err = Open(q.dir); err != nil {
+		t.Fatal(err)
+	}
+	useSink(q, sink)
+	if q.Depth() != 1 {
+		t.Fatalf("expected 1 queued message, got %d", q.Depth())
+	}
+
+	m := q.jobs[id]
+	q.attempt(context.Background(), m)
+	for addr, expected := range map[string]struct {
+		status Status
+		code   string
+	}{
+		"bob@example.com":       {StatusDelivered, "2.0.0"},
+		"nobody@example.com":    {StatusFailed, "5.1.1"},
+		"later@example.com":     {StatusPending, "4.3.0"},
+		"carol@nomx.example":    {StatusDelivered, "2.0.0"},
+		"dave@nxdomain.example": {StatusFailed, "5.1.2"},
+		"erin@nullmx.example":   {StatusFailed, "5.1.10"},
+	} {
+		if r := recipient(m, addr); r.Status != expected.status || r.Code != expected.code {
+			t.Errorf("unexpected outcome for %s: %+v", addr, r)
+		}
+	}
+	if len(m.Recipients) != 6 {
+		t.Errorf("duplicate recipients were not merged: %+v", m.Recipients)
+	}
+	received := sink.received()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 transactions, got %d", len(received))
+	}
+	for _, r := range received {
+		if r.from != "alice@local.test" || !r.tls || !bytes.Contains(r.data, []byte("Subject: relay test")) {
+			t.Errorf("unexpected message %+v", r)
+		}
+	}
+	if recipient(m, "bob@example.com").RemoteMTA != "mx2.example.com" {
+		t.Error("the backup MX was not used")
+	}
+	if q.Depth() != 1 || m.NextAttempt.Before(time.Now().Add(30*time.Second)) {
+		t.Fatalf("the pending recipient was not scheduled for a retry, next attempt %s", m.NextAttempt)
+	}
+
+	// the retries are used up, the failed recipients are bounced
+	q.attempt(context.Background(), m)
+	if r := recipient(m, "later@example.com"); r.Status != StatusFailed {
+		t.Errorf("expected later to fail, got %+v", r)
+	}
+	messages := q.Messages()
+	if len(messages) != 1 || messages[0].ID == id {
+		t.Fatalf("expected the bounce in the queue, got %+v", messages)
+	}
+	b := messages[0]
+	if b.From != "" || len(b.Recipients) != 1 || b.Recipients[0].Address != "alice@local.test" {
+		t.Fatalf("unexpected bounce %+v", b)
+	}
+	data, err := ioutil.ReadFile(q.messagePath(b.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Final-Recipient: rfc822; nobody@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx2.example.com\r\nDiagnostic-Code: smtp; 550 5.1.1 no such user\r\n",
+		"Final-Recipient: rfc822; later@example.com\r\nAction: failed\r\nStatus: 4.3.0\r\n",
+		"Final-Recipient: rfc822; dave@nxdomain.example",
+		"Content-Type: text/rfc822-headers\r\n\r\nFrom: alice@local.test\r\nSubject: relay test\r\n",
+	} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("the bounce does not contain %q:\n%s", s, data)
+		}
+	}
+	if bytes.Contains(data, []byte("bob@example.com")) {
+		t.Error("the bounce lists a delivered recipient")
+	}
+
+	// a bounce that can't be delivered is dropped
+	q.attempt(context.Background(), q.jobs[b.ID])
+	if q.Depth() != 0 {
+		t.Errorf("a bounce was bounced: %+v", q.Messages())
+	}
+	if names, _ := ioutil.ReadDir(q.dir); len(names) != 0 {
+		t.Errorf("files left in the queue: %d", len(names))
+	}
+}
+
+func TestRequiredTLS(t *testing.T) {
+	cert, pool := certificate(t, "mx2.example.com")
+	for _, c := range []struct {
+		name   string
+		sink   *tls.Config
+		roots  *x509.CertPool
+		status Status
+		code   string
+	}{
+		{"no STARTTLS", nil, pool, StatusPending, "4.7.10"},
+		{"untrusted certificate", &tls.Config{Certificates: []tls.Certificate{cert}}, x509.NewCertPool(), StatusPending, "4.7.5"},
+		{"trusted certificate", &tls.Config{Certificates: []tls.Certificate{cert}}, pool, StatusDelivered, "2.0.0"},
+	} {
+		sink := newSMTPSink(t, c.sink)
+		q, cleanup := testQueue(t, sink)
+		q.TLS, q.TLSConfig = TLSRequired, &tls.Config{RootCAs: c.roots}
+		id, err := q.Enqueue("alice@local.test", []string{"bob@example.com"}, strings.NewReader(testMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := q.jobs[id]
+		q.attempt(context.Background(), m)
+		if r := m.Recipients[0]; r.Status != c.status || r.Code != c.code {
+			t.Errorf("%s: unexpected outcome %+v", c.name, r)
+		}
+		if delivered := len(sink.received()) > 0; delivered != (c.status == StatusDelivered) {
+			t.Errorf("%s: message sent in clear or not sent", c.name)
+		}
+		cleanup()
+	}
+}
+
+func TestAttemptShutdown(t *testing.T) {
+	sink := newSMTPSink(t, nil)
+	q, cleanup := testQueue(t, sink)
+	defer cleanup()
+	id, err := q.Enqueue("alice@local.test", []string{"bob@example.com", "carol@nomx.example"}, strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the service shuts down once the first domain got the message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dial := q.Dial
+	q.Dial = func(dctx context.Context, network, addr string) (net.Conn, error) {
+		if len(sink.received()) > 0 {
+			cancel()
+			return nil, dctx.Err()
+		}
+		return dial(dctx, network, addr)
+	}
+	q.attempt(ctx, q.jobs[id])
+	if len(sink.received()) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(sink.received()))
+	}
+
+	// after a restart only the other domain is left
+	if q, err = Open(q.dir); err != nil {
+		t.Fatal(err)
+	}
+	useSink(q, sink)
+	m := q.jobs[id]
+	delivered := 0
+	for _, r := range m.Recipients {
+		if r.Status == StatusDelivered {
+			delivered++
+		}
+	}
+	if delivered != 1 || m.Attempts != 0 {
+		t.Fatalf("expected the first domain saved as delivered and the attempt not counted, got %+v", m)
+	}
+	q.attempt(context.Background(), m)
+	if len(sink.received()) != 2 || q.Depth() != 0 {
+		t.Errorf("expected the other domain to get the message once, got %d transactions", len(sink.received()))
+	}
+}
@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// enhancedCode matches the enhanced status code at the start of a reply, RFC 3463
+var enhancedCode = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// deliveryError is the outcome of a failed step of a delivery
+type deliveryError struct {
+	// code is the enhanced status code, its class tells if the failure is permanent
+	code string
+	msg  string
+	// mta is the remote server that replied, empty for local errors
+	mta string
+}
+
+func (e *deliveryError) Error() string {
+	return e.msg
+}
+
+func (e *deliveryError) permanent() bool {
+	return strings.HasPrefix(e.code, "5.")
+}
+
+// replyError turns an error of the SMTP client talking to mta into a deliveryError. Replies
+// keep their code, other errors, eg. a lost connection, are local temporary errors with code.
+func replyError(err error, code, mta string) *deliveryError {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		ret := &deliveryError{msg: fmt.Sprintf("%d %s", te.Code, te.Msg), mta: mta}
+		if m := enhancedCode.FindString(te.Msg); m != "" && m[0] == strconv.Itoa(te.Code)[0] {
+			ret.code = m
+		} else {
+			ret.code = fmt.Sprintf("%d.0.0", te.Code/100)
+		}
+		return ret
+	}
+	return &deliveryError{code: code, msg: fmt.Sprintf("%s: %s", mta, err)}
+}
+
+// update sets the outcome of the pending recipients idx of rcpts to err, failing them if it is permanent
+func update(rcpts []Recipient, idx []int, err *deliveryError) {
+	for _, i := range idx {
+		if rcpts[i].Status != StatusPending {
+			continue
+		}
+		rcpts[i].Code, rcpts[i].Diagnostic, rcpts[i].RemoteMTA = err.code, err.msg, err.mta
+		if err.permanent() {
+			rcpts[i].Status = StatusFailed
+		}
+	}
+}
+
+// mxHosts returns the hosts mail for domain is sent to, by preference. A domain without MX
+// records is its own MX, a domain with a null MX (RFC 7505) does not accept mail.
+func (q *Queue) mxHosts(ctx context.Context, domain string) ([]string, *deliveryError) {
+	if domain == "" {
+		return nil, &deliveryError{code: "5.1.3", msg: "recipient address has no domain"}
+	}
+	mx, err := q.Resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, &deliveryError{code: "4.4.3", msg: fmt.Sprintf("MX lookup for %s failed: %s", domain, err)}
+	}
+	if len(mx) == 0 {
+		if _, err := q.Resolver.LookupHost(ctx, domain); err != nil {
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, &deliveryError{code: "5.1.2", msg: fmt.Sprintf("domain %s does not exist", domain)}
+			}
+			return nil, &deliveryError{code: "4.4.3", msg: fmt.Sprintf("address lookup for %s failed: %s", domain, err)}
+		}
+		return []string{domain}, nil
+	}
+	if len(mx) == 1 && (mx[0].Host == "." || mx[0].Host == "") {
+		return nil, &deliveryError{code: "5.1.10", msg: fmt.Sprintf("domain %s does not accept mail (null MX)", domain)}
+	}
+	sort.SliceStable(mx, func(i, j int) bool { return mx[i].Pref < mx[j].Pref })
+	hosts := make([]string, 0, len(mx))
+	for _, r := range mx {
+		hosts = append(hosts, strings.TrimSuffix(r.Host, "."))
+	}
+	return hosts, nil
+}
+
+// deliver sends the message of id to the recipients idx of rcpts, all of domain, trying
+// its MX hosts in turn until one of them takes the transaction
+func (q *Queue) deliver(ctx context.Context, id, from, domain string, rcpts []Recipient, idx []int) {
+	hosts, derr := q.mxHosts(ctx, domain)
+	if derr != nil {
+		update(rcpts, idx, derr)
+		return
+	}
+	for _, host := range hosts {
+		if derr = q.transaction(ctx, host, id, from, rcpts, idx); derr == nil {
+			return
+		}
+	}
+	// the last MX decides, the first ones are usually the best ones but unreachable
+	update(rcpts, idx, derr)
+}
+
+// tlsConfig returns the STARTTLS config for host
+func (q *Queue) tlsConfig(host string) *tls.Config {
+	cfg := &tls.Config{}
+	if q.TLSConfig != nil {
+		cfg = q.TLSConfig.Clone()
+	}
+	cfg.ServerName = host
+	if q.TLS == TLSOpportunistic {
+		// a certificate can't be checked without DANE or MTA-STS, encrypting still defeats passive eavesdroppers
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg
+}
+
+// transaction sends the message to host. It returns an error when the transaction could not
+// take place, the next MX is tried then. Otherwise the outcome of each recipient is in rcpts.
+func (q *Queue) transaction(ctx context.Context, host, id, from string, rcpts []Recipient, idx []int) *deliveryError {
+	conn, err := q.Dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(q.Port)))
+	if err != nil {
+		return &deliveryError{code: "4.4.1", msg: fmt.Sprintf("could not connect to %s: %s", host, err)}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return replyError(err, "4.4.2", host)
+	}
+	defer c.Close()
+	if err := c.Hello(q.Hostname); err != nil {
+		return replyError(err, "4.4.2", host)
+	}
+	if q.TLS != TLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(q.tlsConfig(host)); err != nil {
+				return replyError(err, "4.7.5", host)
+			}
+		} else if q.TLS == TLSRequired {
+			return &deliveryError{code: "4.7.10", msg: fmt.Sprintf("%s does not offer STARTTLS", host), mta: host}
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		derr := replyError(err, "4.4.2", host)
+		if derr.mta == "" || !derr.permanent() {
+			return derr
+		}
+		// the sender is refused, another MX would refuse it too
+		update(rcpts, idx, derr)
+		return nil
+	}
+	accepted := make([]int, 0, len(idx))
+	for _, i := range idx {
+		if rcpts[i].Status != StatusPending {
+			// refused by a previous MX
+			continue
+		}
+		if err := c.Rcpt(rcpts[i].Address); err != nil {
+			derr := replyError(err, "4.4.2", host)
+			if derr.mta == "" {
+				return derr
+			}
+			update(rcpts, []int{i}, derr)
+			continue
+		}
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		c.Quit()
+		return nil
+	}
+	if err := q.data(c, id); err != nil {
+		derr := replyError(err, "4.4.2", host)
+		if derr.mta == "" {
+			return derr
+		}
+		update(rcpts, accepted, derr)
+		return nil
+	}
+	for _, i := range accepted {
+		rcpts[i].Status, rcpts[i].Code, rcpts[i].Diagnostic, rcpts[i].RemoteMTA = StatusDelivered, "2.0.0", "", host
+	}
+	c.Quit()
+	return nil
+}
+
+// data sends the message file of id
+func (q *Queue) data(c *smtp.Client, id string) error {
+	f, err := os.Open(q.messagePath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}